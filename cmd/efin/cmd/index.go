@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"github.com/artilugio0/efin-suite/internal/repl"
+	"github.com/spf13/cobra"
+)
+
+var (
+	indexDBFile string
+)
+
+var indexCmd = &cobra.Command{
+	Use:   "index",
+	Short: "Build the full-text index of the requests DB",
+	Long: `Build the full-text index used by the search operator,
+or add the requests saved by the proxy since it was last built:
+
+  efin index
+  efin query 'requests where resp.body search "password OR token"'`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		repl.RunIndex(indexDBFile)
+	},
+}
+
+func init() {
+	indexCmd.Flags().StringVarP(&indexDBFile, "db-file", "D", "./proxy.db", "Requests DB file path")
+	rootCmd.AddCommand(indexCmd)
+}
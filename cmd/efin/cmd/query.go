@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/artilugio0/efin-suite/internal/repl"
+	"github.com/spf13/cobra"
+)
+
+var (
+	queryDBFile      string
+	querySuiteDBFile string
+	querySaved       string
+	queryExplain     bool
+)
+
+var queryCmd = &cobra.Command{
+	Use:   "query [<query> | --saved <name>]",
+	Short: "Query the requests DB",
+	Long: `Run a query over the requests saved by the proxy
+and show the results, without starting the REPL. The query
+uses the same syntax accepted by the REPL, with or without
+the leading 'query' keyword:
+
+  efin query 'requests where resp.status ge 400 and header.host contains "api"'
+  efin query 'count group by host, status'
+
+Queries saved in the REPL with save_query can be run by name:
+
+  efin query --saved errors
+
+With --explain, the compiled SQL, its parameters, the SQLite
+query plan and the time the query takes are shown instead of
+the results.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if querySaved != "" {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.MinimumNArgs(1)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if querySaved != "" {
+			repl.RunSavedQuery(queryDBFile, querySuiteDBFile, querySaved, queryExplain)
+			return
+		}
+
+		repl.RunQuery(queryDBFile, querySuiteDBFile, strings.Join(args, " "), queryExplain)
+	},
+}
+
+func init() {
+	queryCmd.Flags().StringVarP(&queryDBFile, "db-file", "D", "./proxy.db", "Requests DB file path")
+	queryCmd.Flags().StringVar(&querySuiteDBFile, "suite-db-file", repl.DefaultSuiteDBFile(), "Efin suite DB file path, where saved queries are stored")
+	queryCmd.Flags().StringVarP(&querySaved, "saved", "s", "", "Run the saved query with this name")
+	queryCmd.Flags().BoolVar(&queryExplain, "explain", false, "Show how the query is run instead of its results")
+	rootCmd.AddCommand(queryCmd)
+}
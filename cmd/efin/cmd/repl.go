@@ -6,7 +6,8 @@ import (
 )
 
 var (
-	replDBFile string
+	replDBFile      string
+	replSuiteDBFile string
 )
 
 var replCmd = &cobra.Command{
@@ -14,13 +15,17 @@ var replCmd = &cobra.Command{
 	Short: "Run Efin REPL",
 	Long: `Efin REPL is a Read-Evaluate-Print-Loop
 program that lets you interact with all of the Efin Suite
-tools interactively`,
+tools interactively.
+
+Query macros defined with defq in the macros.lua file, next
+to the suite DB file, are loaded when the REPL starts.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		repl.Run(replDBFile)
+		repl.Run(replDBFile, replSuiteDBFile)
 	},
 }
 
 func init() {
 	replCmd.Flags().StringVarP(&replDBFile, "db-file", "D", "./proxy.db", "Requests DB file path")
+	replCmd.Flags().StringVar(&replSuiteDBFile, "suite-db-file", repl.DefaultSuiteDBFile(), "Efin suite DB file path, where saved queries are stored")
 	rootCmd.AddCommand(replCmd)
 }
@@ -0,0 +1,66 @@
+package ql
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Prefixes of the columns with the value of a request or response header,
+// like "header:Authorization" or "resp_header:Content-Type".
+const (
+	RequestHeaderColumnPrefix  = "header:"
+	ResponseHeaderColumnPrefix = "resp_header:"
+)
+
+const contentTypeColumn = "(SELECT ct.value FROM headers ct WHERE ct.response_id = resp.response_id AND LOWER(ct.name) = 'content-type' LIMIT 1)"
+
+// extraColumns maps the columns that are not fields of fieldColumns to the
+// SQL expression that computes them. mime is the media type of the response,
+// from its Content-Type header or guessed from the start of its body.
+var extraColumns = map[string]string{
+	"content_type": contentTypeColumn,
+	"mime":         "mime_type(" + contentTypeColumn + ", substr(resp.body, 1, 512))",
+}
+
+// CheckColumn returns an error if name is not a column that can be shown
+// for each request of a query: a field queries can be sorted by,
+// content_type, mime or a header column.
+func CheckColumn(name string) error {
+	_, _, err := columnExpression(name)
+	return err
+}
+
+// ColumnNames returns the names of the columns that are not header columns,
+// sorted.
+func ColumnNames() []string {
+	names := slices.Collect(maps.Keys(fieldColumns))
+	names = slices.AppendSeq(names, maps.Keys(extraColumns))
+	slices.Sort(names)
+	return names
+}
+
+// columnExpression returns the SQL expression that computes a column, and
+// its parameters. Header columns have the first value of the header, or
+// NULL if the request or response does not have it.
+func columnExpression(name string) (string, []any, error) {
+	if header, ok := strings.CutPrefix(name, RequestHeaderColumnPrefix); ok && header != "" {
+		return "(SELECT hv.value FROM headers hv WHERE hv.request_id = req.request_id AND LOWER(hv.name) = LOWER(?) LIMIT 1)", []any{header}, nil
+	}
+
+	if header, ok := strings.CutPrefix(name, ResponseHeaderColumnPrefix); ok && header != "" {
+		return "(SELECT hv.value FROM headers hv WHERE hv.response_id = resp.response_id AND LOWER(hv.name) = LOWER(?) LIMIT 1)", []any{header}, nil
+	}
+
+	if column, ok := fieldColumns[name]; ok {
+		return column, nil, nil
+	}
+
+	if column, ok := extraColumns[name]; ok {
+		return column, nil, nil
+	}
+
+	return "", nil, fmt.Errorf("invalid column '%s', expected one of %s, %s<name> or %s<name>",
+		name, strings.Join(ColumnNames(), ", "), RequestHeaderColumnPrefix, ResponseHeaderColumnPrefix)
+}
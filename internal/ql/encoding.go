@@ -0,0 +1,279 @@
+package ql
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The JSON encoding of queries is stable, so that saved queries can be
+// shared as files. Conditions are encoded as objects with a "type" key and
+// the fields of the condition, and/or as {"type": "and", "left": ...,
+// "right": ...} and not as {"type": "not", "condition": ...}.
+
+// conditionTypes maps the type names used in the JSON encoding to the
+// conditions they decode to.
+var conditionTypes = map[string]func() RequestCondition{
+	"id":                 func() RequestCondition { return &RequestIdCondition{} },
+	"timestamp":          func() RequestCondition { return &RequestTimestampCondition{} },
+	"method":             func() RequestCondition { return &RequestMethodCondition{} },
+	"path":               func() RequestCondition { return &RequestPathCondition{} },
+	"endpoint":           func() RequestCondition { return &RequestEndpointCondition{} },
+	"url":                func() RequestCondition { return &RequestURLCondition{} },
+	"host":               func() RequestCondition { return &RequestHostCondition{} },
+	"scheme":             func() RequestCondition { return &RequestSchemeCondition{} },
+	"port":               func() RequestCondition { return &RequestPortCondition{} },
+	"query_string":       func() RequestCondition { return &RequestQueryStringCondition{} },
+	"param":              func() RequestCondition { return &RequestParamCondition{} },
+	"numeric":            func() RequestCondition { return &RequestNumericFieldCondition{} },
+	"header":             func() RequestCondition { return &RequestHeaderCondition{} },
+	"header_number":      func() RequestCondition { return &RequestHeaderNumberCondition{} },
+	"body":               func() RequestCondition { return &RequestBodyCondition{} },
+	"body_param":         func() RequestCondition { return &RequestBodyParamCondition{} },
+	"raw":                func() RequestCondition { return &RequestRawCondition{} },
+	"resp_status":        func() RequestCondition { return &RequestResponseStatusCondition{} },
+	"resp_header":        func() RequestCondition { return &RequestResponseHeaderCondition{} },
+	"resp_header_number": func() RequestCondition { return &RequestResponseHeaderNumberCondition{} },
+	"resp_body":          func() RequestCondition { return &RequestResponseBodyCondition{} },
+	"resp_body_param":    func() RequestCondition { return &RequestResponseBodyParamCondition{} },
+	"resp_raw":           func() RequestCondition { return &RequestResponseRawCondition{} },
+	"subquery":           func() RequestCondition { return &RequestSubqueryCondition{} },
+}
+
+var conditionTypeNames = map[reflect.Type]string{}
+
+func init() {
+	for name, newCondition := range conditionTypes {
+		conditionTypeNames[reflect.TypeOf(newCondition())] = name
+	}
+}
+
+var queryOperationNames = map[QueryOperation]string{
+	QueryOperationGet:   "get",
+	QueryOperationCount: "count",
+}
+
+type queryJSON struct {
+	Operation     string          `json:"operation"`
+	Where         json.RawMessage `json:"where,omitempty"`
+	GroupBy       []string        `json:"group_by,omitempty"`
+	OrderBy       []OrderBy       `json:"order_by,omitempty"`
+	Limit         int             `json:"limit,omitempty"`
+	Offset        int             `json:"offset,omitempty"`
+	SetOperations []SetOperation  `json:"set_operations,omitempty"`
+}
+
+func (q *Query) MarshalJSON() ([]byte, error) {
+	operation, ok := queryOperationNames[q.Operation]
+	if !ok {
+		return nil, fmt.Errorf("invalid query operation '%d'", q.Operation)
+	}
+
+	encoded := queryJSON{
+		Operation:     operation,
+		GroupBy:       q.GroupBy,
+		OrderBy:       q.OrderBy,
+		Limit:         q.Limit,
+		Offset:        q.Offset,
+		SetOperations: q.SetOperations,
+	}
+
+	if q.RequestCondition != nil {
+		where, err := marshalCondition(q.RequestCondition)
+		if err != nil {
+			return nil, err
+		}
+		encoded.Where = where
+	}
+
+	return json.Marshal(encoded)
+}
+
+func (q *Query) UnmarshalJSON(data []byte) error {
+	var encoded queryJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+
+	operation := QueryOperation(-1)
+	for op, name := range queryOperationNames {
+		if name == encoded.Operation {
+			operation = op
+		}
+	}
+	if operation < 0 {
+		return fmt.Errorf("invalid query operation '%s'", encoded.Operation)
+	}
+
+	*q = Query{
+		Operation:     operation,
+		GroupBy:       encoded.GroupBy,
+		OrderBy:       encoded.OrderBy,
+		Limit:         encoded.Limit,
+		Offset:        encoded.Offset,
+		SetOperations: encoded.SetOperations,
+	}
+
+	if len(encoded.Where) > 0 {
+		condition, err := unmarshalCondition(encoded.Where)
+		if err != nil {
+			return err
+		}
+		q.RequestCondition = condition
+	}
+
+	return nil
+}
+
+func marshalCondition(c RequestCondition) (json.RawMessage, error) {
+	switch c := c.(type) {
+	case *AndCondition:
+		return marshalCompoundCondition("and", c.Condition1, c.Condition2)
+
+	case *OrCondition:
+		return marshalCompoundCondition("or", c.Condition1, c.Condition2)
+
+	case *NotCondition:
+		condition, err := marshalCondition(c.Condition)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(map[string]any{"type": "not", "condition": condition})
+	}
+
+	name, ok := conditionTypeNames[reflect.TypeOf(c)]
+	if !ok {
+		return nil, fmt.Errorf("cannot encode condition of type %T", c)
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["type"] = json.RawMessage(strconv.Quote(name))
+
+	return json.Marshal(fields)
+}
+
+func marshalCompoundCondition(name string, left, right RequestCondition) (json.RawMessage, error) {
+	leftData, err := marshalCondition(left)
+	if err != nil {
+		return nil, err
+	}
+
+	rightData, err := marshalCondition(right)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]any{"type": name, "left": leftData, "right": rightData})
+}
+
+// uniqueIDCounter numbers the decoded conditions that need a unique ID, like
+// the ones created by the parser from the position of their tokens.
+var uniqueIDCounter atomic.Int64
+
+func unmarshalCondition(data json.RawMessage) (RequestCondition, error) {
+	var node struct {
+		Type      string          `json:"type"`
+		Left      json.RawMessage `json:"left"`
+		Right     json.RawMessage `json:"right"`
+		Condition json.RawMessage `json:"condition"`
+	}
+	if err := json.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+
+	switch node.Type {
+	case "and", "or":
+		left, err := unmarshalCondition(node.Left)
+		if err != nil {
+			return nil, err
+		}
+
+		right, err := unmarshalCondition(node.Right)
+		if err != nil {
+			return nil, err
+		}
+
+		if node.Type == "and" {
+			return &AndCondition{Condition1: left, Condition2: right}, nil
+		}
+		return &OrCondition{Condition1: left, Condition2: right}, nil
+
+	case "not":
+		condition, err := unmarshalCondition(node.Condition)
+		if err != nil {
+			return nil, err
+		}
+
+		return &NotCondition{Condition: condition}, nil
+	}
+
+	newCondition, ok := conditionTypes[node.Type]
+	if !ok {
+		return nil, fmt.Errorf("invalid condition type '%s'", node.Type)
+	}
+
+	c := newCondition()
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("invalid %s condition: %v", node.Type, err)
+	}
+
+	if id := reflect.ValueOf(c).Elem().FieldByName("UniqueID"); id.IsValid() {
+		id.SetString("d" + strconv.FormatInt(uniqueIDCounter.Add(1), 10))
+	}
+
+	return c, nil
+}
+
+// timestampValueJSON is the encoding of a TimestampValue, with Ago in the
+// format of ParseDuration, like "1h30m".
+type timestampValueJSON struct {
+	Ago       string    `json:"ago,omitempty"`
+	Time      time.Time `json:"time,omitzero"`
+	RequestId string    `json:"request_id,omitempty"`
+}
+
+func (v TimestampValue) MarshalJSON() ([]byte, error) {
+	encoded := timestampValueJSON{
+		Time:      v.Time,
+		RequestId: v.RequestId,
+	}
+	if v.Ago != 0 {
+		encoded.Ago = FormatDuration(v.Ago)
+	}
+
+	return json.Marshal(encoded)
+}
+
+func (v *TimestampValue) UnmarshalJSON(data []byte) error {
+	var decoded timestampValueJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*v = TimestampValue{
+		Time:      decoded.Time,
+		RequestId: decoded.RequestId,
+	}
+
+	if decoded.Ago != "" {
+		ago, err := ParseDuration(decoded.Ago)
+		if err != nil {
+			return err
+		}
+		v.Ago = ago
+	}
+
+	return nil
+}
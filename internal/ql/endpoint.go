@@ -0,0 +1,59 @@
+package ql
+
+import (
+	"regexp"
+	"strings"
+)
+
+// EndpointPlaceholder replaces the path segments that identify objects in
+// the endpoint of a request.
+const EndpointPlaceholder = "{id}"
+
+var (
+	uuidSegmentRE  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegmentRE   = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	tokenSegmentRE = regexp.MustCompile(`^[0-9A-Za-z_-]{20,}$`)
+)
+
+// NormalizePath returns the endpoint of a URL path: the path with the
+// segments that look like object identifiers replaced with "{id}". Numbers,
+// UUIDs, hex hashes and long random tokens are identifiers, so
+// "/users/123/orders/9" and "/users/456/orders/10" are both
+// "/users/{id}/orders/{id}".
+func NormalizePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if isIdentifierSegment(s) {
+			segments[i] = EndpointPlaceholder
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func isIdentifierSegment(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	if strings.Trim(s, "0123456789") == "" || uuidSegmentRE.MatchString(s) {
+		return true
+	}
+
+	// Hashes and random tokens have digits, which tells them apart from long
+	// words like "authentication" or "deadbeefcafebabe"
+	if !strings.ContainsAny(s, "0123456789") {
+		return false
+	}
+
+	if hexSegmentRE.MatchString(s) {
+		return true
+	}
+
+	// Random tokens, like base64 encoded keys, mix letters and digits
+	return tokenSegmentRE.MatchString(s) && strings.Trim(s, "0123456789_-") != ""
+}
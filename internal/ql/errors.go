@@ -0,0 +1,175 @@
+package ql
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ParseError is an error found while parsing a query. Every error returned
+// by ParseQuery is a ParseError.
+type ParseError struct {
+	// Pos is the byte offset of the input where the error was found
+	Pos int
+	// Found is the text of the token found at Pos, empty at the end of the
+	// input
+	Found string
+	// Expected are the tokens that would have been valid at Pos, when they
+	// are known
+	Expected []string
+	// Suggestion is the expected token closest to the one found, if there is
+	// one close enough to be a typo
+	Suggestion string
+
+	msg string
+}
+
+func (e *ParseError) Error() string {
+	s := fmt.Sprintf("%s (at position %d)", e.msg, e.Pos)
+	if e.Suggestion != "" {
+		s += fmt.Sprintf(". Did you mean '%s'?", e.Suggestion)
+	}
+
+	return s
+}
+
+// Annotate renders the error followed by the line of the input where it was
+// found, with a caret under the position of the error.
+func (e *ParseError) Annotate(input string) string {
+	pos := min(max(e.Pos, 0), len(input))
+
+	lineStart := strings.LastIndexByte(input[:pos], '\n') + 1
+	lineEnd := len(input)
+	if i := strings.IndexByte(input[pos:], '\n'); i >= 0 {
+		lineEnd = pos + i
+	}
+
+	// Tabs are kept so that the caret is aligned with the line
+	caret := []rune{}
+	for _, c := range input[lineStart:pos] {
+		if c == '\t' {
+			caret = append(caret, '\t')
+		} else {
+			caret = append(caret, ' ')
+		}
+	}
+
+	return e.Error() + "\n" + input[lineStart:lineEnd] + "\n" + string(caret) + "^"
+}
+
+// AsParseError returns the ParseError wrapped by err, if there is one.
+func AsParseError(err error) (*ParseError, bool) {
+	var parseError *ParseError
+	if errors.As(err, &parseError) {
+		return parseError, true
+	}
+
+	return nil, false
+}
+
+// errorf returns a ParseError at the position of the last token read or
+// peeked. The token found is appended to the message.
+func (t *Tokenizer) errorf(expected []string, format string, args ...any) *ParseError {
+	found := t.tokenText()
+
+	msg := fmt.Sprintf(format, args...)
+	if found == "" {
+		msg += ". Found input end instead"
+	} else {
+		msg += fmt.Sprintf(". Found '%s' instead", found)
+	}
+
+	return &ParseError{
+		Pos:        t.tokenStart,
+		Found:      found,
+		Expected:   expected,
+		Suggestion: closestMatch(found, expected),
+		msg:        msg,
+	}
+}
+
+// wrapError turns the errors that are not ParseErrors, like the ones of
+// invalid values, into ParseErrors at the position of the last token.
+func (t *Tokenizer) wrapError(err error) *ParseError {
+	if parseError, ok := AsParseError(err); ok {
+		return parseError
+	}
+
+	return &ParseError{
+		Pos:   t.tokenStart,
+		Found: t.tokenText(),
+		msg:   err.Error(),
+	}
+}
+
+// tokenText returns the text of the input of the last token read or peeked,
+// or of the invalid text found there.
+func (t *Tokenizer) tokenText() string {
+	pos, tokenStart := t.pos, t.tokenStart
+	defer func() {
+		t.pos, t.tokenStart = pos, tokenStart
+	}()
+
+	t.pos = tokenStart
+	_, end, err := t.peekToken()
+	if err != nil || end <= tokenStart {
+		end = tokenStart
+		for end < len(t.input) && !unicode.IsSpace(rune(t.input[end])) {
+			end++
+		}
+	}
+
+	return t.input[tokenStart:end]
+}
+
+// closestMatch returns the candidate closest to s, if it is close enough to
+// be a typo of s.
+func closestMatch(s string, candidates []string) string {
+	s = strings.ToLower(s)
+	if s == "" {
+		return ""
+	}
+
+	best := ""
+	bestDistance := 0
+	for _, c := range candidates {
+		d := editDistance(s, strings.ToLower(c))
+		if d == 0 {
+			return ""
+		}
+
+		if best == "" || d < bestDistance {
+			best, bestDistance = c, d
+		}
+	}
+
+	if best == "" || bestDistance > 2 || bestDistance >= len(s) {
+		return ""
+	}
+
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr := make([]int, len(b)+1)
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev = curr
+	}
+
+	return prev[len(b)]
+}
@@ -0,0 +1,263 @@
+package ql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// String returns the query as a text query, with parentheses around every
+// and and or condition that is part of another condition, so that it shows
+// how the query was read.
+func (q *Query) String() string {
+	var buf strings.Builder
+
+	buf.WriteString("query ")
+	if q.Operation == QueryOperationCount {
+		buf.WriteString("count")
+	} else {
+		buf.WriteString("requests")
+	}
+
+	q.writeConditions(&buf)
+
+	if len(q.GroupBy) > 0 {
+		buf.WriteString(" group by " + strings.Join(q.GroupBy, ", "))
+	}
+
+	if len(q.OrderBy) > 0 {
+		terms := make([]string, len(q.OrderBy))
+		for i, o := range q.OrderBy {
+			terms[i] = o.Field
+			if o.Descending {
+				terms[i] += " desc"
+			}
+		}
+		buf.WriteString(" order by " + strings.Join(terms, ", "))
+	}
+
+	if q.Limit > 0 {
+		buf.WriteString(" limit " + strconv.Itoa(q.Limit))
+	}
+
+	if q.Offset > 0 {
+		buf.WriteString(" offset " + strconv.Itoa(q.Offset))
+	}
+
+	return buf.String()
+}
+
+// writeConditions writes the where clause and the set operations of q.
+func (q *Query) writeConditions(buf *strings.Builder) {
+	if q.RequestCondition != nil {
+		buf.WriteString(" where " + FormatCondition(q.RequestCondition))
+	}
+
+	for _, op := range q.SetOperations {
+		buf.WriteString(" " + op.Operator + " query requests")
+		if op.Query != nil {
+			op.Query.writeConditions(buf)
+		}
+	}
+}
+
+// FormatCondition returns a condition in the text query syntax, with
+// parentheses around every and and or condition that is part of another
+// condition.
+func FormatCondition(c RequestCondition) string {
+	switch c := c.(type) {
+	case *AndCondition:
+		return formatOperand(c.Condition1) + " and " + formatOperand(c.Condition2)
+
+	case *OrCondition:
+		return formatOperand(c.Condition1) + " or " + formatOperand(c.Condition2)
+
+	case *NotCondition:
+		return "not " + formatOperand(c.Condition)
+
+	case *RequestIdCondition:
+		return "id " + c.Operator + " " + formatValues(c.Operator, c.Id, c.Ids, formatId)
+
+	case *RequestTimestampCondition:
+		s := "timestamp " + c.Operator + " " + formatTimestampValue(c.Value)
+		if c.Operator == "between" {
+			s += " and " + formatTimestampValue(c.End)
+		}
+		return s
+
+	case *RequestMethodCondition:
+		format := formatString
+		switch c.Operator {
+		case "eq", "ne", "in":
+			format = strings.ToUpper
+		}
+		return "method " + c.Operator + " " + formatValues(c.Operator, c.Value, c.Values, format)
+
+	case *RequestPathCondition:
+		return formatTextCondition("path", c.Operator, c.Value, c.Values)
+
+	case *RequestEndpointCondition:
+		return formatTextCondition("endpoint", c.Operator, c.Value, c.Values)
+
+	case *RequestURLCondition:
+		return formatTextCondition("url", c.Operator, c.Value, c.Values)
+
+	case *RequestHostCondition:
+		return formatTextCondition("host", c.Operator, c.Value, c.Values)
+
+	case *RequestSchemeCondition:
+		return formatTextCondition("scheme", c.Operator, c.Value, c.Values)
+
+	case *RequestQueryStringCondition:
+		return formatTextCondition("query_string", c.Operator, c.Value, c.Values)
+
+	case *RequestPortCondition:
+		return formatNumberCondition("port", c.Operator, c.Value, c.Values)
+
+	case *RequestParamCondition:
+		return formatTextCondition("param."+formatName(c.Name), c.Operator, c.Value, c.Values)
+
+	case *RequestNumericFieldCondition:
+		return formatNumberCondition(c.Field, c.Operator, c.Value, c.Values)
+
+	case *RequestHeaderCondition:
+		return formatTextCondition("header."+formatName(c.Name), c.Operator, c.Value, c.Values)
+
+	case *RequestHeaderNumberCondition:
+		return formatNumberCondition("header."+formatName(c.Name)+".as_number", c.Operator, c.Value, c.Values)
+
+	case *RequestBodyCondition:
+		return formatTextCondition("body", c.Operator, c.Value, c.Values)
+
+	case *RequestBodyParamCondition:
+		return formatTextCondition(c.Format+"."+formatName(c.Name), c.Operator, c.Value, c.Values)
+
+	case *RequestRawCondition:
+		return formatTextCondition("raw", c.Operator, c.Value, nil)
+
+	case *RequestResponseStatusCondition:
+		if c.Operator == "class" {
+			return "resp.status class '" + strconv.Itoa(c.Value) + "xx'"
+		}
+		return formatNumberCondition("resp.status", c.Operator, c.Value, c.Values)
+
+	case *RequestResponseHeaderCondition:
+		return formatTextCondition("resp.header."+formatName(c.Name), c.Operator, c.Value, c.Values)
+
+	case *RequestResponseHeaderNumberCondition:
+		return formatNumberCondition("resp.header."+formatName(c.Name)+".as_number", c.Operator, c.Value, c.Values)
+
+	case *RequestResponseBodyCondition:
+		return formatTextCondition("resp.body", c.Operator, c.Value, c.Values)
+
+	case *RequestResponseBodyParamCondition:
+		return formatTextCondition("resp."+c.Format+"."+formatName(c.Name), c.Operator, c.Value, c.Values)
+
+	case *RequestResponseRawCondition:
+		return formatTextCondition("resp.raw", c.Operator, c.Value, nil)
+
+	case *RequestSubqueryCondition:
+		var buf strings.Builder
+		buf.WriteString(c.Field + " in (query requests")
+		if c.Query != nil {
+			c.Query.writeConditions(&buf)
+		}
+		buf.WriteString(")")
+		return buf.String()
+	}
+
+	return fmt.Sprintf("<%T>", c)
+}
+
+// formatOperand formats a condition that is part of another condition.
+func formatOperand(c RequestCondition) string {
+	switch c.(type) {
+	case *AndCondition, *OrCondition:
+		return "(" + FormatCondition(c) + ")"
+	}
+
+	return FormatCondition(c)
+}
+
+func formatTextCondition(field, operator, value string, values []string) string {
+	if operator == "exists" {
+		return field + " exists"
+	}
+
+	return field + " " + operator + " " + formatValues(operator, value, values, formatString)
+}
+
+func formatNumberCondition(field, operator string, value int, values []int) string {
+	if operator == "exists" {
+		return field + " exists"
+	}
+
+	if operator == "in" {
+		items := make([]string, len(values))
+		for i, v := range values {
+			items[i] = strconv.Itoa(v)
+		}
+		return field + " in (" + strings.Join(items, ", ") + ")"
+	}
+
+	return field + " " + operator + " " + strconv.Itoa(value)
+}
+
+func formatValues(operator, value string, values []string, format func(string) string) string {
+	if operator != "in" {
+		return format(value)
+	}
+
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = format(v)
+	}
+
+	return "(" + strings.Join(items, ", ") + ")"
+}
+
+// formatString quotes a string value. There are no escape sequences, so
+// strings with single quotes are quoted with double quotes.
+func formatString(s string) string {
+	if strings.Contains(s, "'") {
+		return `"` + s + `"`
+	}
+
+	return "'" + s + "'"
+}
+
+// formatName returns a header or parameter name as it is written after the
+// dot, which is quoted unless it is a single name token.
+func formatName(name string) string {
+	tk := NewTokenizer(name)
+	token, err := tk.NextToken()
+	if err == nil && tk.GetPosition() == len(name) {
+		switch token.(type) {
+		case TokenIdentifier, TokenHeaderName:
+			return name
+		}
+	}
+
+	return formatString(name)
+}
+
+func formatId(id string) string {
+	if numberRE.MatchString(id) || uuidRE.MatchString(id) {
+		return id
+	}
+
+	return formatString(id)
+}
+
+func formatTimestampValue(v TimestampValue) string {
+	if v.RequestId != "" {
+		return "request " + formatId(v.RequestId)
+	}
+
+	if !v.Time.IsZero() {
+		return formatString(v.Time.Format(time.RFC3339))
+	}
+
+	return FormatDuration(v.Ago) + " ago"
+}
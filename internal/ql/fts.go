@@ -0,0 +1,127 @@
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// FullTextIndexTable is the FTS5 table that indexes the text of requests and
+// responses for the search operator. It lives in the proxy DB file, along
+// with the mark of the last build, but both are only written by efin-suite,
+// with BuildFullTextIndex.
+const FullTextIndexTable = "efin_fts"
+
+// The row id of each indexed entry is the id of the request
+const fullTextIndexSchema = `CREATE VIRTUAL TABLE IF NOT EXISTS ` + FullTextIndexTable + ` USING fts5(
+	url,
+	req_headers,
+	req_body,
+	resp_headers,
+	resp_body
+)`
+
+// fullTextIndexStateSchema keeps the mark of the index: every request up to
+// it was indexed, or has no response and is not waited for anymore.
+const fullTextIndexStateSchema = `CREATE TABLE IF NOT EXISTS ` + FullTextIndexTable + `_state (
+	id INTEGER PRIMARY KEY CHECK (id = 0),
+	mark INTEGER NOT NULL
+)`
+
+// fullTextIndexPendingRequests is how many requests behind the newest one a
+// build waits for the response of a request. Requests whose response never
+// arrives, like the ones that failed, are not indexed once they are further
+// behind.
+const fullTextIndexPendingRequests = 1000
+
+// The mark of the next build stays before the oldest request that is still
+// waiting for its response. Without any, it is the id of the last request.
+const fullTextIndexNextMark = `SELECT IFNULL(
+	(SELECT MIN(r.request_id) - 1 FROM requests r
+		WHERE r.request_id > MAX(?1, (SELECT MAX(request_id) FROM requests) - ?2)
+		AND NOT EXISTS (SELECT 1 FROM responses WHERE response_id = r.request_id)),
+	(SELECT IFNULL(MAX(request_id), 0) FROM requests))`
+
+// Only requests with a response are indexed, so that the response is in the
+// index too. Requests after the mark can be indexed already, when the mark
+// stays before a request waiting for its response, and they are skipped.
+const fullTextIndexInsert = `INSERT INTO ` + FullTextIndexTable + ` (rowid, url, req_headers, req_body, resp_headers, resp_body)
+SELECT
+	req.request_id,
+	req.url,
+	(SELECT group_concat(h.name || ': ' || h.value, char(10)) FROM headers h WHERE h.request_id = req.request_id),
+	CAST(req.body AS TEXT),
+	(SELECT group_concat(h.name || ': ' || h.value, char(10)) FROM headers h WHERE h.response_id = resp.response_id),
+	CAST(resp.body AS TEXT)
+FROM requests req
+INNER JOIN responses resp ON req.request_id = resp.response_id
+WHERE req.request_id > ?
+AND NOT EXISTS (SELECT 1 FROM ` + FullTextIndexTable + ` f WHERE f.rowid = req.request_id)`
+
+// BuildFullTextIndex creates the full-text index if it does not exist and
+// adds the requests saved since the last build. It returns the number of
+// requests added to the index.
+func BuildFullTextIndex(ctx context.Context, db *sql.DB) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, schema := range []string{fullTextIndexSchema, fullTextIndexStateSchema} {
+		if _, err := tx.ExecContext(ctx, schema); err != nil {
+			return 0, fmt.Errorf("could not create the full-text index: %v", err)
+		}
+	}
+
+	var mark int64
+	err = tx.QueryRowContext(ctx, "SELECT mark FROM "+FullTextIndexTable+"_state WHERE id = 0").Scan(&mark)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("could not read the full-text index mark: %v", err)
+	}
+
+	var next int64
+	if err := tx.QueryRowContext(ctx, fullTextIndexNextMark, mark, fullTextIndexPendingRequests).Scan(&next); err != nil {
+		return 0, fmt.Errorf("could not update the full-text index: %v", err)
+	}
+
+	result, err := tx.ExecContext(ctx, fullTextIndexInsert, mark)
+	if err != nil {
+		return 0, fmt.Errorf("could not update the full-text index: %v", err)
+	}
+
+	added, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO "+FullTextIndexTable+"_state (id, mark) VALUES (0, ?) ON CONFLICT (id) DO UPDATE SET mark = excluded.mark",
+		max(next, mark),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("could not update the full-text index mark: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return added, nil
+}
+
+// IsMissingFullTextIndex reports whether err was caused by running a search
+// before the full-text index was built.
+func IsMissingFullTextIndex(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such table: "+FullTextIndexTable)
+}
+
+// searchCondition compiles the search operator, which takes an FTS5 query
+// and matches it against the given columns of the full-text index.
+func searchCondition(query string, columns ...string) (string, []any) {
+	match := "{" + strings.Join(columns, " ") + "} : (" + query + ")"
+	condition := "req.request_id IN (SELECT rowid FROM " + FullTextIndexTable + " WHERE " + FullTextIndexTable + " MATCH ?)"
+
+	return condition, []any{match}
+}
@@ -0,0 +1,269 @@
+package ql
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"modernc.org/sqlite"
+)
+
+// regexpCache keeps the compiled patterns used by the REGEXP operator so
+// that a query does not compile the same expression once per row.
+var regexpCache sync.Map
+
+func init() {
+	// SQLite translates "X REGEXP Y" into a call to regexp(Y, X).
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, sqlRegexp)
+
+	// URL parts, used by the host, scheme, port, path, endpoint,
+	// query_string and param fields. They return NULL for URLs that cannot
+	// be parsed.
+	sqlite.MustRegisterDeterministicScalarFunction("url_host", 1, urlPartFunction(func(u *url.URL) driver.Value {
+		return strings.ToLower(u.Hostname())
+	}))
+	sqlite.MustRegisterDeterministicScalarFunction("url_scheme", 1, urlPartFunction(func(u *url.URL) driver.Value {
+		return strings.ToLower(u.Scheme)
+	}))
+	sqlite.MustRegisterDeterministicScalarFunction("url_port", 1, urlPartFunction(urlPort))
+	sqlite.MustRegisterDeterministicScalarFunction("url_path", 1, urlPartFunction(func(u *url.URL) driver.Value {
+		return u.EscapedPath()
+	}))
+	sqlite.MustRegisterDeterministicScalarFunction("url_query", 1, urlPartFunction(func(u *url.URL) driver.Value {
+		return u.RawQuery
+	}))
+	sqlite.MustRegisterDeterministicScalarFunction("url_param", 2, sqlURLParam)
+	sqlite.MustRegisterDeterministicScalarFunction("url_endpoint", 1, urlPartFunction(func(u *url.URL) driver.Value {
+		return NormalizePath(u.EscapedPath())
+	}))
+
+	// Body parameters, used by the form and multipart fields
+	sqlite.MustRegisterDeterministicScalarFunction("form_param", 2, sqlFormParam)
+	sqlite.MustRegisterDeterministicScalarFunction("multipart_param", 3, sqlMultipartParam)
+
+	// Media type of a response, used by the mime column
+	sqlite.MustRegisterDeterministicScalarFunction("mime_type", 2, sqlMimeType)
+}
+
+func sqlRegexp(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	pattern, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("regexp: pattern must be a string")
+	}
+
+	if args[1] == nil {
+		return false, nil
+	}
+
+	re, err := compileRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := args[1].(type) {
+	case string:
+		return re.MatchString(v), nil
+	case []byte:
+		return re.Match(v), nil
+	default:
+		return re.MatchString(fmt.Sprint(v)), nil
+	}
+}
+
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexpCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression '%s': %v", pattern, err)
+	}
+	regexpCache.Store(pattern, re)
+
+	return re, nil
+}
+
+// urlPartFunction returns an SQL function that parses its URL argument and
+// returns the part of it computed by part.
+func urlPartFunction(part func(*url.URL) driver.Value) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		u, ok := sqlURL(args[0])
+		if !ok {
+			return nil, nil
+		}
+
+		return part(u), nil
+	}
+}
+
+// sqlURLParam returns the first value of a query parameter, or NULL if the
+// URL does not have it.
+func sqlURLParam(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	name, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("url_param: parameter name must be a string")
+	}
+
+	u, ok := sqlURL(args[0])
+	if !ok {
+		return nil, nil
+	}
+
+	return queryParam(u.RawQuery, name), nil
+}
+
+// sqlFormParam returns the first value of a parameter of an URL encoded
+// form body, or NULL if the body does not have it.
+func sqlFormParam(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	name, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("form_param: parameter name must be a string")
+	}
+
+	body, ok := sqlText(args[0])
+	if !ok {
+		return nil, nil
+	}
+
+	return queryParam(body, name), nil
+}
+
+func queryParam(query, name string) driver.Value {
+	values, err := url.ParseQuery(query)
+	if err != nil && len(values) == 0 {
+		return nil
+	}
+
+	if v, ok := values[name]; ok && len(v) > 0 {
+		return v[0]
+	}
+
+	return nil
+}
+
+// sqlMultipartParam returns the value of the first part of a multipart body
+// with the given form name, or NULL if the body does not have it. The
+// boundary is taken from the Content-Type header value.
+func sqlMultipartParam(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	name, ok := args[2].(string)
+	if !ok {
+		return nil, fmt.Errorf("multipart_param: parameter name must be a string")
+	}
+
+	body, ok := sqlText(args[0])
+	if !ok {
+		return nil, nil
+	}
+
+	contentType, ok := sqlText(args[1])
+	if !ok {
+		return nil, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, nil
+	}
+
+	reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			// Truncated or malformed bodies match the parts read so far
+			return nil, nil
+		}
+
+		if part.FormName() != name {
+			continue
+		}
+
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return nil, nil
+		}
+
+		return string(value), nil
+	}
+}
+
+// urlPort returns the port of a URL, which is the default port of its scheme
+// if it is not explicit.
+func urlPort(u *url.URL) driver.Value {
+	if port := u.Port(); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return nil
+		}
+		return int64(n)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "ws":
+		return int64(80)
+	case "https", "wss":
+		return int64(443)
+	}
+
+	return nil
+}
+
+func sqlURL(value driver.Value) (*url.URL, bool) {
+	s, ok := sqlText(value)
+	if !ok {
+		return nil, false
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, false
+	}
+
+	return u, true
+}
+
+// sqlText returns the text of a TEXT or BLOB value.
+func sqlText(value driver.Value) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+
+	return "", false
+}
+
+// sqlMimeType returns the media type of a Content-Type header value, without
+// its parameters. If there is no header, the media type is guessed from the
+// start of the body, and if the body is empty too it returns NULL.
+func sqlMimeType(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if contentType, ok := args[0].(string); ok && contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+			return mediaType, nil
+		}
+		return strings.TrimSpace(strings.ToLower(contentType)), nil
+	}
+
+	var body []byte
+	switch v := args[1].(type) {
+	case []byte:
+		body = v
+	case string:
+		body = []byte(v)
+	}
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	return mediaType, nil
+}
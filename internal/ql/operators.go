@@ -0,0 +1,107 @@
+package ql
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Operators supported by each kind of field. Both the text query parser and
+// the conditions use these lists, so every operator that can be parsed for
+// a field also compiles. The search operator uses the full-text index.
+var (
+	textOperators      = []string{"eq", "ne", "contains", "icontains", "matches", "in"}
+	bodyOperators      = []string{"eq", "ne", "contains", "icontains", "matches", "in", "search"}
+	headerOperators    = []string{"eq", "ne", "contains", "icontains", "matches", "in", "exists"}
+	numericOperators   = []string{"eq", "ne", "lt", "le", "gt", "ge", "in"}
+	statusOperators    = []string{"eq", "ne", "lt", "le", "gt", "ge", "in", "class"}
+	idOperators        = []string{"eq", "ne", "lt", "le", "gt", "ge", "in", "matches"}
+	rawOperators       = []string{"contains", "icontains", "matches", "search"}
+	timestampOperators = []string{"eq", "ne", "lt", "le", "gt", "ge", "between"}
+)
+
+var comparisonOperators = map[string]string{
+	"eq": "=",
+	"ne": "!=",
+	"lt": "<",
+	"le": "<=",
+	"gt": ">",
+	"ge": ">=",
+}
+
+func checkOperator(field, operator string, allowed []string) error {
+	if !slices.Contains(allowed, operator) {
+		return fmt.Errorf("invalid operator '%s' for field '%s'. Valid operators are: %s", operator, field, strings.Join(allowed, ", "))
+	}
+
+	return nil
+}
+
+// compareCondition compiles the comparison operators and the in operator.
+func compareCondition(column, operator string, value any, values []any) (string, []any, error) {
+	if operator == "in" {
+		if len(values) == 0 {
+			return "", nil, fmt.Errorf("the in operator requires at least one value")
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+		return column + " IN (" + placeholders + ")", values, nil
+	}
+
+	op, ok := comparisonOperators[operator]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid operator '%s'", operator)
+	}
+
+	return column + " " + op + " ?", []any{value}, nil
+}
+
+func intValues(values []int) []any {
+	anyValues := make([]any, len(values))
+	for i, v := range values {
+		anyValues[i] = v
+	}
+
+	return anyValues
+}
+
+// ParseStatusClass parses a status class like '5xx' and returns its first
+// digit.
+func ParseStatusClass(s string) (int, error) {
+	class := strings.TrimSuffix(strings.ToLower(s), "xx")
+	if len(class) != 1 || class[0] < '1' || class[0] > '5' {
+		return 0, fmt.Errorf("invalid status class '%s'. Expected one of 1xx, 2xx, 3xx, 4xx or 5xx", s)
+	}
+
+	return int(class[0] - '0'), nil
+}
+
+// textCondition compiles the operators shared by every text field. contains
+// is case sensitive and, unlike LIKE, does not treat % and _ as wildcards.
+func textCondition(column, operator, value string, values []string) (string, []any, error) {
+	switch operator {
+	case "contains":
+		return "instr(" + column + ", ?) > 0", []any{value}, nil
+
+	case "icontains":
+		return "instr(LOWER(" + column + "), LOWER(?)) > 0", []any{value}, nil
+
+	case "matches":
+		return regexpCondition(column, value)
+	}
+
+	anyValues := make([]any, len(values))
+	for i, v := range values {
+		anyValues[i] = v
+	}
+
+	return compareCondition(column, operator, value, anyValues)
+}
+
+func regexpCondition(column, pattern string) (string, []any, error) {
+	if _, err := compileRegexp(pattern); err != nil {
+		return "", nil, err
+	}
+
+	return column + " REGEXP ?", []any{pattern}, nil
+}
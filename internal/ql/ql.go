@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -11,16 +12,19 @@ import (
 )
 
 var identifierRE *regexp.Regexp = regexp.MustCompile("^[a-zA-Z_]+$")
-var durationRE *regexp.Regexp = regexp.MustCompile("^[1-9][0-9]*[mshd]$")
+var durationRE *regexp.Regexp = regexp.MustCompile("^([0-9]+[dhms])+$")
 var uuidRE *regexp.Regexp = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
 var headerNameRE *regexp.Regexp = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9-]*$")
-var numberRE *regexp.Regexp = regexp.MustCompile("^(0|[1-9][0-9]+)$")
+var numberRE *regexp.Regexp = regexp.MustCompile("^(0|[1-9][0-9]*)$")
 
 type Token interface{}
 
 type Tokenizer struct {
 	input string
 	pos   int
+	// tokenStart is the position of the last token read or peeked, where
+	// errors are reported
+	tokenStart int
 }
 
 type TokenKeyword string
@@ -33,10 +37,16 @@ type TokenDotOp string
 type TokenExistsOp string
 type TokenContainsOp string
 type TokenIContainsOp string
+type TokenMatchesOp string
+type TokenSearchOp string
+type TokenBetweenOp string
+type TokenClassOp string
+type TokenInOp string
 type TokenHeaderName string
 type TokenString string
 type TokenNumber int
 type TokenParen string
+type TokenCommaOp string
 type TokenLogicalOp string
 
 const (
@@ -46,7 +56,18 @@ const (
 	TokenKeywordRequests  TokenKeyword     = "requests"
 	TokenKeywordResponses TokenKeyword     = "responses"
 	TokenKeywordCount     TokenKeyword     = "count"
+	TokenKeywordGroup     TokenKeyword     = "group"
+	TokenKeywordBy        TokenKeyword     = "by"
+	TokenKeywordOrder     TokenKeyword     = "order"
+	TokenKeywordAsc       TokenKeyword     = "asc"
+	TokenKeywordDesc      TokenKeyword     = "desc"
+	TokenKeywordLimit     TokenKeyword     = "limit"
+	TokenKeywordOffset    TokenKeyword     = "offset"
+	TokenKeywordUnion     TokenKeyword     = "union"
+	TokenKeywordIntersect TokenKeyword     = "intersect"
+	TokenKeywordExcept    TokenKeyword     = "except"
 	TokenOrderOpEq        TokenOrderOp     = "eq"
+	TokenOrderOpNe        TokenOrderOp     = "ne"
 	TokenOrderOpGt        TokenOrderOp     = "gt"
 	TokenOrderOpGte       TokenOrderOp     = "ge"
 	TokenOrderOpLt        TokenOrderOp     = "lt"
@@ -55,8 +76,14 @@ const (
 	TokenExists           TokenExistsOp    = "exists"
 	TokenContains         TokenContainsOp  = "contains"
 	TokenIContains        TokenIContainsOp = "icontains"
+	TokenMatches          TokenMatchesOp   = "matches"
+	TokenSearch           TokenSearchOp    = "search"
+	TokenBetween          TokenBetweenOp   = "between"
+	TokenClass            TokenClassOp     = "class"
+	TokenIn               TokenInOp        = "in"
 	TokenParenOpen        TokenParen       = "("
 	TokenParenClose       TokenParen       = ")"
+	TokenComma            TokenCommaOp     = ","
 	TokenLogicalOpAnd     TokenLogicalOp   = "and"
 	TokenLogicalOpOr      TokenLogicalOp   = "or"
 	TokenLogicalOpNot     TokenLogicalOp   = "not"
@@ -86,14 +113,20 @@ func (t *Tokenizer) GetPosition() int {
 
 func (t *Tokenizer) SetPosition(pos int) {
 	t.pos = pos
+	t.tokenStart = t.skipSpace(pos)
 }
 
-func (t *Tokenizer) peekToken() (Token, int, error) {
-	pos := t.pos
+func (t *Tokenizer) skipSpace(pos int) int {
 	for pos < len(t.input) && unicode.IsSpace(rune(t.input[pos])) {
 		pos++
 	}
+	return pos
+}
+
+func (t *Tokenizer) peekToken() (Token, int, error) {
+	pos := t.skipSpace(t.pos)
 	start := pos
+	t.tokenStart = start
 
 	isSpecialChar := map[rune]bool{
 		'.':  true,
@@ -101,6 +134,7 @@ func (t *Tokenizer) peekToken() (Token, int, error) {
 		'\'': true,
 		'(':  true,
 		')':  true,
+		',':  true,
 	}
 F:
 	for pos < len(t.input) {
@@ -137,6 +171,8 @@ F:
 			return t.peekStringToken(pos)
 		case '(', ')':
 			return TokenParen(t.input[pos]), pos + 1, nil
+		case ',':
+			return TokenComma, pos + 1, nil
 		}
 	}
 
@@ -147,15 +183,39 @@ F:
 		return TokenKeywordRequests, pos, nil
 	case "where":
 		return TokenKeywordWhere, pos, nil
-	case "=":
+	case "count":
+		return TokenKeywordCount, pos, nil
+	case "group":
+		return TokenKeywordGroup, pos, nil
+	case "by":
+		return TokenKeywordBy, pos, nil
+	case "order":
+		return TokenKeywordOrder, pos, nil
+	case "asc":
+		return TokenKeywordAsc, pos, nil
+	case "desc":
+		return TokenKeywordDesc, pos, nil
+	case "limit":
+		return TokenKeywordLimit, pos, nil
+	case "offset":
+		return TokenKeywordOffset, pos, nil
+	case "union":
+		return TokenKeywordUnion, pos, nil
+	case "intersect":
+		return TokenKeywordIntersect, pos, nil
+	case "except":
+		return TokenKeywordExcept, pos, nil
+	case "=", "eq":
 		return TokenOrderOpEq, pos, nil
-	case ">":
+	case "!=", "ne":
+		return TokenOrderOpNe, pos, nil
+	case ">", "gt":
 		return TokenOrderOpGt, pos, nil
-	case ">=":
+	case ">=", "ge":
 		return TokenOrderOpGte, pos, nil
-	case "<":
+	case "<", "lt":
 		return TokenOrderOpLt, pos, nil
-	case "<=":
+	case "<=", "le":
 		return TokenOrderOpLte, pos, nil
 	case "ago":
 		return TokenKeywordAgo, pos, nil
@@ -165,6 +225,16 @@ F:
 		return TokenContains, pos, nil
 	case "icontains":
 		return TokenIContains, pos, nil
+	case "matches":
+		return TokenMatches, pos, nil
+	case "search":
+		return TokenSearch, pos, nil
+	case "between":
+		return TokenBetween, pos, nil
+	case "class":
+		return TokenClass, pos, nil
+	case "in":
+		return TokenIn, pos, nil
 	case "and":
 		return TokenLogicalOpAnd, pos, nil
 	case "or":
@@ -178,25 +248,12 @@ F:
 	}
 
 	if durationRE.MatchString(s) {
-		d, err := strconv.Atoi(t.input[start : pos-1])
+		d, err := ParseDuration(s)
 		if err != nil {
 			return nil, 0, err
 		}
-		tk := time.Duration(d)
-		switch t.input[pos-1] {
-		case 's':
-			tk *= time.Second
-		case 'm':
-			tk *= time.Minute
-		case 'h':
-			tk *= time.Hour
-		case 'd':
-			tk *= time.Hour * 24
-		default:
-			return nil, 0, fmt.Errorf("invalid duration suffix: '%c'", t.input[pos])
-		}
 
-		return TokenDuration(tk), pos, nil
+		return TokenDuration(d), pos, nil
 	}
 
 	if uuidRE.MatchString(s) {
@@ -210,21 +267,21 @@ F:
 	if numberRE.MatchString(s) {
 		n, err := strconv.Atoi(t.input[start:pos])
 		if err != nil {
-			return nil, 0, fmt.Errorf("invalid number: '%s'", t.input[start:pos])
+			return nil, 0, &ParseError{Pos: start, Found: t.input[start:pos], msg: fmt.Sprintf("invalid number '%s'", t.input[start:pos])}
 		}
 		return TokenNumber(n), pos, nil
 	}
 
-	return nil, 0, fmt.Errorf("invalid token found: '%s'", t.input[start:pos])
+	return nil, 0, &ParseError{Pos: start, Found: t.input[start:pos], msg: fmt.Sprintf("invalid token '%s'", t.input[start:pos])}
 }
 
 func (t *Tokenizer) peekStringToken(start int) (Token, int, error) {
 	if start >= len(t.input) {
-		return nil, 0, fmt.Errorf("unexpected end of input")
+		return nil, 0, &ParseError{Pos: start, Expected: []string{`"`, "'"}, msg: "expected a quoted string. Found input end instead"}
 	}
 
 	if t.input[start] != '"' && t.input[start] != '\'' {
-		return nil, 0, fmt.Errorf(`expected a single or double quote. Got '%c'`, t.input[start])
+		return nil, 0, &ParseError{Pos: start, Expected: []string{`"`, "'"}, msg: fmt.Sprintf("expected a single or double quote. Found '%c' instead", t.input[start])}
 	}
 
 	quote := t.input[start]
@@ -235,7 +292,7 @@ func (t *Tokenizer) peekStringToken(start int) (Token, int, error) {
 	}
 
 	if pos >= len(t.input) {
-		return nil, 0, fmt.Errorf("unexpected end of input")
+		return nil, 0, &ParseError{Pos: start, Found: t.input[start:], msg: fmt.Sprintf("unterminated string, missing the closing %c", quote)}
 	}
 
 	return TokenString(t.input[start+1 : pos]), pos + 1, nil
@@ -246,6 +303,9 @@ func (t *Tokenizer) PeekToken() (Token, error) {
 	return token, err
 }
 
+// AssertNextToken consumes the next token, failing if it is not expectedToken.
+// Identifiers are compared with normalizeIdentifier, so expected identifiers
+// are written in lowercase.
 func (t *Tokenizer) AssertNextToken(expectedToken Token) error {
 	start := t.pos
 	nt, err := t.NextToken()
@@ -253,31 +313,51 @@ func (t *Tokenizer) AssertNextToken(expectedToken Token) error {
 		return err
 	}
 
-	if nt == TEOF && nt != expectedToken {
-		t.pos = start
-		return fmt.Errorf("expected token '%s'. Found end of input instead", expectedToken)
-	}
-
-	if nt != expectedToken {
-		t.pos = start
-		if nt == TEOF {
-			return fmt.Errorf("expected token '%s'. Found end of input instead", expectedToken)
+	if normalizeIdentifier(nt) != expectedToken {
+		t.SetPosition(start)
+		if expectedToken == TEOF {
+			return t.errorf(nil, "expected end of input")
 		}
-		return fmt.Errorf("unexpected token found: '%s'", nt)
+		return t.errorf([]string{tokenName(expectedToken)}, "expected '%s'", tokenName(expectedToken))
 	}
 
 	return nil
 }
 
 func (t *Tokenizer) AssertNextTokenOneOf(alts []Token) error {
-	var err error
 	for _, alt := range alts {
-		if err = t.AssertNextToken(alt); err == nil {
+		if err := t.AssertNextToken(alt); err == nil {
 			return nil
 		}
 	}
 
-	return err
+	expected := make([]string, len(alts))
+	for i, alt := range alts {
+		expected[i] = tokenName(alt)
+	}
+
+	return t.errorf(expected, "expected one of '%s'", strings.Join(expected, "', '"))
+}
+
+// normalizeIdentifier returns an identifier in lowercase, the way field names
+// are compared: like keywords, they are case-insensitive. The tokenizer keeps
+// identifiers as written because the names of parameters and json paths that
+// follow a field are case-sensitive. Other tokens are returned unchanged.
+func normalizeIdentifier(token Token) Token {
+	if id, ok := token.(TokenIdentifier); ok {
+		return TokenIdentifier(strings.ToLower(string(id)))
+	}
+
+	return token
+}
+
+// tokenName returns the text a token is written as.
+func tokenName(token Token) string {
+	if token == TokenDot {
+		return "."
+	}
+
+	return fmt.Sprint(token)
 }
 
 func NextTokenWithType[A any](tokenizer *Tokenizer) (*A, error) {
@@ -297,11 +377,35 @@ func NextTokenWithType[A any](tokenizer *Tokenizer) (*A, error) {
 	typ := reflect.TypeOf(zeroValue)
 	typeFields := strings.Split(typ.String(), ".")
 	typeStr := typeFields[len(typeFields)-1]
-	return nil, fmt.Errorf("expected a %s. Found '%s' instead", typeStr, nt)
+	if name, ok := tokenTypeNames[typeStr]; ok {
+		typeStr = name
+	}
+	return nil, tokenizer.errorf(nil, "expected %s", typeStr)
+}
+
+// tokenTypeNames are the names of the token types used in errors.
+var tokenTypeNames = map[string]string{
+	"TokenString":     "a quoted string",
+	"TokenNumber":     "a number",
+	"TokenIdentifier": "a name",
+	"TokenUUID":       "a UUID",
+	"TokenDuration":   "a duration",
 }
 
+// ParseQuery parses a text query. Its errors are ParseErrors, with the
+// position of the input where they were found.
 func ParseQuery(s string) (*Query, error) {
 	tk := NewTokenizer(s)
+
+	query, err := parseQuery(tk)
+	if err != nil {
+		return nil, tk.wrapError(err)
+	}
+
+	return query, nil
+}
+
+func parseQuery(tk *Tokenizer) (*Query, error) {
 	result := &Query{}
 
 	err := tk.AssertNextToken(TokenKeywordQuery)
@@ -315,148 +419,381 @@ func ParseQuery(s string) (*Query, error) {
 	}
 	switch token {
 	case TokenKeywordRequests:
-		err := tk.AssertNextToken(TokenKeywordWhere)
-		if err != nil {
+		result.Operation = QueryOperationGet
+
+	case TokenKeywordCount:
+		result.Operation = QueryOperationCount
+
+	default:
+		return nil, tk.errorf([]string{"requests", "count"}, "expected 'requests' or 'count'")
+	}
+
+	nt, err := tk.PeekToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if nt == TokenKeywordWhere {
+		if err := tk.AssertNextToken(TokenKeywordWhere); err != nil {
 			return nil, err
 		}
 
-		result.Operation = QueryOperationGet
-		cond, err := parseRequestCondition(tk, true)
+		cond, err := parseRequestCondition(tk)
 		if err != nil {
 			return nil, err
 		}
 		result.RequestCondition = cond
+	}
+
+	setOperations, err := parseSetOperations(tk)
+	if err != nil {
+		return nil, err
+	}
+	result.SetOperations = setOperations
+
+	groupBy, err := parseGroupBy(tk)
+	if err != nil {
+		return nil, err
+	}
+	result.GroupBy = groupBy
 
-		if err := tk.AssertNextToken(TEOF); err != nil {
+	// Requests queries grouped by endpoint list the endpoints of the
+	// requests instead
+	if result.Operation == QueryOperationGet && len(groupBy) > 0 {
+		if err := checkEndpointsGroupBy(groupBy); err != nil {
 			return nil, err
 		}
+	}
 
-	default:
-		if token == TEOF {
-			return nil, fmt.Errorf("expected 'requests', 'responses' or 'count'. Found input end instead")
-		}
+	orderBy, err := parseOrderBy(tk)
+	if err != nil {
+		return nil, err
+	}
+	result.OrderBy = orderBy
+
+	if err := parseLimit(tk, result); err != nil {
+		return nil, err
+	}
 
-		return nil, fmt.Errorf("Expected 'requests', 'responses' or 'count'. Found '%s' instead", token)
+	if err := tk.AssertNextToken(TEOF); err != nil {
+		return nil, err
 	}
 
 	return result, nil
 }
 
-func parseRequestCondition(tokenizer *Tokenizer, andOr bool) (RequestCondition, error) {
+// setOperationTokens maps the set operation keywords to the operators used
+// by the queries.
+var setOperationTokens = map[Token]string{
+	TokenKeywordUnion:     SetOperationUnion,
+	TokenKeywordIntersect: SetOperationIntersect,
+	TokenKeywordExcept:    SetOperationExcept,
+}
+
+// parseSetOperations parses a sequence of set operations, like
+// "except query requests where resp.status eq 403". Their operands can only
+// have conditions.
+func parseSetOperations(tokenizer *Tokenizer) ([]SetOperation, error) {
+	setOperations := []SetOperation{}
+	for {
+		nt, err := tokenizer.PeekToken()
+		if err != nil {
+			return nil, err
+		}
+
+		operator, ok := setOperationTokens[nt]
+		if !ok {
+			return setOperations, nil
+		}
+
+		if err := tokenizer.AssertNextToken(nt); err != nil {
+			return nil, err
+		}
+
+		operand, err := parseRequestsQuery(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+
+		setOperations = append(setOperations, SetOperation{
+			Operator: operator,
+			Query:    operand,
+		})
+	}
+}
+
+// parseRequestsQuery parses a "query requests" with optional conditions,
+// used as an operand of the set operations and as a subquery.
+func parseRequestsQuery(tokenizer *Tokenizer) (*Query, error) {
+	if err := tokenizer.AssertNextToken(TokenKeywordQuery); err != nil {
+		return nil, err
+	}
+
+	if err := tokenizer.AssertNextToken(TokenKeywordRequests); err != nil {
+		return nil, err
+	}
+
+	query := &Query{Operation: QueryOperationGet}
+
 	nt, err := tokenizer.PeekToken()
 	if err != nil {
 		return nil, err
 	}
 
-	var cond RequestCondition
-	switch nt {
-	case TokenParenOpen:
-		if err := tokenizer.AssertNextToken(TokenParenOpen); err != nil {
+	if nt == TokenKeywordWhere {
+		if err := tokenizer.AssertNextToken(TokenKeywordWhere); err != nil {
 			return nil, err
 		}
 
-		cond, err := parseRequestCondition(tokenizer, true)
+		cond, err := parseRequestCondition(tokenizer)
 		if err != nil {
 			return nil, err
 		}
+		query.RequestCondition = cond
+	}
 
-		if err := tokenizer.AssertNextToken(TokenParenClose); err != nil {
+	return query, nil
+}
+
+func parseOrderBy(tokenizer *Tokenizer) ([]OrderBy, error) {
+	nt, err := tokenizer.PeekToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if nt != TokenKeywordOrder {
+		return nil, nil
+	}
+
+	if err := tokenizer.AssertNextToken(TokenKeywordOrder); err != nil {
+		return nil, err
+	}
+
+	if err := tokenizer.AssertNextToken(TokenKeywordBy); err != nil {
+		return nil, err
+	}
+
+	orderBy := []OrderBy{}
+	for {
+		nt, err := tokenizer.PeekToken()
+		if err != nil {
 			return nil, err
 		}
-		return cond, nil
 
-	case TokenIdentifier("timestamp"):
-		cond, err = parseRequestTimestampCondition(tokenizer)
+		name := "count"
+		if nt == TokenKeywordCount {
+			// count is a keyword, but it is also the field counts are sorted by
+			if err := tokenizer.AssertNextToken(TokenKeywordCount); err != nil {
+				return nil, err
+			}
+		} else {
+			field, err := NextTokenWithType[TokenIdentifier](tokenizer)
+			if err != nil {
+				return nil, err
+			}
+			name = string(normalizeIdentifier(*field).(TokenIdentifier))
+		}
+
+		if !IsOrderByField(name) {
+			return nil, tokenizer.errorf(orderByFieldNames(), "invalid order by field")
+		}
+		o := OrderBy{Field: name}
+
+		nt, err = tokenizer.PeekToken()
 		if err != nil {
 			return nil, err
 		}
-	case TokenIdentifier("id"):
-		cond, err = parseRequestIdCondition(tokenizer)
+
+		switch nt {
+		case TokenKeywordAsc:
+			if err := tokenizer.AssertNextToken(TokenKeywordAsc); err != nil {
+				return nil, err
+			}
+		case TokenKeywordDesc:
+			if err := tokenizer.AssertNextToken(TokenKeywordDesc); err != nil {
+				return nil, err
+			}
+			o.Descending = true
+		}
+		orderBy = append(orderBy, o)
+
+		nt, err = tokenizer.PeekToken()
 		if err != nil {
 			return nil, err
 		}
-	case TokenIdentifier("method"):
-		cond, err = parseRequestMethodCondition(tokenizer)
-		if err != nil {
+
+		if nt != TokenComma {
+			return orderBy, nil
+		}
+
+		if err := tokenizer.AssertNextToken(TokenComma); err != nil {
 			return nil, err
 		}
-	case TokenIdentifier("header"):
-		cond, err = parseRequestHeaderCondition(tokenizer)
+	}
+}
+
+func parseLimit(tokenizer *Tokenizer, query *Query) error {
+	nt, err := tokenizer.PeekToken()
+	if err != nil {
+		return err
+	}
+
+	if nt == TokenKeywordLimit {
+		if err := tokenizer.AssertNextToken(TokenKeywordLimit); err != nil {
+			return err
+		}
+
+		limit, err := NextTokenWithType[TokenNumber](tokenizer)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	case TokenIdentifier("body"):
-		cond, err = parseRequestBodyCondition(tokenizer)
+		query.Limit = int(*limit)
+
+		nt, err = tokenizer.PeekToken()
 		if err != nil {
-			return nil, err
+			return err
 		}
-	case TokenIdentifier("path"):
-		cond, err = parseRequestPathCondition(tokenizer)
+	}
+
+	if nt == TokenKeywordOffset {
+		if err := tokenizer.AssertNextToken(TokenKeywordOffset); err != nil {
+			return err
+		}
+
+		offset, err := NextTokenWithType[TokenNumber](tokenizer)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	case TokenIdentifier("raw"):
-		cond, err = parseRequestRawCondition(tokenizer)
+		query.Offset = int(*offset)
+	}
+
+	return nil
+}
+
+func parseGroupBy(tokenizer *Tokenizer) ([]string, error) {
+	nt, err := tokenizer.PeekToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if nt != TokenKeywordGroup {
+		return nil, nil
+	}
+
+	if err := tokenizer.AssertNextToken(TokenKeywordGroup); err != nil {
+		return nil, err
+	}
+
+	if err := tokenizer.AssertNextToken(TokenKeywordBy); err != nil {
+		return nil, err
+	}
+
+	fields := []string{}
+	for {
+		field, err := NextTokenWithType[TokenIdentifier](tokenizer)
 		if err != nil {
 			return nil, err
 		}
-	case TokenIdentifier("resp"), TokenIdentifier("response"):
-		cond, err = parseRequestResponseCondition(tokenizer)
+
+		name := string(normalizeIdentifier(*field).(TokenIdentifier))
+		if !IsGroupByField(name) {
+			return nil, tokenizer.errorf(groupByFieldNames(), "invalid group by field")
+		}
+		fields = append(fields, name)
+
+		nt, err := tokenizer.PeekToken()
 		if err != nil {
 			return nil, err
 		}
-	case TokenLogicalOpNot:
-		if err := tokenizer.AssertNextToken(TokenLogicalOpNot); err != nil {
-			return nil, err
+
+		if nt != TokenComma {
+			return fields, nil
 		}
 
-		cond, err = parseRequestCondition(tokenizer, false)
-		if err != nil {
+		if err := tokenizer.AssertNextToken(TokenComma); err != nil {
 			return nil, err
 		}
+	}
+}
+
+// conditionFields are the tokens a request condition can start with.
+var conditionFields = []string{
+	"timestamp", "id", "method", "header", "body", "path", "endpoint", "raw",
+	"url", "host", "scheme", "query_string", "port", "param", "req_size",
+	"resp_size", "header_count", "resp_header_count", "form", "multipart",
+	"json", "resp", "response", "not", "(",
+}
+
+// IsConditionStart reports whether s starts like a request condition: with
+// a condition field, "not" or a parenthesis, or with a word followed by an
+// operator, like a misspelled field. Text that does not start like a
+// condition can be used as text instead of as a condition when it cannot
+// be parsed.
+func IsConditionStart(s string) bool {
+	tokenizer := NewTokenizer(s)
+	first, err := tokenizer.NextToken()
+	if err != nil {
+		return false
+	}
 
-		cond = &NotCondition{
-			Condition: cond,
+	switch t := normalizeIdentifier(first).(type) {
+	case TokenIdentifier:
+		if slices.Contains(conditionFields, string(t)) {
+			return true
 		}
+	case TokenLogicalOp:
+		return t == TokenLogicalOpNot
+	case TokenParen:
+		return t == TokenParenOpen
 	default:
-		if nt == TEOF {
-			return nil, fmt.Errorf("expected a request condition. Found input end instead")
-		}
+		return false
+	}
 
-		return nil, fmt.Errorf("expected a request condition. Found '%s' instead", nt)
+	second, err := tokenizer.NextToken()
+	if err != nil {
+		return false
 	}
 
-	if !andOr {
-		return cond, nil
+	switch second.(type) {
+	case TokenOrderOp, TokenDotOp, TokenExistsOp, TokenContainsOp, TokenIContainsOp,
+		TokenMatchesOp, TokenSearchOp, TokenBetweenOp, TokenClassOp, TokenInOp:
+		return true
 	}
 
-	nt, err = tokenizer.PeekToken()
+	return false
+}
+
+// responseFields are the fields of the response in "resp.<field>"
+// conditions.
+var responseFields = []string{"status", "header", "body", "raw", "form", "multipart", "json"}
+
+var bodyFormats = []string{BodyFormatForm, BodyFormatMultipart, BodyFormatJSON}
+
+// parseRequestCondition parses a condition made of conditions combined with
+// and, or and not. not binds tighter than and, which binds tighter than or,
+// and both and and or are left-associative, so "a or b and not c or d" is
+// read as "(a or (b and (not c))) or d".
+func parseRequestCondition(tokenizer *Tokenizer) (RequestCondition, error) {
+	cond, err := parseAndCondition(tokenizer)
 	if err != nil {
 		return nil, err
 	}
 
-	switch nt {
-	case TokenLogicalOpAnd:
-		if err := tokenizer.AssertNextToken(TokenLogicalOpAnd); err != nil {
-			return nil, err
-		}
-
-		cond2, err := parseRequestCondition(tokenizer, true)
+	for {
+		nt, err := tokenizer.PeekToken()
 		if err != nil {
 			return nil, err
 		}
 
-		cond = &AndCondition{
-			Condition1: cond,
-			Condition2: cond2,
+		if nt != TokenLogicalOpOr {
+			return cond, nil
 		}
 
-	case TokenLogicalOpOr:
 		if err := tokenizer.AssertNextToken(TokenLogicalOpOr); err != nil {
 			return nil, err
 		}
 
-		cond2, err := parseRequestCondition(tokenizer, true)
+		cond2, err := parseAndCondition(tokenizer)
 		if err != nil {
 			return nil, err
 		}
@@ -466,249 +803,722 @@ func parseRequestCondition(tokenizer *Tokenizer, andOr bool) (RequestCondition,
 			Condition2: cond2,
 		}
 	}
-
-	return cond, nil
 }
 
-func parseRequestTimestampCondition(tokenizer *Tokenizer) (*RequestTimestampCondition, error) {
-	if err := tokenizer.AssertNextToken(TokenIdentifier("timestamp")); err != nil {
-		return nil, err
-	}
-
-	orderOp, err := NextTokenWithType[TokenOrderOp](tokenizer)
+func parseAndCondition(tokenizer *Tokenizer) (RequestCondition, error) {
+	cond, err := parseNotCondition(tokenizer)
 	if err != nil {
 		return nil, err
 	}
-	var operator string
-	switch *orderOp {
-	case TokenOrderOpEq:
-		operator = "eq"
-	case TokenOrderOpLt:
-		operator = "lt"
-	case TokenOrderOpLte:
-		operator = "le"
-	case TokenOrderOpGt:
-		operator = "gt"
-	case TokenOrderOpGte:
-		operator = "ge"
-	default:
-		return nil, fmt.Errorf("unknown timestamp operator: '%s'", *orderOp)
+
+	for {
+		nt, err := tokenizer.PeekToken()
+		if err != nil {
+			return nil, err
+		}
+
+		if nt != TokenLogicalOpAnd {
+			return cond, nil
+		}
+
+		if err := tokenizer.AssertNextToken(TokenLogicalOpAnd); err != nil {
+			return nil, err
+		}
+
+		cond2, err := parseNotCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+
+		cond = &AndCondition{
+			Condition1: cond,
+			Condition2: cond2,
+		}
 	}
+}
 
-	duration, err := NextTokenWithType[TokenDuration](tokenizer)
+func parseNotCondition(tokenizer *Tokenizer) (RequestCondition, error) {
+	nt, err := tokenizer.PeekToken()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := tokenizer.AssertNextToken(TokenKeywordAgo); err != nil {
-		return nil, err
+	if nt != TokenLogicalOpNot {
+		return parseFieldCondition(tokenizer)
 	}
 
-	return &RequestTimestampCondition{
-		TimeAgo:  time.Duration(*duration),
-		Operator: operator,
-	}, nil
-}
-
-func parseRequestIdCondition(tokenizer *Tokenizer) (*RequestIdCondition, error) {
-	if err := tokenizer.AssertNextToken(TokenIdentifier("id")); err != nil {
+	if err := tokenizer.AssertNextToken(TokenLogicalOpNot); err != nil {
 		return nil, err
 	}
 
-	orderOp, err := NextTokenWithType[TokenOrderOp](tokenizer)
+	cond, err := parseNotCondition(tokenizer)
 	if err != nil {
 		return nil, err
 	}
-	var operator string
-	switch *orderOp {
-	case TokenOrderOpEq:
-		operator = "eq"
-	default:
-		return nil, fmt.Errorf("invalid order operator: '%s'", *orderOp)
-	}
-
-	var id string
-	idToken, err := NextTokenWithType[TokenUUID](tokenizer)
-	if err == nil {
-		id = string(*idToken)
-	} else {
-		// TODO: fix ID condition
-		numberToken, err2 := NextTokenWithType[TokenNumber](tokenizer)
-		if err2 == nil {
-			id = string(*numberToken)
-		} else {
-			stringToken, err3 := NextTokenWithType[TokenString](tokenizer)
-			if err3 != nil {
-				return nil, err
-			}
-			id = string(*stringToken)
-		}
-	}
 
-	return &RequestIdCondition{
-		Id:       id,
-		Operator: operator,
+	return &NotCondition{
+		Condition: cond,
 	}, nil
 }
 
-func parseRequestMethodCondition(tokenizer *Tokenizer) (*RequestMethodCondition, error) {
-	if err := tokenizer.AssertNextToken(TokenIdentifier("method")); err != nil {
-		return nil, err
+// parseFieldCondition parses a condition over a field, or a parenthesized
+// condition.
+func parseFieldCondition(tokenizer *Tokenizer) (RequestCondition, error) {
+	if isSubqueryCondition(tokenizer) {
+		return parseRequestSubqueryCondition(tokenizer)
 	}
 
-	err := tokenizer.AssertNextToken(TokenOrderOpEq)
+	nt, err := tokenizer.PeekToken()
 	if err != nil {
 		return nil, err
 	}
 
-	var method string
-	nt, err := tokenizer.NextToken()
+	var cond RequestCondition
+	switch normalizeIdentifier(nt) {
+	case TokenParenOpen:
+		if err := tokenizer.AssertNextToken(TokenParenOpen); err != nil {
+			return nil, err
+		}
+
+		cond, err := parseRequestCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := tokenizer.AssertNextToken(TokenParenClose); err != nil {
+			return nil, err
+		}
+		return cond, nil
+
+	case TokenIdentifier("timestamp"):
+		cond, err = parseRequestTimestampCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("id"):
+		cond, err = parseRequestIdCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("method"):
+		cond, err = parseRequestMethodCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("header"):
+		cond, err = parseRequestHeaderCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("body"):
+		cond, err = parseRequestBodyCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("path"):
+		cond, err = parseRequestPathCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("raw"):
+		cond, err = parseRequestRawCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("url"), TokenIdentifier("host"), TokenIdentifier("scheme"), TokenIdentifier("query_string"), TokenIdentifier("endpoint"):
+		cond, err = parseRequestURLPartCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("port"):
+		cond, err = parseRequestPortCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("param"):
+		cond, err = parseRequestParamCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("req_size"), TokenIdentifier("resp_size"), TokenIdentifier("header_count"), TokenIdentifier("resp_header_count"):
+		cond, err = parseRequestNumericFieldCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("form"), TokenIdentifier("multipart"), TokenIdentifier("json"):
+		cond, err = parseRequestBodyParamCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	case TokenIdentifier("resp"), TokenIdentifier("response"):
+		cond, err = parseRequestResponseCondition(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, tokenizer.errorf(conditionFields, "expected a request condition")
+	}
+
+	return cond, nil
+}
+
+// isSubqueryCondition reports whether the next condition compares a field
+// with the results of a subquery, like "path in (query requests ...)".
+func isSubqueryCondition(tokenizer *Tokenizer) bool {
+	start := tokenizer.GetPosition()
+	defer tokenizer.SetPosition(start)
+
+	field, err := tokenizer.NextToken()
+	if err != nil {
+		return false
+	}
+
+	if name, ok := normalizeIdentifier(field).(TokenIdentifier); !ok || fieldColumns[string(name)] == "" {
+		return false
+	}
+
+	for _, expected := range []Token{TokenIn, TokenParenOpen, TokenKeywordQuery} {
+		nt, err := tokenizer.NextToken()
+		if err != nil || nt != expected {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseRequestSubqueryCondition(tokenizer *Tokenizer) (*RequestSubqueryCondition, error) {
+	field, err := NextTokenWithType[TokenIdentifier](tokenizer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tokenizer.AssertNextToken(TokenIn); err != nil {
+		return nil, err
+	}
+
+	if err := tokenizer.AssertNextToken(TokenParenOpen); err != nil {
+		return nil, err
+	}
+
+	query, err := parseRequestsQuery(tokenizer)
+	if err != nil {
+		return nil, err
+	}
+
+	query.SetOperations, err = parseSetOperations(tokenizer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tokenizer.AssertNextToken(TokenParenClose); err != nil {
+		return nil, err
+	}
+
+	return &RequestSubqueryCondition{
+		Field: string(normalizeIdentifier(*field).(TokenIdentifier)),
+		Query: query,
+	}, nil
+}
+
+func parseRequestTimestampCondition(tokenizer *Tokenizer) (*RequestTimestampCondition, error) {
+	if err := tokenizer.AssertNextToken(TokenIdentifier("timestamp")); err != nil {
+		return nil, err
+	}
+
+	operator, err := parseOperator(tokenizer, "timestamp", timestampOperators)
 	if err != nil {
 		return nil, err
 	}
 
+	value, err := parseTimestampValue(tokenizer)
+	if err != nil {
+		return nil, err
+	}
+
+	cond := &RequestTimestampCondition{
+		Operator: operator,
+		Value:    value,
+	}
+
+	if operator == "between" {
+		if err := tokenizer.AssertNextToken(TokenLogicalOpAnd); err != nil {
+			return nil, err
+		}
+
+		cond.End, err = parseTimestampValue(tokenizer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cond, nil
+}
+
+// parseTimestampValue parses one of "<duration> ago", a quoted ISO-8601
+// timestamp or "request <id>", which refers to the timestamp of a request.
+func parseTimestampValue(tokenizer *Tokenizer) (TimestampValue, error) {
+	nt, err := tokenizer.NextToken()
+	if err != nil {
+		return TimestampValue{}, err
+	}
+
 	switch v := nt.(type) {
+	case TokenDuration:
+		if err := tokenizer.AssertNextToken(TokenKeywordAgo); err != nil {
+			return TimestampValue{}, err
+		}
+
+		return TimestampValue{Ago: time.Duration(v)}, nil
+
+	case TokenString:
+		return ParseTimestampValue(string(v))
+
 	case TokenIdentifier:
-		method = strings.ToUpper(string(v))
+		if normalizeIdentifier(v) == TokenIdentifier("request") {
+			id, err := tokenizer.NextToken()
+			if err != nil {
+				return TimestampValue{}, err
+			}
+
+			switch id := id.(type) {
+			case TokenNumber:
+				return TimestampValue{RequestId: strconv.Itoa(int(id))}, nil
+			case TokenString:
+				return TimestampValue{RequestId: string(id)}, nil
+			case TokenUUID:
+				return TimestampValue{RequestId: string(id)}, nil
+			}
+
+			return TimestampValue{}, tokenizer.errorf(nil, "expected a request id")
+		}
+	}
+
+	return TimestampValue{}, tokenizer.errorf(nil, "expected a timestamp value")
+}
+
+func parseRequestIdCondition(tokenizer *Tokenizer) (*RequestIdCondition, error) {
+	if err := tokenizer.AssertNextToken(TokenIdentifier("id")); err != nil {
+		return nil, err
+	}
+
+	operator, err := parseOperator(tokenizer, "id", idOperators)
+	if err != nil {
+		return nil, err
+	}
+
+	if operator == "in" {
+		ids := []string{}
+		err := parseList(tokenizer, func() error {
+			id, err := parseIdValue(tokenizer)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return &RequestIdCondition{
+			Operator: operator,
+			Ids:      ids,
+		}, nil
+	}
+
+	id, err := parseIdValue(tokenizer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RequestIdCondition{
+		Id:       id,
+		Operator: operator,
+	}, nil
+}
+
+// parseIdValue parses a request id, which can be a number, a UUID or a
+// string.
+func parseIdValue(tokenizer *Tokenizer) (string, error) {
+	nt, err := tokenizer.NextToken()
+	if err != nil {
+		return "", err
+	}
+
+	switch v := nt.(type) {
+	case TokenNumber:
+		return strconv.Itoa(int(v)), nil
+	case TokenUUID:
+		return string(v), nil
 	case TokenString:
-		method = strings.ToUpper(string(v))
+		return string(v), nil
+	}
+
+	return "", tokenizer.errorf(nil, "expected a request id")
+}
+
+var validMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "HEAD", "OPTIONS", "TRACE"}
+
+func parseRequestMethodCondition(tokenizer *Tokenizer) (*RequestMethodCondition, error) {
+	if err := tokenizer.AssertNextToken(TokenIdentifier("method")); err != nil {
+		return nil, err
+	}
+
+	operator, err := parseOperator(tokenizer, "method", textOperators)
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case "eq", "ne", "in":
 	default:
-		return nil, fmt.Errorf("invalid request method")
+		value, err := NextTokenWithType[TokenString](tokenizer)
+		if err != nil {
+			return nil, err
+		}
+
+		return &RequestMethodCondition{
+			Operator: operator,
+			Value:    string(*value),
+		}, nil
 	}
 
-	if method != "GET" && method != "POST" && method != "PUT" &&
-		method != "PATCH" && method != "DELETE" && method != "CONNECT" &&
-		method != "HEAD" && method != "OPTION" {
-		return nil, fmt.Errorf("invalid request method")
+	parseMethod := func() (string, error) {
+		nt, err := tokenizer.NextToken()
+		if err != nil {
+			return "", err
+		}
+
+		var method string
+		switch v := nt.(type) {
+		case TokenIdentifier:
+			method = strings.ToUpper(string(v))
+		case TokenString:
+			method = strings.ToUpper(string(v))
+		default:
+			return "", tokenizer.errorf(validMethods, "expected a request method")
+		}
+
+		if !slices.Contains(validMethods, method) {
+			return "", tokenizer.errorf(validMethods, "invalid request method")
+		}
+
+		return method, nil
+	}
+
+	if operator == "in" {
+		methods := []string{}
+		err := parseList(tokenizer, func() error {
+			method, err := parseMethod()
+			if err != nil {
+				return err
+			}
+			methods = append(methods, method)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return &RequestMethodCondition{
+			Operator: operator,
+			Values:   methods,
+		}, nil
+	}
+
+	method, err := parseMethod()
+	if err != nil {
+		return nil, err
 	}
 
 	return &RequestMethodCondition{
-		Value: method,
+		Operator: operator,
+		Value:    method,
 	}, nil
 }
 
-func parseRequestHeaderCondition(tokenizer *Tokenizer) (*RequestHeaderCondition, error) {
+func parseRequestHeaderCondition(tokenizer *Tokenizer) (RequestCondition, error) {
 	startPosition := tokenizer.GetPosition()
 
 	if err := tokenizer.AssertNextToken(TokenIdentifier("header")); err != nil {
 		return nil, err
 	}
 
-	if err := tokenizer.AssertNextToken(TokenDot); err != nil {
+	if name, ok := parseHeaderNumberName(tokenizer); ok {
+		operator, value, values, err := parseNumberCondition(tokenizer, "header")
+		if err != nil {
+			return nil, err
+		}
+
+		return &RequestHeaderNumberCondition{
+			UniqueID: strconv.Itoa(startPosition),
+			Name:     name,
+			Operator: operator,
+			Value:    value,
+			Values:   values,
+		}, nil
+	}
+
+	headerName, operator, value, values, err := parseHeaderConditionParts(tokenizer, "header")
+	if err != nil {
 		return nil, err
 	}
 
+	return &RequestHeaderCondition{
+		UniqueID: strconv.Itoa(startPosition),
+		Name:     headerName,
+		Operator: operator,
+		Value:    value,
+		Values:   values,
+	}, nil
+}
+
+// parseHeaderNumberName parses the ".name.as_number" part of a header
+// condition that compares the header value as a number. If the condition is
+// not a numeric one, it returns false and leaves the tokenizer unchanged.
+func parseHeaderNumberName(tokenizer *Tokenizer) (string, bool) {
+	start := tokenizer.GetPosition()
+
+	tokens := []Token{}
+	for range 4 {
+		nt, err := tokenizer.NextToken()
+		if err != nil {
+			break
+		}
+		tokens = append(tokens, nt)
+	}
+
+	if len(tokens) == 4 && tokens[0] == TokenDot && tokens[2] == TokenDot && normalizeIdentifier(tokens[3]) == TokenIdentifier("as_number") {
+		switch v := tokens[1].(type) {
+		case TokenHeaderName:
+			return string(v), true
+		case TokenIdentifier:
+			return string(v), true
+		case TokenString:
+			return string(v), true
+		}
+	}
+
+	tokenizer.SetPosition(start)
+	return "", false
+}
+
+// parseHeaderConditionParts parses the ".name operator value" part of a
+// request or response header condition.
+func parseHeaderConditionParts(tokenizer *Tokenizer, field string) (string, string, string, []string, error) {
+	if err := tokenizer.AssertNextToken(TokenDot); err != nil {
+		return "", "", "", nil, err
+	}
+
 	headerNameToken, err := tokenizer.NextToken()
 	if err != nil {
-		return nil, err
+		return "", "", "", nil, err
 	}
 
+	// Names that are not valid identifiers can be quoted
 	headerName := ""
 	switch v := headerNameToken.(type) {
 	case TokenHeaderName:
 		headerName = string(v)
 	case TokenIdentifier:
 		headerName = string(v)
+	case TokenString:
+		headerName = string(v)
+	default:
+		return "", "", "", nil, tokenizer.errorf(nil, "expected a %s name", field)
+	}
+
+	operator, err := parseOperator(tokenizer, field, headerOperators)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+
+	if operator == "exists" {
+		return headerName, operator, "", nil, nil
 	}
 
-	opToken, err := tokenizer.NextToken()
+	value, values, err := parseStringValues(tokenizer, operator)
 	if err != nil {
+		return "", "", "", nil, err
+	}
+
+	return headerName, operator, value, values, nil
+}
+
+func parseRequestBodyCondition(tokenizer *Tokenizer) (*RequestBodyCondition, error) {
+	if err := tokenizer.AssertNextToken(TokenIdentifier("body")); err != nil {
 		return nil, err
 	}
 
-	operator := ""
-	switch opToken {
-	case TokenExists:
-		return &RequestHeaderCondition{
-			UniqueID: strconv.Itoa(startPosition),
-			Name:     headerName,
-			Operator: "exists",
-		}, nil
+	operator, err := parseOperator(tokenizer, "body", bodyOperators)
+	if err != nil {
+		return nil, err
+	}
 
-	case TokenOrderOpEq:
-		operator = "eq"
-	case TokenContains:
-		operator = "contains"
-	case TokenIContains:
-		operator = "icontains"
-	default:
-		return nil, fmt.Errorf("unknown header operator: '%s'", operator)
+	value, values, err := parseStringValues(tokenizer, operator)
+	if err != nil {
+		return nil, err
 	}
 
-	value, err := NextTokenWithType[TokenString](tokenizer)
+	return &RequestBodyCondition{
+		Operator: operator,
+		Value:    value,
+		Values:   values,
+	}, nil
+}
+
+// parseRequestBodyParamCondition parses conditions over the parameters of
+// form, multipart and JSON bodies, like "json.'$.user.id' eq '1'".
+func parseRequestBodyParamCondition(tokenizer *Tokenizer) (*RequestBodyParamCondition, error) {
+	format, err := parseBodyFormat(tokenizer)
 	if err != nil {
 		return nil, err
 	}
 
-	return &RequestHeaderCondition{
-		UniqueID: strconv.Itoa(startPosition),
-		Name:     headerName,
+	name, operator, value, values, err := parseHeaderConditionParts(tokenizer, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RequestBodyParamCondition{
+		Format:   format,
+		Name:     name,
 		Operator: operator,
-		Value:    string(*value),
+		Value:    value,
+		Values:   values,
 	}, nil
 }
 
-func parseRequestBodyCondition(tokenizer *Tokenizer) (*RequestBodyCondition, error) {
-	if err := tokenizer.AssertNextToken(TokenIdentifier("body")); err != nil {
+func parseBodyFormat(tokenizer *Tokenizer) (string, error) {
+	nt, err := tokenizer.NextToken()
+	if err != nil {
+		return "", err
+	}
+
+	if format, ok := normalizeIdentifier(nt).(TokenIdentifier); ok {
+		switch string(format) {
+		case BodyFormatForm, BodyFormatMultipart, BodyFormatJSON:
+			return string(format), nil
+		}
+	}
+
+	return "", tokenizer.errorf(bodyFormats, "expected a body format")
+}
+
+func parseRequestPathCondition(tokenizer *Tokenizer) (*RequestPathCondition, error) {
+	if err := tokenizer.AssertNextToken(TokenIdentifier("path")); err != nil {
 		return nil, err
 	}
 
-	opToken, err := tokenizer.NextToken()
+	operator, err := parseOperator(tokenizer, "path", textOperators)
 	if err != nil {
 		return nil, err
 	}
 
-	operator := ""
-	switch opToken {
-	case TokenContains:
-		operator = "contains"
-	case TokenIContains:
-		operator = "icontains"
-	default:
-		return nil, fmt.Errorf("unknown body operator: '%s'", operator)
+	value, values, err := parseStringValues(tokenizer, operator)
+	if err != nil {
+		return nil, err
 	}
 
-	value, err := NextTokenWithType[TokenString](tokenizer)
+	return &RequestPathCondition{
+		Operator: operator,
+		Value:    value,
+		Values:   values,
+	}, nil
+}
+
+// parseRequestURLPartCondition parses conditions over the text parts of the
+// request URL: url, host, scheme, query_string and endpoint.
+func parseRequestURLPartCondition(tokenizer *Tokenizer) (RequestCondition, error) {
+	nt, err := tokenizer.NextToken()
 	if err != nil {
 		return nil, err
 	}
 
-	return &RequestBodyCondition{
+	field, ok := normalizeIdentifier(nt).(TokenIdentifier)
+	if !ok {
+		return nil, tokenizer.errorf(nil, "expected a URL field")
+	}
+
+	operator, err := parseOperator(tokenizer, string(field), textOperators)
+	if err != nil {
+		return nil, err
+	}
+
+	value, values, err := parseStringValues(tokenizer, operator)
+	if err != nil {
+		return nil, err
+	}
+
+	switch field {
+	case "url":
+		return &RequestURLCondition{Operator: operator, Value: value, Values: values}, nil
+	case "host":
+		return &RequestHostCondition{Operator: operator, Value: value, Values: values}, nil
+	case "scheme":
+		return &RequestSchemeCondition{Operator: operator, Value: value, Values: values}, nil
+	case "query_string":
+		return &RequestQueryStringCondition{Operator: operator, Value: value, Values: values}, nil
+	case "endpoint":
+		return &RequestEndpointCondition{Operator: operator, Value: value, Values: values}, nil
+	}
+
+	return nil, fmt.Errorf("invalid URL field '%s'", field)
+}
+
+func parseRequestPortCondition(tokenizer *Tokenizer) (*RequestPortCondition, error) {
+	if err := tokenizer.AssertNextToken(TokenIdentifier("port")); err != nil {
+		return nil, err
+	}
+
+	operator, value, values, err := parseNumberCondition(tokenizer, "port")
+	if err != nil {
+		return nil, err
+	}
+
+	return &RequestPortCondition{
 		Operator: operator,
-		Value:    string(*value),
+		Value:    value,
+		Values:   values,
 	}, nil
 }
 
-func parseRequestPathCondition(tokenizer *Tokenizer) (*RequestPathCondition, error) {
-	if err := tokenizer.AssertNextToken(TokenIdentifier("path")); err != nil {
+func parseRequestParamCondition(tokenizer *Tokenizer) (*RequestParamCondition, error) {
+	if err := tokenizer.AssertNextToken(TokenIdentifier("param")); err != nil {
 		return nil, err
 	}
 
-	opToken, err := tokenizer.NextToken()
+	name, operator, value, values, err := parseHeaderConditionParts(tokenizer, "param")
 	if err != nil {
 		return nil, err
 	}
 
-	operator := ""
-	switch opToken {
-	case TokenOrderOpEq:
-		operator = "eq"
-	case TokenContains:
-		operator = "contains"
-	case TokenIContains:
-		operator = "icontains"
-	default:
-		return nil, fmt.Errorf("unknown path operator: '%s'", operator)
+	return &RequestParamCondition{
+		Name:     name,
+		Operator: operator,
+		Value:    value,
+		Values:   values,
+	}, nil
+}
+
+func parseRequestNumericFieldCondition(tokenizer *Tokenizer) (*RequestNumericFieldCondition, error) {
+	field, err := NextTokenWithType[TokenIdentifier](tokenizer)
+	if err != nil {
+		return nil, err
 	}
 
-	value, err := NextTokenWithType[TokenString](tokenizer)
+	name := string(normalizeIdentifier(*field).(TokenIdentifier))
+	operator, value, values, err := parseNumberCondition(tokenizer, name)
 	if err != nil {
 		return nil, err
 	}
 
-	return &RequestPathCondition{
+	return &RequestNumericFieldCondition{
+		Field:    name,
 		Operator: operator,
-		Value:    string(*value),
+		Value:    value,
+		Values:   values,
 	}, nil
 }
 
@@ -719,7 +1529,7 @@ func parseRequestRawCondition(tokenizer *Tokenizer) (*RequestRawCondition, error
 		return nil, err
 	}
 
-	err := tokenizer.AssertNextToken(TokenContains)
+	operator, err := parseOperator(tokenizer, "raw", rawOperators)
 	if err != nil {
 		return nil, err
 	}
@@ -731,6 +1541,7 @@ func parseRequestRawCondition(tokenizer *Tokenizer) (*RequestRawCondition, error
 
 	return &RequestRawCondition{
 		UniqueID: strconv.Itoa(startPosition),
+		Operator: operator,
 		Value:    string(*value),
 	}, nil
 }
@@ -752,9 +1563,9 @@ func parseRequestResponseCondition(tokenizer *Tokenizer) (RequestCondition, erro
 		return nil, err
 	}
 
-	responseFieldName, ok := nt.(TokenIdentifier)
+	responseFieldName, ok := normalizeIdentifier(nt).(TokenIdentifier)
 	if !ok {
-		return nil, fmt.Errorf("invalid response field found")
+		return nil, tokenizer.errorf(responseFields, "expected a response field")
 	}
 
 	switch string(responseFieldName) {
@@ -766,9 +1577,11 @@ func parseRequestResponseCondition(tokenizer *Tokenizer) (RequestCondition, erro
 		return parseRequestResponseStatusCondition(tokenizer)
 	case "raw":
 		return parseRequestResponseRawCondition(tokenizer)
+	case BodyFormatForm, BodyFormatMultipart, BodyFormatJSON:
+		return parseRequestResponseBodyParamCondition(tokenizer)
 	}
 
-	return nil, fmt.Errorf("invalid response field '%s'", string(responseFieldName))
+	return nil, tokenizer.errorf(responseFields, "invalid response field")
 }
 
 func parseRequestResponseBodyCondition(tokenizer *Tokenizer) (*RequestResponseBodyCondition, error) {
@@ -776,29 +1589,20 @@ func parseRequestResponseBodyCondition(tokenizer *Tokenizer) (*RequestResponseBo
 		return nil, err
 	}
 
-	opToken, err := tokenizer.NextToken()
+	operator, err := parseOperator(tokenizer, "resp.body", bodyOperators)
 	if err != nil {
 		return nil, err
 	}
 
-	operator := ""
-	switch opToken {
-	case TokenContains:
-		operator = "contains"
-	case TokenIContains:
-		operator = "icontains"
-	default:
-		return nil, fmt.Errorf("unknown body operator: '%s'", operator)
-	}
-
-	value, err := NextTokenWithType[TokenString](tokenizer)
+	value, values, err := parseStringValues(tokenizer, operator)
 	if err != nil {
 		return nil, err
 	}
 
 	return &RequestResponseBodyCondition{
 		Operator: operator,
-		Value:    string(*value),
+		Value:    value,
+		Values:   values,
 	}, nil
 }
 
@@ -807,96 +1611,93 @@ func parseRequestResponseStatusCondition(tokenizer *Tokenizer) (*RequestResponse
 		return nil, err
 	}
 
-	opToken, err := tokenizer.NextToken()
+	operator, err := parseOperator(tokenizer, "resp.status", statusOperators)
 	if err != nil {
 		return nil, err
 	}
 
-	operator := ""
-	switch opToken {
-	case TokenOrderOpEq:
-		operator = "eq"
-	case TokenOrderOpLt:
-		operator = "lt"
-	case TokenOrderOpLte:
-		operator = "le"
-	case TokenOrderOpGt:
-		operator = "gt"
-	case TokenOrderOpGte:
-		operator = "ge"
-	default:
-		return nil, fmt.Errorf("unknown status operator: '%s'", operator)
+	if operator == "class" {
+		class, err := NextTokenWithType[TokenString](tokenizer)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := ParseStatusClass(string(*class))
+		if err != nil {
+			return nil, err
+		}
+
+		return &RequestResponseStatusCondition{
+			Operator: operator,
+			Value:    value,
+		}, nil
 	}
 
-	value, err := NextTokenWithType[TokenNumber](tokenizer)
+	value, values, err := parseNumberValues(tokenizer, operator)
 	if err != nil {
 		return nil, err
 	}
 
 	return &RequestResponseStatusCondition{
 		Operator: operator,
-		Value:    int(*value),
+		Value:    value,
+		Values:   values,
 	}, nil
 }
 
-func parseRequestResponseHeaderCondition(tokenizer *Tokenizer) (*RequestResponseHeaderCondition, error) {
+func parseRequestResponseHeaderCondition(tokenizer *Tokenizer) (RequestCondition, error) {
 	startPosition := tokenizer.GetPosition()
 
 	if err := tokenizer.AssertNextToken(TokenIdentifier("header")); err != nil {
 		return nil, err
 	}
 
-	if err := tokenizer.AssertNextToken(TokenDot); err != nil {
-		return nil, err
+	if name, ok := parseHeaderNumberName(tokenizer); ok {
+		operator, value, values, err := parseNumberCondition(tokenizer, "resp.header")
+		if err != nil {
+			return nil, err
+		}
+
+		return &RequestResponseHeaderNumberCondition{
+			UniqueID: strconv.Itoa(startPosition),
+			Name:     name,
+			Operator: operator,
+			Value:    value,
+			Values:   values,
+		}, nil
 	}
 
-	headerNameToken, err := tokenizer.NextToken()
+	headerName, operator, value, values, err := parseHeaderConditionParts(tokenizer, "resp.header")
 	if err != nil {
 		return nil, err
 	}
 
-	headerName := ""
-	switch v := headerNameToken.(type) {
-	case TokenHeaderName:
-		headerName = string(v)
-	case TokenIdentifier:
-		headerName = string(v)
-	}
+	return &RequestResponseHeaderCondition{
+		UniqueID: strconv.Itoa(startPosition),
+		Name:     headerName,
+		Operator: operator,
+		Value:    value,
+		Values:   values,
+	}, nil
+}
 
-	opToken, err := tokenizer.NextToken()
+func parseRequestResponseBodyParamCondition(tokenizer *Tokenizer) (*RequestResponseBodyParamCondition, error) {
+	format, err := parseBodyFormat(tokenizer)
 	if err != nil {
 		return nil, err
 	}
 
-	operator := ""
-	switch opToken {
-	case TokenExists:
-		return &RequestResponseHeaderCondition{
-			UniqueID: strconv.Itoa(startPosition),
-			Name:     headerName,
-			Operator: "exists",
-		}, nil
-
-	case TokenOrderOpEq:
-		operator = "eq"
-	case TokenContains:
-		operator = "contains"
-	case TokenIContains:
-		operator = "icontains"
-	default:
-		return nil, fmt.Errorf("unknown header operator: '%s'", operator)
-	}
-
-	value, err := NextTokenWithType[TokenString](tokenizer)
+	name, operator, value, values, err := parseHeaderConditionParts(tokenizer, "resp."+format)
 	if err != nil {
 		return nil, err
 	}
 
-	return &RequestResponseHeaderCondition{
-		UniqueID: strconv.Itoa(startPosition),
-		Name:     headerName,
+	return &RequestResponseBodyParamCondition{
+		Format:   format,
+		Name:     name,
 		Operator: operator,
-		Value:    string(*value),
+		Value:    value,
+		Values:   values,
 	}, nil
 }
 
@@ -907,7 +1708,7 @@ func parseRequestResponseRawCondition(tokenizer *Tokenizer) (*RequestResponseRaw
 		return nil, err
 	}
 
-	err := tokenizer.AssertNextToken(TokenContains)
+	operator, err := parseOperator(tokenizer, "resp.raw", rawOperators)
 	if err != nil {
 		return nil, err
 	}
@@ -919,6 +1720,144 @@ func parseRequestResponseRawCondition(tokenizer *Tokenizer) (*RequestResponseRaw
 
 	return &RequestResponseRawCondition{
 		UniqueID: strconv.Itoa(startPosition),
+		Operator: operator,
 		Value:    string(*value),
 	}, nil
 }
+
+// operatorTokens maps operator tokens to the operator names used by the
+// conditions.
+var operatorTokens = map[Token]string{
+	TokenOrderOpEq:  "eq",
+	TokenOrderOpNe:  "ne",
+	TokenOrderOpLt:  "lt",
+	TokenOrderOpLte: "le",
+	TokenOrderOpGt:  "gt",
+	TokenOrderOpGte: "ge",
+	TokenContains:   "contains",
+	TokenIContains:  "icontains",
+	TokenMatches:    "matches",
+	TokenSearch:     "search",
+	TokenExists:     "exists",
+	TokenIn:         "in",
+	TokenBetween:    "between",
+	TokenClass:      "class",
+}
+
+// parseOperator parses the operator of a condition over field, which must be
+// one of the allowed operators.
+func parseOperator(tokenizer *Tokenizer, field string, allowed []string) (string, error) {
+	start := tokenizer.GetPosition()
+	nt, err := tokenizer.NextToken()
+	if err != nil {
+		return "", err
+	}
+
+	if operator, ok := operatorTokens[nt]; ok && slices.Contains(allowed, operator) {
+		return operator, nil
+	}
+
+	tokenizer.SetPosition(start)
+
+	return "", tokenizer.errorf(allowed, "expected a %s operator, one of %s", field, strings.Join(allowed, ", "))
+}
+
+// parseStringValues parses the value of a text condition, which is a list of
+// strings for the in operator and a single string otherwise.
+func parseStringValues(tokenizer *Tokenizer, operator string) (string, []string, error) {
+	if operator != "in" {
+		value, err := NextTokenWithType[TokenString](tokenizer)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return string(*value), nil, nil
+	}
+
+	values := []string{}
+	err := parseList(tokenizer, func() error {
+		value, err := NextTokenWithType[TokenString](tokenizer)
+		if err != nil {
+			return err
+		}
+		values = append(values, string(*value))
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "", values, nil
+}
+
+// parseNumberCondition parses the operator and the value of a condition over
+// a numeric field.
+func parseNumberCondition(tokenizer *Tokenizer, field string) (string, int, []int, error) {
+	operator, err := parseOperator(tokenizer, field, numericOperators)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	value, values, err := parseNumberValues(tokenizer, operator)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	return operator, value, values, nil
+}
+
+// parseNumberValues parses the value of a numeric condition, which is a list
+// of numbers for the in operator and a single number otherwise.
+func parseNumberValues(tokenizer *Tokenizer, operator string) (int, []int, error) {
+	if operator != "in" {
+		value, err := NextTokenWithType[TokenNumber](tokenizer)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		return int(*value), nil, nil
+	}
+
+	values := []int{}
+	err := parseList(tokenizer, func() error {
+		value, err := NextTokenWithType[TokenNumber](tokenizer)
+		if err != nil {
+			return err
+		}
+		values = append(values, int(*value))
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return 0, values, nil
+}
+
+// parseList parses a parenthesized, comma separated list of items, calling
+// parseItem to parse each one of them.
+func parseList(tokenizer *Tokenizer, parseItem func() error) error {
+	if err := tokenizer.AssertNextToken(TokenParenOpen); err != nil {
+		return err
+	}
+
+	for {
+		if err := parseItem(); err != nil {
+			return err
+		}
+
+		nt, err := tokenizer.NextToken()
+		if err != nil {
+			return err
+		}
+
+		switch nt {
+		case TokenComma:
+			continue
+		case TokenParenClose:
+			return nil
+		}
+
+		return tokenizer.errorf([]string{",", ")"}, "expected ',' or ')'")
+	}
+}
@@ -0,0 +1,268 @@
+// Package qltest creates DBs with the tables of the proxy and a set of
+// requests, to run queries against in tests.
+package qltest
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// Schema mirrors the tables the proxy creates.
+const Schema = `
+CREATE TABLE requests (
+	request_id INTEGER PRIMARY KEY,
+	method TEXT NOT NULL,
+	url TEXT NOT NULL,
+	body BLOB,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE responses (
+	response_id INTEGER PRIMARY KEY,
+	status_code INTEGER NOT NULL,
+	body BLOB,
+	content_length INTEGER
+);
+CREATE TABLE headers (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	request_id INTEGER,
+	response_id INTEGER,
+	name TEXT NOT NULL,
+	value TEXT NOT NULL
+);
+`
+
+// Request is a request stored by the proxy with its response.
+type Request struct {
+	ID          int
+	Method      string
+	URL         string
+	Body        string
+	Timestamp   string
+	Status      int
+	RespBody    string
+	Headers     [][2]string
+	RespHeaders [][2]string
+}
+
+// Requests are the requests the query tests run against.
+var Requests = []Request{
+	{
+		ID:          1,
+		Method:      "GET",
+		URL:         "https://example.com/api/users",
+		Timestamp:   "2024-01-01 10:00:00",
+		Status:      200,
+		RespBody:    `{"ok":true}`,
+		Headers:     [][2]string{{"Host", "example.com"}, {"Content-Type", "application/json"}},
+		RespHeaders: [][2]string{{"Content-Type", "application/json"}},
+	},
+	{
+		ID:          2,
+		Method:      "POST",
+		URL:         "https://example.com/api/login",
+		Body:        "user=admin&pass=100%_secret",
+		Timestamp:   "2024-01-01 11:00:00",
+		Status:      302,
+		Headers:     [][2]string{{"Host", "example.com"}, {"Content-Type", "application/x-www-form-urlencoded"}, {"X-Csrf", "abc"}},
+		RespHeaders: [][2]string{{"Location", "/home"}},
+	},
+	{
+		ID:          3,
+		Method:      "PUT",
+		URL:         "https://other.org/Upload",
+		Body:        "DATA",
+		Timestamp:   "2024-01-01 12:00:00",
+		Status:      500,
+		RespBody:    "Internal Error",
+		Headers:     [][2]string{{"Host", "other.org"}, {"Content-Type", "text/plain"}},
+		RespHeaders: [][2]string{{"Content-Type", "text/html"}},
+	},
+	{
+		ID:          4,
+		Method:      "DELETE",
+		URL:         "https://other.org/api/items/4",
+		Timestamp:   "2024-01-01 13:00:00",
+		Status:      403,
+		RespBody:    "forbidden",
+		Headers:     [][2]string{{"Host", "other.org"}, {"Content-Type", "application/json"}},
+		RespHeaders: [][2]string{{"Content-Type", "text/plain"}},
+	},
+}
+
+// NewDB creates a DB with requests for a test, and returns its file and a
+// handle to it.
+func NewDB(t testing.TB, requests []Request) (string, *sql.DB) {
+	t.Helper()
+
+	dbFile := filepath.Join(t.TempDir(), "proxy.db")
+	if err := CreateDB(dbFile, requests); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return dbFile, db
+}
+
+// CreateDB creates a DB at dbFile with the tables of the proxy and
+// requests.
+func CreateDB(dbFile string, requests []Request) error {
+	db, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(Schema); err != nil {
+		return err
+	}
+
+	for _, r := range requests {
+		if _, err := db.Exec(
+			"INSERT INTO requests (request_id, method, url, body, timestamp) VALUES (?, ?, ?, ?, ?)",
+			r.ID, r.Method, r.URL, r.Body, r.Timestamp,
+		); err != nil {
+			return err
+		}
+
+		if _, err := db.Exec(
+			"INSERT INTO responses (response_id, status_code, body, content_length) VALUES (?, ?, ?, ?)",
+			r.ID, r.Status, r.RespBody, len(r.RespBody),
+		); err != nil {
+			return err
+		}
+
+		for _, h := range r.Headers {
+			if _, err := db.Exec("INSERT INTO headers (request_id, name, value) VALUES (?, ?, ?)", r.ID, h[0], h[1]); err != nil {
+				return err
+			}
+		}
+
+		for _, h := range r.RespHeaders {
+			if _, err := db.Exec("INSERT INTO headers (response_id, name, value) VALUES (?, ?, ?)", r.ID, h[0], h[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// OperatorCase is a condition written both in the text query language and
+// with the Lua DSL, and the ids of the Requests it matches, in ascending
+// order.
+type OperatorCase struct {
+	Where string
+	Lua   string
+	Want  []int
+}
+
+// OperatorMatrix has the cases of each operator for each field, run
+// against Requests by both the parser and the Lua evaluator.
+var OperatorMatrix = []OperatorCase{
+	// id
+	{"id eq 2", "q.id.eq(2)", []int{2}},
+	{"id = 2", "q.id.eq('2')", []int{2}},
+	{"id ne 2", "q.id.ne(2)", []int{1, 3, 4}},
+	{"id != 2", "q.id.ne('2')", []int{1, 3, 4}},
+	{"id gt 2", "q.id.gt(2)", []int{3, 4}},
+	{"id ge 2", "q.id.ge(2)", []int{2, 3, 4}},
+	{"id lt 2", "q.id.lt(2)", []int{1}},
+	{"id le 2", "q.id.le(2)", []int{1, 2}},
+	{"id in (1, 3)", "q.id.in_({1, 3})", []int{1, 3}},
+	{"id matches '^[34]$'", "q.id.matches('^[34]$')", []int{3, 4}},
+
+	// timestamp
+	{"timestamp eq '2024-01-01T11:00:00Z'", "q.timestamp.eq('2024-01-01T11:00:00Z')", []int{2}},
+	{"timestamp ne '2024-01-01T11:00:00Z'", "q.timestamp.ne('2024-01-01T11:00:00Z')", []int{1, 3, 4}},
+	{"timestamp gt '2024-01-01T11:00:00Z'", "q.timestamp.gt('2024-01-01T11:00:00Z')", []int{3, 4}},
+	{"timestamp ge '2024-01-01T11:00:00Z'", "q.timestamp.ge('2024-01-01T11:00:00Z')", []int{2, 3, 4}},
+	{"timestamp lt '2024-01-01T11:00:00Z'", "q.timestamp.lt('2024-01-01T11:00:00Z')", []int{1}},
+	{"timestamp le '2024-01-01T11:00:00Z'", "q.timestamp.le('2024-01-01T11:00:00Z')", []int{1, 2}},
+	{"timestamp between '2024-01-01T10:30:00Z' and '2024-01-01T12:30:00Z'", "q.timestamp.between('2024-01-01T10:30:00Z', '2024-01-01T12:30:00Z')", []int{2, 3}},
+	{"timestamp gt request 3", "q.timestamp.gt(q.request_time(3))", []int{4}},
+	{"timestamp lt 1d ago", "q.timestamp.lt('1d')", []int{1, 2, 3, 4}},
+
+	// method
+	{"method eq get", "q.method.eq('get')", []int{1}},
+	{"method eq 'post'", "q.method.eq('post')", []int{2}},
+	{"method ne GET", "q.method.ne('GET')", []int{2, 3, 4}},
+	{"method contains 'E'", "q.method.contains('E')", []int{1, 4}},
+	{"method icontains 'e'", "q.method.icontains('e')", []int{1, 4}},
+	{"method matches '^P'", "q.method.matches('^P')", []int{2, 3}},
+	{"method in (GET, 'delete')", "q.method.in_({'GET', 'delete'})", []int{1, 4}},
+
+	// path
+	{"path eq '/Upload'", "q.path.eq('/Upload')", []int{3}},
+	{"path ne '/Upload'", "q.path.ne('/Upload')", []int{1, 2, 4}},
+	{"path contains '/api/'", "q.path.contains('/api/')", []int{1, 2, 4}},
+	{"path contains 'upload'", "q.path.contains('upload')", []int{}},
+	{"path icontains 'upload'", "q.path.icontains('upload')", []int{3}},
+	{"path matches 'items/[0-9]+$'", "q.path.matches('items/[0-9]+$')", []int{4}},
+	{"path in ('/api/users', '/Upload')", "q.path.in_({'/api/users', '/Upload'})", []int{1, 3}},
+
+	// body
+	{"body eq 'DATA'", "q.body.eq('DATA')", []int{3}},
+	{"body ne 'DATA'", "q.body.ne('DATA')", []int{1, 2, 4}},
+	{"body contains '100%_'", "q.body.contains('100%_')", []int{2}},
+	{"body contains '%'", "q.body.contains('%')", []int{2}},
+	{"body contains 'data'", "q.body.contains('data')", []int{}},
+	{"body icontains 'data'", "q.body.icontains('data')", []int{3}},
+	{"body matches '^user='", "q.body.matches('^user=')", []int{2}},
+	{"body in ('DATA', 'other')", "q.body.in_({'DATA', 'other'})", []int{3}},
+
+	// header
+	{"header.x-csrf exists", "q.header('x-csrf').exists()", []int{2}},
+	{"header.content-type eq 'application/json'", "q.header('content-type').eq('application/json')", []int{1, 4}},
+	{"header.content-type ne 'application/json'", "q.header('content-type').ne('application/json')", []int{2, 3}},
+	{"header.content-type contains 'json'", "q.header('content-type').contains('json')", []int{1, 4}},
+	{"header.content-type contains 'JSON'", "q.header('content-type').contains('JSON')", []int{}},
+	{"header.content-type icontains 'JSON'", "q.header('content-type').icontains('JSON')", []int{1, 4}},
+	{"header.content-type matches '^text/'", "q.header('content-type').matches('^text/')", []int{3}},
+	{"header.content-type in ('text/plain', 'application/x-www-form-urlencoded')", "q.header('content-type').in_({'text/plain', 'application/x-www-form-urlencoded'})", []int{2, 3}},
+
+	// raw
+	{"raw contains 'admin'", "q.raw.contains('admin')", []int{2}},
+	{"raw contains 'ADMIN'", "q.raw.contains('ADMIN')", []int{}},
+	{"raw icontains 'ADMIN'", "q.raw.icontains('ADMIN')", []int{2}},
+	{`raw matches 'other\.org'`, `q.raw.matches('other\\.org')`, []int{3, 4}},
+
+	// resp.status
+	{"resp.status eq 500", "q.resp_status.eq(500)", []int{3}},
+	{"resp.status ne 500", "q.resp_status.ne(500)", []int{1, 2, 4}},
+	{"resp.status gt 302", "q.resp_status.gt(302)", []int{3, 4}},
+	{"resp.status ge 302", "q.resp_status.ge(302)", []int{2, 3, 4}},
+	{"resp.status lt 302", "q.resp_status.lt(302)", []int{1}},
+	{"resp.status le 302", "q.resp_status.le(302)", []int{1, 2}},
+	{"resp.status in (403, 500)", "q.resp_status.in_({403, 500})", []int{3, 4}},
+
+	// resp.body
+	{"resp.body eq 'forbidden'", "q.resp_body.eq('forbidden')", []int{4}},
+	{"resp.body ne 'forbidden'", "q.resp_body.ne('forbidden')", []int{1, 2, 3}},
+	{"resp.body contains 'Error'", "q.resp_body.contains('Error')", []int{3}},
+	{"resp.body contains 'error'", "q.resp_body.contains('error')", []int{}},
+	{"resp.body icontains 'error'", "q.resp_body.icontains('error')", []int{3}},
+	{`resp.body matches '^\{'`, `q.resp_body.matches('^\\{')`, []int{1}},
+	{"resp.body in ('forbidden', 'Internal Error')", "q.resp_body.in_({'forbidden', 'Internal Error'})", []int{3, 4}},
+
+	// resp.header
+	{"resp.header.location exists", "q.resp_header('location').exists()", []int{2}},
+	{"resp.header.content-type eq 'text/plain'", "q.resp_header('content-type').eq('text/plain')", []int{4}},
+	{"resp.header.content-type ne 'text/plain'", "q.resp_header('content-type').ne('text/plain')", []int{1, 3}},
+	{"resp.header.content-type contains 'text'", "q.resp_header('content-type').contains('text')", []int{3, 4}},
+	{"resp.header.content-type icontains 'TEXT'", "q.resp_header('content-type').icontains('TEXT')", []int{3, 4}},
+	{"resp.header.content-type matches 'html$'", "q.resp_header('content-type').matches('html$')", []int{3}},
+	{"resp.header.content-type in ('text/html', 'application/json')", "q.resp_header('content-type').in_({'text/html', 'application/json'})", []int{1, 3}},
+
+	// resp.raw
+	{"resp.raw contains 'forbidden'", "q.resp_raw.contains('forbidden')", []int{4}},
+	{"resp.raw icontains 'FORBIDDEN'", "q.resp_raw.icontains('FORBIDDEN')", []int{4}},
+	{"resp.raw matches '^/home$'", "q.resp_raw.matches('^/home$')", []int{2}},
+}
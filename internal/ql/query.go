@@ -2,8 +2,10 @@ package ql
 
 import (
 	"fmt"
+	"maps"
+	"slices"
 	"strconv"
-	"time"
+	"strings"
 )
 
 type QueryOperation int
@@ -16,292 +18,733 @@ const (
 type Query struct {
 	Operation        QueryOperation
 	RequestCondition RequestCondition
+	GroupBy          []string
+	OrderBy          []OrderBy
+	// Limit is the maximum number of rows returned. Zero means no limit.
+	Limit  int
+	Offset int
+	// SetOperations combine the requests matched by the query with the ones
+	// matched by other queries, from left to right.
+	SetOperations []SetOperation
+}
+
+// Set operations between the requests matched by two queries
+const (
+	SetOperationUnion     = "union"
+	SetOperationIntersect = "intersect"
+	SetOperationExcept    = "except"
+)
+
+type SetOperation struct {
+	Operator string `json:"operator"`
+	// Query only uses the conditions and the set operations of the query
+	Query *Query `json:"query"`
+}
+
+type OrderBy struct {
+	Field      string `json:"field"`
+	Descending bool   `json:"descending,omitempty"`
+}
+
+// fieldColumns maps the fields queries can be sorted and grouped by to the
+// SQL expression that computes them.
+var fieldColumns = map[string]string{
+	"timestamp":         "req.timestamp",
+	"id":                "req.request_id",
+	"host":              "url_host(req.url)",
+	"scheme":            "url_scheme(req.url)",
+	"port":              "url_port(req.url)",
+	"method":            "req.method",
+	"status":            "resp.status_code",
+	"path":              "url_path(req.url)",
+	"endpoint":          "url_endpoint(req.url)",
+	"url":               "req.url",
+	"req_size":          numericFieldColumns["req_size"],
+	"resp_size":         numericFieldColumns["resp_size"],
+	"header_count":      numericFieldColumns["header_count"],
+	"resp_header_count": numericFieldColumns["resp_header_count"],
+}
+
+// numericFieldColumns maps the numeric fields derived from requests and
+// responses to the SQL expression that computes them. Sizes are in bytes.
+var numericFieldColumns = map[string]string{
+	"req_size":          "IFNULL(LENGTH(req.body), 0)",
+	"resp_size":         "IFNULL(LENGTH(resp.body), 0)",
+	"header_count":      "(SELECT COUNT(*) FROM headers hc WHERE hc.request_id = req.request_id)",
+	"resp_header_count": "(SELECT COUNT(*) FROM headers hc WHERE hc.response_id = resp.response_id)",
+}
+
+// IsNumericField reports whether field is one of the derived numeric fields,
+// like req_size or header_count.
+func IsNumericField(field string) bool {
+	_, ok := numericFieldColumns[field]
+	return ok
+}
+
+// groupByFields are the fields a count query can be grouped by.
+var groupByFields = map[string]bool{
+	"host":     true,
+	"scheme":   true,
+	"port":     true,
+	"method":   true,
+	"status":   true,
+	"path":     true,
+	"endpoint": true,
+	"url":      true,
+}
+
+func IsGroupByField(field string) bool {
+	return groupByFields[field]
+}
+
+func groupByFieldNames() []string {
+	return slices.Sorted(maps.Keys(groupByFields))
+}
+
+func orderByFieldNames() []string {
+	return append(slices.Sorted(maps.Keys(fieldColumns)), "count")
+}
+
+// IsOrderByField reports whether field can be used to sort the results of a
+// query. Count queries can also be sorted by "count".
+func IsOrderByField(field string) bool {
+	_, ok := fieldColumns[field]
+	return ok || field == "count"
+}
+
+// IsSubqueryField reports whether field can be compared with the results of
+// a subquery.
+func IsSubqueryField(field string) bool {
+	_, ok := fieldColumns[field]
+	return ok
 }
 
 type RequestCondition interface {
 	GetRequestConditionString() (string, []any, error)
-	GetRequestJoinsString() (string, error)
 }
 
 type RequestIdCondition struct {
-	Id       string
-	Operator string
+	Id       string   `json:"id,omitempty"`
+	Operator string   `json:"operator"`
+	Ids      []string `json:"ids,omitempty"`
 }
 
 func (c *RequestIdCondition) GetRequestConditionString() (string, []any, error) {
-	var op string
-	switch c.Operator {
-	case "eq":
-		op = "="
-	default:
-		return "", nil, fmt.Errorf("invalid operator '%s'", c.Operator)
+	if err := checkOperator("id", c.Operator, idOperators); err != nil {
+		return "", nil, err
 	}
 
-	condition := "req.request_id " + op + " ?"
-
-	return condition, []any{c.Id}, nil
-}
-
-func (c *RequestIdCondition) GetRequestJoinsString() (string, error) {
-	return "", nil
+	return textCondition("req.request_id", c.Operator, c.Id, c.Ids)
 }
 
 type RequestMethodCondition struct {
-	Value string
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
 }
 
 func (c *RequestMethodCondition) GetRequestConditionString() (string, []any, error) {
-	condition := "req.method = ?"
-	return condition, []any{c.Value}, nil
-}
+	operator := c.Operator
+	if operator == "" {
+		operator = "eq"
+	}
 
-func (c *RequestMethodCondition) GetRequestJoinsString() (string, error) {
-	return "", nil
+	if err := checkOperator("method", operator, textOperators); err != nil {
+		return "", nil, err
+	}
+
+	return textCondition("req.method", operator, c.Value, c.Values)
 }
 
 type RequestPathCondition struct {
-	Operator string
-	Value    string
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
 }
 
 func (c *RequestPathCondition) GetRequestConditionString() (string, []any, error) {
-	switch c.Operator {
-	case "eq":
-		condition := "req.url = ?"
-		return condition, []any{c.Value}, nil
+	if err := checkOperator("path", c.Operator, textOperators); err != nil {
+		return "", nil, err
+	}
 
-	case "contains":
-		condition := "req.url LIKE ?"
-		return condition, []any{"%" + c.Value + "%"}, nil
+	return textCondition("url_path(req.url)", c.Operator, c.Value, c.Values)
+}
 
-	case "icontains":
-		condition := "LOWER(req.url) = LIKE LOWER(?)"
-		return condition, []any{"%" + c.Value + "%"}, nil
+// RequestEndpointCondition matches the endpoint of the request: its path
+// with the object identifiers replaced with "{id}", as returned by
+// NormalizePath.
+type RequestEndpointCondition struct {
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
+}
+
+func (c *RequestEndpointCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("endpoint", c.Operator, textOperators); err != nil {
+		return "", nil, err
 	}
 
-	return "", nil, fmt.Errorf("invalid operator '%s'", c.Operator)
+	return textCondition("url_endpoint(req.url)", c.Operator, c.Value, c.Values)
 }
 
-func (c *RequestPathCondition) GetRequestJoinsString() (string, error) {
-	return "", nil
+// RequestURLCondition matches the full URL of the request, including the
+// scheme, host and query string.
+type RequestURLCondition struct {
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
 }
 
-type RequestHeaderCondition struct {
-	UniqueID string
-	Name     string
-	Operator string
-	Value    string
+func (c *RequestURLCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("url", c.Operator, textOperators); err != nil {
+		return "", nil, err
+	}
+
+	return textCondition("req.url", c.Operator, c.Value, c.Values)
 }
 
-func (c *RequestHeaderCondition) GetRequestConditionString() (string, []any, error) {
-	condition := ""
-	tableName := "h" + c.UniqueID
+// RequestHostCondition matches the host name of the request URL. Host names
+// are compared in lower case.
+type RequestHostCondition struct {
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
+}
+
+func (c *RequestHostCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("host", c.Operator, textOperators); err != nil {
+		return "", nil, err
+	}
 
+	value := c.Value
+	values := c.Values
 	switch c.Operator {
-	case "exists":
-		condition = "LOWER(" + tableName + ".name) = LOWER(?)"
-		return condition, []any{c.Name}, nil
+	case "eq", "ne", "in":
+		value = strings.ToLower(value)
+		values = make([]string, len(c.Values))
+		for i, v := range c.Values {
+			values[i] = strings.ToLower(v)
+		}
+	}
 
-	case "contains":
-		condition = "LOWER(" + tableName + ".name) = LOWER(?) and " + tableName + ".value LIKE ?"
-		return condition, []any{c.Name, "%" + c.Value + "%"}, nil
+	return textCondition("url_host(req.url)", c.Operator, value, values)
+}
 
-	case "icontains":
-		condition = "LOWER(" + tableName + ".name) = LOWER(?) and LOWER(" + tableName + ".value) LIKE LOWER(?)"
-		return condition, []any{c.Name, "%" + c.Value + "%"}, nil
+type RequestSchemeCondition struct {
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
+}
 
-	default:
-		return "", nil, fmt.Errorf("invalid operator '%s'", c.Operator)
+func (c *RequestSchemeCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("scheme", c.Operator, textOperators); err != nil {
+		return "", nil, err
 	}
 
-	return condition, nil, nil
+	value := strings.ToLower(c.Value)
+	values := make([]string, len(c.Values))
+	for i, v := range c.Values {
+		values[i] = strings.ToLower(v)
+	}
+
+	return textCondition("url_scheme(req.url)", c.Operator, value, values)
+}
+
+// RequestPortCondition matches the port of the request URL, which is the
+// default port of the scheme if the URL does not have one.
+type RequestPortCondition struct {
+	Operator string `json:"operator"`
+	Value    int    `json:"value,omitempty"`
+	Values   []int  `json:"values,omitempty"`
 }
 
-func (c *RequestHeaderCondition) GetRequestJoinsString() (string, error) {
-	return "INNER JOIN headers h" + c.UniqueID + " ON h" + c.UniqueID + ".request_id = req.request_id", nil
+func (c *RequestPortCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("port", c.Operator, numericOperators); err != nil {
+		return "", nil, err
+	}
+
+	return compareCondition("url_port(req.url)", c.Operator, c.Value, intValues(c.Values))
+}
+
+// RequestQueryStringCondition matches the raw query string of the request
+// URL, without the leading '?'.
+type RequestQueryStringCondition struct {
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
+}
+
+func (c *RequestQueryStringCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("query_string", c.Operator, textOperators); err != nil {
+		return "", nil, err
+	}
+
+	return textCondition("url_query(req.url)", c.Operator, c.Value, c.Values)
+}
+
+// RequestParamCondition matches a query parameter of the request URL. If the
+// parameter is repeated, only its first value is compared.
+type RequestParamCondition struct {
+	Name     string   `json:"name"`
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
+}
+
+func (c *RequestParamCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("param", c.Operator, headerOperators); err != nil {
+		return "", nil, err
+	}
+
+	if c.Operator == "exists" {
+		return "url_param(req.url, ?) IS NOT NULL", []any{c.Name}, nil
+	}
+
+	condition, values, err := textCondition("url_param(req.url, ?)", c.Operator, c.Value, c.Values)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return condition, append([]any{c.Name}, values...), nil
+}
+
+// RequestNumericFieldCondition matches one of the derived numeric fields.
+type RequestNumericFieldCondition struct {
+	Field    string `json:"field"`
+	Operator string `json:"operator"`
+	Value    int    `json:"value,omitempty"`
+	Values   []int  `json:"values,omitempty"`
+}
+
+func (c *RequestNumericFieldCondition) GetRequestConditionString() (string, []any, error) {
+	column, ok := numericFieldColumns[c.Field]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid numeric field '%s'", c.Field)
+	}
+
+	if err := checkOperator(c.Field, c.Operator, numericOperators); err != nil {
+		return "", nil, err
+	}
+
+	return compareCondition(column, c.Operator, c.Value, intValues(c.Values))
+}
+
+type RequestHeaderCondition struct {
+	UniqueID string   `json:"-"`
+	Name     string   `json:"name"`
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
+}
+
+func (c *RequestHeaderCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("header", c.Operator, headerOperators); err != nil {
+		return "", nil, err
+	}
+
+	return headerCondition("h"+c.UniqueID, "request_id = req.request_id", c.Name, c.Operator, c.Value, c.Values)
+}
+
+// RequestHeaderNumberCondition matches the value of a request header as a
+// number, like in q.header('content-length').as_number(). Headers whose
+// value is not an integer never match.
+type RequestHeaderNumberCondition struct {
+	UniqueID string `json:"-"`
+	Name     string `json:"name"`
+	Operator string `json:"operator"`
+	Value    int    `json:"value,omitempty"`
+	Values   []int  `json:"values,omitempty"`
+}
+
+func (c *RequestHeaderNumberCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("header", c.Operator, numericOperators); err != nil {
+		return "", nil, err
+	}
+
+	return headerNumberCondition("h"+c.UniqueID, "request_id = req.request_id", c.Name, c.Operator, c.Value, c.Values)
 }
 
 type RequestBodyCondition struct {
-	Operator string
-	Value    string
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
 }
 
 func (c *RequestBodyCondition) GetRequestConditionString() (string, []any, error) {
-	switch c.Operator {
-	case "contains":
-		condition := "req.body LIKE ?"
-		return condition, []any{"%" + c.Value + "%"}, nil
+	if err := checkOperator("body", c.Operator, bodyOperators); err != nil {
+		return "", nil, err
+	}
 
-	case "icontains":
-		condition := "LOWER(req.body) = LIKE LOWER(?)"
-		return condition, []any{"%" + c.Value + "%"}, nil
+	if c.Operator == "search" {
+		condition, values := searchCondition(c.Value, "req_body")
+		return condition, values, nil
 	}
 
-	return "", nil, fmt.Errorf("invalid operator '%s'", c.Operator)
+	return textCondition("req.body", c.Operator, c.Value, c.Values)
 }
 
-func (c *RequestBodyCondition) GetRequestJoinsString() (string, error) {
-	return "", nil
+// Formats of the bodies whose parameters can be matched by the body
+// parameter conditions.
+const (
+	BodyFormatForm      = "form"
+	BodyFormatMultipart = "multipart"
+	BodyFormatJSON      = "json"
+)
+
+// RequestBodyParamCondition matches a parameter of a form, multipart or JSON
+// request body. For JSON bodies, the name is a JSON path like '$.user.id';
+// names that do not start with '$' are relative to the root object.
+type RequestBodyParamCondition struct {
+	Format   string   `json:"format"`
+	Name     string   `json:"name"`
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
+}
+
+func (c *RequestBodyParamCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator(c.Format, c.Operator, headerOperators); err != nil {
+		return "", nil, err
+	}
+
+	return bodyParamCondition("req.body", "request_id = req.request_id", c.Format, c.Name, c.Operator, c.Value, c.Values)
 }
 
 type RequestRawCondition struct {
-	UniqueID string
-	Value    string
+	UniqueID string `json:"-"`
+	Operator string `json:"operator"`
+	Value    string `json:"value,omitempty"`
 }
 
 func (c *RequestRawCondition) GetRequestConditionString() (string, []any, error) {
-	headerTable := "h" + c.UniqueID
-	_ = headerTable
-	value := "%" + c.Value + "%"
+	operator := c.Operator
+	if operator == "" {
+		operator = "contains"
+	}
 
-	condition := ("req.url LIKE ?" +
-		"or req.method LIKE ? " +
-		"or req.body LIKE ? " +
-		"or " + headerTable + ".value LIKE ?" +
-		"or " + headerTable + ".name LIKE ?")
-	return condition, []any{value, value, value, value, value}, nil
-}
+	if err := checkOperator("raw", operator, rawOperators); err != nil {
+		return "", nil, err
+	}
+
+	if operator == "search" {
+		condition, values := searchCondition(c.Value, "url", "req_headers", "req_body")
+		return condition, values, nil
+	}
+
+	cond, values, err := rawCondition(operator, c.Value, "req.url", "req.method", "req.body")
+	if err != nil {
+		return "", nil, err
+	}
 
-func (c *RequestRawCondition) GetRequestJoinsString() (string, error) {
-	return "INNER JOIN headers h" + c.UniqueID + " ON h" + c.UniqueID + ".request_id = req.request_id", nil
+	headersCond, headersValues, err := rawHeadersCondition("h"+c.UniqueID, "request_id = req.request_id", operator, c.Value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return cond + " or " + headersCond, append(values, headersValues...), nil
 }
 
 type RequestTimestampCondition struct {
-	TimeAgo  time.Duration
-	Operator string
+	Operator string         `json:"operator"`
+	Value    TimestampValue `json:"value"`
+	// End is the upper bound of the between operator.
+	End TimestampValue `json:"end,omitzero"`
 }
 
 func (c *RequestTimestampCondition) GetRequestConditionString() (string, []any, error) {
-	seconds := strconv.Itoa(int(c.TimeAgo.Seconds()))
-	var op string
-	switch c.Operator {
-	case "eq":
-		op = "="
-	case "lt":
-		op = "<"
-	case "le":
-		op = "<="
-	case "gt":
-		op = ">"
-	case "ge":
-		op = ">="
-	default:
-		return "", nil, fmt.Errorf("invalid operator '%s'", c.Operator)
+	if err := checkOperator("timestamp", c.Operator, timestampOperators); err != nil {
+		return "", nil, err
 	}
-	condition := "req.timestamp " + op + " datetime('now', '-" + seconds + " seconds')"
 
-	return condition, nil, nil
-}
+	if c.Operator == "between" {
+		start, startValues := c.Value.sqlExpression()
+		end, endValues := c.End.sqlExpression()
+		condition := "req.timestamp BETWEEN " + start + " AND " + end
+
+		return condition, append(startValues, endValues...), nil
+	}
+
+	value, values := c.Value.sqlExpression()
+	condition := "req.timestamp " + comparisonOperators[c.Operator] + " " + value
 
-func (c *RequestTimestampCondition) GetRequestJoinsString() (string, error) {
-	return "", nil
+	return condition, values, nil
 }
 
 type RequestResponseStatusCondition struct {
-	Operator string
-	Value    int
+	Operator string `json:"operator"`
+	Value    int    `json:"value,omitempty"`
+	Values   []int  `json:"values,omitempty"`
 }
 
 func (c *RequestResponseStatusCondition) GetRequestConditionString() (string, []any, error) {
-	op := ""
-	switch c.Operator {
-	case "eq":
-		op = "="
-	case "lt":
-		op = "<"
-	case "le":
-		op = "<="
-	case "gt":
-		op = ">"
-	case "ge":
-		op = ">="
-	default:
-		return "", nil, fmt.Errorf("invalid operator '%s'", c.Operator)
+	if err := checkOperator("resp.status", c.Operator, statusOperators); err != nil {
+		return "", nil, err
 	}
-	condition := "resp.status_code " + op + " ?"
 
-	return condition, []any{c.Value}, nil
-}
+	// The value of the class operator is the first digit of the status
+	if c.Operator == "class" {
+		if c.Value < 1 || c.Value > 5 {
+			return "", nil, fmt.Errorf("invalid status class '%dxx'", c.Value)
+		}
+
+		return "resp.status_code BETWEEN ? AND ?", []any{c.Value * 100, c.Value*100 + 99}, nil
+	}
 
-func (c *RequestResponseStatusCondition) GetRequestJoinsString() (string, error) {
-	return "", nil
+	return compareCondition("resp.status_code", c.Operator, c.Value, intValues(c.Values))
 }
 
 type RequestResponseHeaderCondition struct {
-	UniqueID string
-	Name     string
-	Operator string
-	Value    string
+	UniqueID string   `json:"-"`
+	Name     string   `json:"name"`
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
 }
 
 func (c *RequestResponseHeaderCondition) GetRequestConditionString() (string, []any, error) {
-	condition := ""
-	tableName := "h" + c.UniqueID
-
-	switch c.Operator {
-	case "exists":
-		condition = "LOWER(" + tableName + ".name) = LOWER(?)"
-		return condition, []any{c.Name}, nil
+	if err := checkOperator("resp.header", c.Operator, headerOperators); err != nil {
+		return "", nil, err
+	}
 
-	case "contains":
-		condition = "LOWER(" + tableName + ".name) = LOWER(?) and " + tableName + ".value LIKE ?"
-		return condition, []any{c.Name, "%" + c.Value + "%"}, nil
+	return headerCondition("h"+c.UniqueID, "response_id = resp.response_id", c.Name, c.Operator, c.Value, c.Values)
+}
 
-	case "icontains":
-		condition = "LOWER(" + tableName + ".name) = LOWER(?) and LOWER(" + tableName + ".value) LIKE LOWER(?)"
-		return condition, []any{c.Name, "%" + c.Value + "%"}, nil
+type RequestResponseHeaderNumberCondition struct {
+	UniqueID string `json:"-"`
+	Name     string `json:"name"`
+	Operator string `json:"operator"`
+	Value    int    `json:"value,omitempty"`
+	Values   []int  `json:"values,omitempty"`
+}
 
-	default:
-		return "", nil, fmt.Errorf("invalid operator '%s'", c.Operator)
+func (c *RequestResponseHeaderNumberCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("resp.header", c.Operator, numericOperators); err != nil {
+		return "", nil, err
 	}
 
-	return condition, nil, nil
-}
-
-func (c *RequestResponseHeaderCondition) GetRequestJoinsString() (string, error) {
-	return "INNER JOIN headers h" + c.UniqueID + " ON h" + c.UniqueID + ".response_id = resp.response_id", nil
+	return headerNumberCondition("h"+c.UniqueID, "response_id = resp.response_id", c.Name, c.Operator, c.Value, c.Values)
 }
 
 type RequestResponseBodyCondition struct {
-	Operator string
-	Value    string
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
 }
 
 func (c *RequestResponseBodyCondition) GetRequestConditionString() (string, []any, error) {
-	switch c.Operator {
-	case "contains":
-		condition := "resp.body LIKE ?"
-		return condition, []any{"%" + c.Value + "%"}, nil
+	if err := checkOperator("resp.body", c.Operator, bodyOperators); err != nil {
+		return "", nil, err
+	}
 
-	case "icontains":
-		condition := "LOWER(resp.body) = LIKE LOWER(?)"
-		return condition, []any{"%" + c.Value + "%"}, nil
+	if c.Operator == "search" {
+		condition, values := searchCondition(c.Value, "resp_body")
+		return condition, values, nil
 	}
 
-	return "", nil, fmt.Errorf("invalid operator '%s'", c.Operator)
+	return textCondition("resp.body", c.Operator, c.Value, c.Values)
 }
 
-func (c *RequestResponseBodyCondition) GetRequestJoinsString() (string, error) {
-	return "", nil
+// RequestResponseBodyParamCondition matches a parameter of a form,
+// multipart or JSON response body.
+type RequestResponseBodyParamCondition struct {
+	Format   string   `json:"format"`
+	Name     string   `json:"name"`
+	Operator string   `json:"operator"`
+	Value    string   `json:"value,omitempty"`
+	Values   []string `json:"values,omitempty"`
+}
+
+func (c *RequestResponseBodyParamCondition) GetRequestConditionString() (string, []any, error) {
+	if err := checkOperator("resp."+c.Format, c.Operator, headerOperators); err != nil {
+		return "", nil, err
+	}
+
+	return bodyParamCondition("resp.body", "response_id = resp.response_id", c.Format, c.Name, c.Operator, c.Value, c.Values)
 }
 
 type RequestResponseRawCondition struct {
-	UniqueID string
-	Value    string
+	UniqueID string `json:"-"`
+	Operator string `json:"operator"`
+	Value    string `json:"value,omitempty"`
 }
 
 func (c *RequestResponseRawCondition) GetRequestConditionString() (string, []any, error) {
-	headerTable := "h" + c.UniqueID
-	value := "%" + c.Value + "%"
+	operator := c.Operator
+	if operator == "" {
+		operator = "contains"
+	}
+
+	if err := checkOperator("resp.raw", operator, rawOperators); err != nil {
+		return "", nil, err
+	}
+
+	if operator == "search" {
+		condition, values := searchCondition(c.Value, "resp_headers", "resp_body")
+		return condition, values, nil
+	}
+
+	cond, values, err := rawCondition(operator, c.Value, "resp.body")
+	if err != nil {
+		return "", nil, err
+	}
+
+	headersCond, headersValues, err := rawHeadersCondition("h"+c.UniqueID, "response_id = resp.response_id", operator, c.Value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return cond + " or " + headersCond, append(values, headersValues...), nil
+}
+
+// headerCondition compiles a condition over the headers of a request or a
+// response to an EXISTS subquery. Unlike a join, the subquery does not drop
+// messages without headers nor duplicate rows, and it can be negated.
+// correlation relates the headers table, aliased as tableName, to the outer
+// query.
+func headerCondition(tableName, correlation, name, operator, value string, values []string) (string, []any, error) {
+	nameCondition := "LOWER(" + tableName + ".name) = LOWER(?)"
+	if operator == "exists" {
+		return existsHeader(tableName, correlation, nameCondition), []any{name}, nil
+	}
+
+	valueCondition, valueValues, err := textCondition(tableName+".value", operator, value, values)
+	if err != nil {
+		return "", nil, err
+	}
+
+	condition := existsHeader(tableName, correlation, nameCondition+" and "+valueCondition)
+	return condition, append([]any{name}, valueValues...), nil
+}
+
+// headerNumberCondition is like headerCondition, but it compares the header
+// values as integers.
+func headerNumberCondition(tableName, correlation, name, operator string, value int, values []int) (string, []any, error) {
+	column := "TRIM(" + tableName + ".value)"
+	valueCondition, valueValues, err := compareCondition("CAST("+column+" AS INTEGER)", operator, value, intValues(values))
+	if err != nil {
+		return "", nil, err
+	}
+
+	nameCondition := "LOWER(" + tableName + ".name) = LOWER(?)"
+	isNumber := column + " != '' and " + column + " NOT GLOB '*[^0-9]*'"
+
+	condition := existsHeader(tableName, correlation, nameCondition+" and "+isNumber+" and "+valueCondition)
+	return condition, append([]any{name}, valueValues...), nil
+}
+
+// bodyParamCondition compiles a condition over a parameter of the body in
+// bodyColumn. Multipart bodies are parsed with the boundary of the
+// Content-Type header, found with correlation like in headerCondition.
+func bodyParamCondition(bodyColumn, correlation, format, name, operator, value string, values []string) (string, []any, error) {
+	var column string
+	var columnValues []any
+	switch format {
+	case BodyFormatForm:
+		column = "form_param(" + bodyColumn + ", ?)"
+		columnValues = []any{name}
+
+	case BodyFormatMultipart:
+		contentType := "(SELECT ct.value FROM headers ct WHERE ct." + correlation + " AND LOWER(ct.name) = 'content-type' LIMIT 1)"
+		column = "multipart_param(" + bodyColumn + ", " + contentType + ", ?)"
+		columnValues = []any{name}
+
+	case BodyFormatJSON:
+		return jsonCondition(bodyColumn, name, operator, value, values)
+
+	default:
+		return "", nil, fmt.Errorf("invalid body format '%s'", format)
+	}
+
+	if operator == "exists" {
+		return column + " IS NOT NULL", columnValues, nil
+	}
+
+	condition, conditionValues, err := textCondition(column, operator, value, values)
+	if err != nil {
+		return "", nil, err
+	}
 
-	condition := ("resp.body LIKE ? " +
-		"or " + headerTable + ".value LIKE ?" +
-		"or " + headerTable + ".name LIKE ?")
-	return condition, []any{value, value, value}, nil
+	return condition, append(columnValues, conditionValues...), nil
 }
 
-func (c *RequestResponseRawCondition) GetRequestJoinsString() (string, error) {
-	return "INNER JOIN headers h" + c.UniqueID + " ON h" + c.UniqueID + ".response_id = resp.response_id", nil
+// jsonCondition compiles a condition over the value at a JSON path of a
+// body. Values are compared as text, with booleans as 'true' and 'false';
+// objects and arrays are compared as JSON. Bodies that are not valid JSON
+// never match.
+func jsonCondition(bodyColumn, path, operator, value string, values []string) (string, []any, error) {
+	if !strings.HasPrefix(path, "$") {
+		path = "$." + path
+	}
+
+	// Bodies are saved as BLOBs, which SQLite would read as binary JSONB
+	text := "CAST(" + bodyColumn + " AS TEXT)"
+	body := "IIF(json_valid(" + text + "), " + text + ", NULL)"
+	if operator == "exists" {
+		return "json_type(" + body + ", ?) IS NOT NULL", []any{path}, nil
+	}
+
+	// json_extract returns 1 and 0 for true and false
+	column := "CASE json_type(" + body + ", ?) WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' ELSE CAST(json_extract(" + body + ", ?) AS TEXT) END"
+	condition, conditionValues, err := textCondition(column, operator, value, values)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return condition, append([]any{path, path}, conditionValues...), nil
+}
+
+// rawHeadersCondition matches if the name or the value of any header of a
+// request or a response matches the raw condition.
+func rawHeadersCondition(tableName, correlation, operator, value string) (string, []any, error) {
+	cond, values, err := rawCondition(operator, value, tableName+".value", tableName+".name")
+	if err != nil {
+		return "", nil, err
+	}
+
+	return existsHeader(tableName, correlation, "("+cond+")"), values, nil
+}
+
+func existsHeader(tableName, correlation, condition string) string {
+	return "EXISTS (SELECT 1 FROM headers " + tableName + " WHERE " + tableName + "." + correlation + " AND " + condition + ")"
+}
+
+// rawCondition applies the same text condition to several columns and
+// matches if any of them does.
+func rawCondition(operator, value string, columns ...string) (string, []any, error) {
+	conditions := make([]string, len(columns))
+	values := []any{}
+	for i, column := range columns {
+		cond, v, err := textCondition(column, operator, value, nil)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions[i] = cond
+		values = append(values, v...)
+	}
+
+	return strings.Join(conditions, " or "), values, nil
+}
+
+// RequestSubqueryCondition matches the requests whose field value is one of
+// the values of the same field in the requests matched by Query, like in
+// "path in (query requests where resp.status eq 403)".
+type RequestSubqueryCondition struct {
+	Field string `json:"field"`
+	Query *Query `json:"query"`
+}
+
+func (c *RequestSubqueryCondition) GetRequestConditionString() (string, []any, error) {
+	column, ok := fieldColumns[c.Field]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid subquery field '%s'", c.Field)
+	}
+
+	subquery, values, err := c.Query.selectColumn(column)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return column + " IN (" + subquery + ")", values, nil
 }
 
 type NotCondition struct {
@@ -318,15 +761,6 @@ func (c *NotCondition) GetRequestConditionString() (string, []any, error) {
 	return condition, values, nil
 }
 
-func (c *NotCondition) GetRequestJoinsString() (string, error) {
-	joins, err := c.Condition.GetRequestJoinsString()
-	if err != nil {
-		return "", err
-	}
-
-	return joins, nil
-}
-
 type AndCondition struct {
 	Condition1 RequestCondition
 	Condition2 RequestCondition
@@ -349,25 +783,6 @@ func (c *AndCondition) GetRequestConditionString() (string, []any, error) {
 	return condition, values, nil
 }
 
-func (c *AndCondition) GetRequestJoinsString() (string, error) {
-	joins1, err := c.Condition1.GetRequestJoinsString()
-	if err != nil {
-		return "", err
-	}
-
-	joins2, err := c.Condition2.GetRequestJoinsString()
-	if err != nil {
-		return "", err
-	}
-
-	joins := joins1
-	if joins2 != "" {
-		joins += " " + joins2
-	}
-
-	return joins, nil
-}
-
 type OrCondition struct {
 	Condition1 RequestCondition
 	Condition2 RequestCondition
@@ -390,47 +805,469 @@ func (c *OrCondition) GetRequestConditionString() (string, []any, error) {
 	return condition, values, nil
 }
 
-func (c *OrCondition) GetRequestJoinsString() (string, error) {
-	joins1, err := c.Condition1.GetRequestJoinsString()
-	if err != nil {
-		return "", err
+const fromRequests = " FROM requests req INNER JOIN responses resp on req.request_id = resp.response_id"
+
+// condition compiles the conditions of the query, including its set
+// operations, which are compiled to a compound SELECT of request ids.
+func (q *Query) condition() (string, []any, error) {
+	conditions := ""
+	var values []any
+
+	if q.RequestCondition != nil {
+		var err error
+		conditions, values, err = q.RequestCondition.GetRequestConditionString()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if len(q.SetOperations) == 0 {
+		return conditions, values, nil
+	}
+
+	compound := "SELECT req.request_id" + fromRequests
+	if conditions != "" {
+		compound += " WHERE " + conditions
+	}
+
+	for _, op := range q.SetOperations {
+		switch op.Operator {
+		case SetOperationUnion, SetOperationIntersect, SetOperationExcept:
+		default:
+			return "", nil, fmt.Errorf("invalid set operation '%s'", op.Operator)
+		}
+
+		if op.Query == nil || op.Query.Operation != QueryOperationGet {
+			return "", nil, fmt.Errorf("the operands of %s must be request queries", op.Operator)
+		}
+
+		// The operand is compiled as a whole, so that its own set operations
+		// are not mixed with the ones of this query
+		operand, operandValues, err := op.Query.selectColumn("req.request_id")
+		if err != nil {
+			return "", nil, err
+		}
+
+		compound += " " + strings.ToUpper(op.Operator) + " " + operand
+		values = append(values, operandValues...)
 	}
 
-	joins2, err := c.Condition2.GetRequestJoinsString()
+	return "req.request_id IN (" + compound + ")", values, nil
+}
+
+// selectColumn compiles a SELECT of column over the requests matched by the
+// query, to be used as a subquery.
+func (q *Query) selectColumn(column string) (string, []any, error) {
+	conditions, values, err := q.condition()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	joins := joins1
-	if joins2 != "" {
-		joins += " " + joins2
+	query := "SELECT " + column + fromRequests
+	if conditions != "" {
+		query += " WHERE " + conditions
 	}
 
-	return joins, nil
+	return query, values, nil
 }
 
 func (q *Query) Compile() (string, []any, error) {
-	conditions, values, err := q.RequestCondition.GetRequestConditionString()
+	conditions, values, err := q.condition()
 	if err != nil {
 		return "", nil, err
 	}
-	joins, err := q.RequestCondition.GetRequestJoinsString()
+
+	from := fromRequests
+	if conditions != "" {
+		from += " WHERE " + conditions
+	}
+
+	switch q.Operation {
+	case QueryOperationGet:
+		if len(q.GroupBy) > 0 {
+			return q.compileEndpoints(from, values)
+		}
+
+		return q.compileRequests(from, values, nil)
+
+	case QueryOperationCount:
+		if len(q.GroupBy) == 0 {
+			return "SELECT COUNT(*)" + from, values, nil
+		}
+
+		selectColumns := make([]string, len(q.GroupBy))
+		groupColumns := make([]string, len(q.GroupBy))
+		for i, field := range q.GroupBy {
+			column, ok := fieldColumns[field]
+			if !ok || !IsGroupByField(field) {
+				return "", nil, fmt.Errorf("invalid group by field '%s'", field)
+			}
+			groupColumns[i] = "g" + strconv.Itoa(i)
+			selectColumns[i] = column + " AS " + groupColumns[i]
+		}
+
+		orderBy, err := q.orderByString(func(field string) (string, error) {
+			if field == "count" {
+				return "COUNT(*)", nil
+			}
+			for i, g := range q.GroupBy {
+				if g == field {
+					return groupColumns[i], nil
+				}
+			}
+			return "", fmt.Errorf("count queries can only be ordered by count or a group by field, not '%s'", field)
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		if orderBy == "" {
+			orderBy = "COUNT(*) DESC"
+		}
+
+		query := "SELECT " + strings.Join(selectColumns, ", ") + ", COUNT(*)"
+		query += from
+		query += " GROUP BY " + strings.Join(groupColumns, ", ")
+		query += " ORDER BY " + orderBy
+
+		limit, limitValues := q.limitString()
+		return query + limit, append(values, limitValues...), nil
+	}
+
+	return "", nil, fmt.Errorf("invalid query operation '%d'", q.Operation)
+}
+
+func (q *Query) orderByString(column func(string) (string, error)) (string, error) {
+	terms := make([]string, len(q.OrderBy))
+	for i, o := range q.OrderBy {
+		c, err := column(o.Field)
+		if err != nil {
+			return "", err
+		}
+
+		if o.Descending {
+			terms[i] = c + " DESC"
+		} else {
+			terms[i] = c + " ASC"
+		}
+	}
+
+	return strings.Join(terms, ", "), nil
+}
+
+// CompileColumns compiles a query that gets requests like Compile, adding
+// the values of columns after the timestamp, id, method, status code and URL
+// of each request. The valid columns are the ones CheckColumn accepts.
+func (q *Query) CompileColumns(columns []string) (string, []any, error) {
+	if q.Operation != QueryOperationGet || q.IsEndpointsQuery() {
+		return "", nil, fmt.Errorf("columns can only be added to queries that get requests")
+	}
+
+	conditions, values, err := q.condition()
+	if err != nil {
+		return "", nil, err
+	}
+
+	from := fromRequests
+	if conditions != "" {
+		from += " WHERE " + conditions
+	}
+
+	return q.compileRequests(from, values, columns)
+}
+
+// compileRequests compiles a query that gets requests, with the values of
+// columns after the ones of every request.
+func (q *Query) compileRequests(from string, values []any, columns []string) (string, []any, error) {
+	orderBy, err := q.orderByString(func(field string) (string, error) {
+		column, ok := fieldColumns[field]
+		if !ok {
+			return "", fmt.Errorf("invalid order by field '%s'", field)
+		}
+		return column, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if orderBy == "" {
+		orderBy = "req.timestamp DESC"
+	}
+
+	// The parameters of the columns come before the ones of the conditions
+	query := "SELECT req.timestamp, req.request_id, req.method, resp.status_code, req.url"
+	selectValues := []any{}
+	for _, c := range columns {
+		column, columnValues, err := columnExpression(c)
+		if err != nil {
+			return "", nil, err
+		}
+		query += ", " + column
+		selectValues = append(selectValues, columnValues...)
+	}
+	query += from
+	query += " ORDER BY " + orderBy
+
+	limit, limitValues := q.limitString()
+	values = append(selectValues, values...)
+	return query + limit, append(values, limitValues...), nil
+}
+
+// PageKey has the values a query is sorted by for a row, used to get the
+// rows that come after it with CompilePage.
+type PageKey []any
+
+// orderTerm is an expression a page of requests is sorted by.
+type orderTerm struct {
+	expression string
+	descending bool
+}
+
+// nonNullFields are the fields of fieldColumns whose column is never NULL.
+// The others, like the timestamp or the parts of URLs that cannot be parsed,
+// can be.
+var nonNullFields = map[string]bool{
+	"id":                true,
+	"method":            true,
+	"status":            true,
+	"url":               true,
+	"req_size":          true,
+	"resp_size":         true,
+	"header_count":      true,
+	"resp_header_count": true,
+}
+
+// pageOrder returns the terms the pages of a query are sorted by: the ones
+// of its order by, or the timestamp in descending order by default, and the
+// request id to break ties. NULL values of the columns that can have them
+// are replaced with -1, which sorts them first like SQLite does, since they
+// cannot be compared in the page key condition. The other columns, like the
+// request id, are used as they are, so SQLite can use their indexes.
+func (q *Query) pageOrder() ([]orderTerm, error) {
+	orderBy := q.OrderBy
+	if len(orderBy) == 0 {
+		orderBy = []OrderBy{{Field: "timestamp", Descending: true}}
+	}
+
+	terms := []orderTerm{}
+	for _, o := range orderBy {
+		column, ok := fieldColumns[o.Field]
+		if !ok {
+			return nil, fmt.Errorf("invalid order by field '%s'", o.Field)
+		}
+		if !nonNullFields[o.Field] {
+			column = "IFNULL(" + column + ", -1)"
+		}
+		terms = append(terms, orderTerm{expression: column, descending: o.Descending})
+	}
+
+	if !slices.ContainsFunc(orderBy, func(o OrderBy) bool { return o.Field == "id" }) {
+		terms = append(terms, orderTerm{
+			expression: "req.request_id",
+			descending: orderBy[len(orderBy)-1].Descending,
+		})
+	}
+
+	return terms, nil
+}
+
+// PageKeySize returns the number of values of the page keys of q, which come
+// after the columns of the rows returned by the queries of CompilePage.
+func (q *Query) PageKeySize() (int, error) {
+	terms, err := q.pageOrder()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(terms), nil
+}
+
+// CompilePage compiles a query that gets up to limit of the requests of q,
+// with the values of columns like CompileColumns, that come after the one
+// with the page key after, or from the start if after is nil. Rows are
+// followed by their page key, to get the next page with it. offset is the
+// number of rows skipped, and the limit and offset of q are not used.
+//
+// Rows with the same values of the fields a query is sorted by are sorted by
+// id, so pages do not skip or repeat rows.
+func (q *Query) CompilePage(columns []string, after PageKey, limit, offset int) (string, []any, error) {
+	if q.Operation != QueryOperationGet || q.IsEndpointsQuery() {
+		return "", nil, fmt.Errorf("only queries that get requests can be paginated")
+	}
+
+	terms, err := q.pageOrder()
 	if err != nil {
 		return "", nil, err
 	}
+	if after != nil && len(after) != len(terms) {
+		return "", nil, fmt.Errorf("invalid page key, expected %d values, got %d", len(terms), len(after))
+	}
+
+	// The parameters of the columns come before the ones of the conditions
+	query := "SELECT req.timestamp, req.request_id, req.method, resp.status_code, req.url"
+	values := []any{}
+	for _, c := range columns {
+		column, columnValues, err := columnExpression(c)
+		if err != nil {
+			return "", nil, err
+		}
+		query += ", " + column
+		values = append(values, columnValues...)
+	}
 
-	query := "SELECT DISTINCT req.timestamp, req.request_id, req.method, resp.status_code, req.url FROM requests req"
-	query += " INNER JOIN responses resp on req.request_id = resp.response_id"
+	orderBy := make([]string, len(terms))
+	for i, t := range terms {
+		query += ", " + t.expression
+		orderBy[i] = t.expression + " ASC"
+		if t.descending {
+			orderBy[i] = t.expression + " DESC"
+		}
+	}
+	query += fromRequests
 
-	if joins != "" {
-		query += " " + joins
+	conditions, conditionValues, err := q.condition()
+	if err != nil {
+		return "", nil, err
+	}
+	values = append(values, conditionValues...)
+
+	if after != nil {
+		keyCondition, keyValues := pageKeyCondition(terms, after)
+		if conditions != "" {
+			conditions = "(" + conditions + ") and " + keyCondition
+		} else {
+			conditions = keyCondition
+		}
+		values = append(values, keyValues...)
 	}
 
 	if conditions != "" {
 		query += " WHERE " + conditions
 	}
+	query += " ORDER BY " + strings.Join(orderBy, ", ")
+	query += " LIMIT ? OFFSET ?"
 
-	query += " " + "ORDER BY req.timestamp DESC"
+	return query, append(values, limit, max(offset, 0)), nil
+}
 
-	return query, values, nil
+// pageKeyCondition compiles the condition of the rows that come after the
+// one with the page key after, in the order of terms: the ones with a
+// greater first term, or the same first term and a greater second one, and
+// so on, where greater means smaller for descending terms.
+func pageKeyCondition(terms []orderTerm, after PageKey) (string, []any) {
+	alternatives := make([]string, len(terms))
+	values := []any{}
+	for i, t := range terms {
+		parts := []string{}
+		for j := range i {
+			parts = append(parts, terms[j].expression+" = ?")
+			values = append(values, after[j])
+		}
+
+		operator := " > ?"
+		if t.descending {
+			operator = " < ?"
+		}
+		parts = append(parts, t.expression+operator)
+		values = append(values, after[i])
+
+		alternatives[i] = "(" + strings.Join(parts, " and ") + ")"
+	}
+
+	return "(" + strings.Join(alternatives, " or ") + ")", values
+}
+
+// After returns a query for the requests matched by q with an id greater
+// than id, oldest first and without a limit. It is used to follow the
+// requests matched by a query as the proxy stores them, since ids grow as
+// requests are stored.
+func (q *Query) After(id string) *Query {
+	var condition RequestCondition = &RequestIdCondition{Operator: "gt", Id: id}
+
+	switch {
+	case len(q.SetOperations) > 0:
+		condition = &AndCondition{
+			Condition1: condition,
+			Condition2: &RequestSubqueryCondition{Field: "id", Query: q},
+		}
+	case q.RequestCondition != nil:
+		condition = &AndCondition{Condition1: condition, Condition2: q.RequestCondition}
+	}
+
+	return &Query{
+		Operation:        QueryOperationGet,
+		RequestCondition: condition,
+		OrderBy:          []OrderBy{{Field: "id"}},
+	}
+}
+
+// endpointColumns are the fields the requests of an endpoints query are
+// grouped by, in the order they are returned.
+var endpointColumns = []string{"host", "method", "endpoint"}
+
+// IsEndpointsQuery reports whether q is a requests query grouped by
+// endpoint, which returns the endpoints of the requests instead of the
+// requests themselves.
+func (q *Query) IsEndpointsQuery() bool {
+	return q.Operation == QueryOperationGet && len(q.GroupBy) > 0
+}
+
+func checkEndpointsGroupBy(groupBy []string) error {
+	if len(groupBy) != 1 || groupBy[0] != "endpoint" {
+		return fmt.Errorf("requests queries can only be grouped by endpoint, use a count query to group by other fields")
+	}
+
+	return nil
+}
+
+// compileEndpoints compiles a requests query grouped by endpoint. It returns
+// a row per host, method and endpoint, with the number of requests and the
+// distinct response status codes separated by commas.
+func (q *Query) compileEndpoints(from string, values []any) (string, []any, error) {
+	if err := checkEndpointsGroupBy(q.GroupBy); err != nil {
+		return "", nil, err
+	}
+
+	selectColumns := make([]string, len(endpointColumns))
+	for i, field := range endpointColumns {
+		selectColumns[i] = fieldColumns[field] + " AS g" + strconv.Itoa(i)
+	}
+
+	orderBy, err := q.orderByString(func(field string) (string, error) {
+		if field == "count" {
+			return "COUNT(*)", nil
+		}
+		for i, c := range endpointColumns {
+			if c == field {
+				return "g" + strconv.Itoa(i), nil
+			}
+		}
+		return "", fmt.Errorf("endpoints can only be ordered by count, host, method or endpoint, not '%s'", field)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if orderBy == "" {
+		orderBy = "g0, g2, g1"
+	}
+
+	query := "SELECT " + strings.Join(selectColumns, ", ") + ", COUNT(*), GROUP_CONCAT(DISTINCT resp.status_code)"
+	query += from
+	query += " GROUP BY g0, g1, g2"
+	query += " ORDER BY " + orderBy
+
+	limit, limitValues := q.limitString()
+	return query + limit, append(values, limitValues...), nil
+}
+
+func (q *Query) limitString() (string, []any) {
+	if q.Limit <= 0 && q.Offset <= 0 {
+		return "", nil
+	}
+
+	// SQLite only accepts OFFSET after LIMIT; a negative limit means no limit
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	return " LIMIT ? OFFSET ?", []any{limit, max(q.Offset, 0)}
 }
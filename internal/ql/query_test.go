@@ -0,0 +1,1770 @@
+package ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artilugio0/efin-suite/internal/ql/qltest"
+)
+
+// newFixtureDB creates a DB with qltest.Requests for a test.
+func newFixtureDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	_, db := qltest.NewDB(t, qltest.Requests)
+	return db
+}
+
+// queryIDs runs a text query and returns the ids of the matching requests,
+// sorted in ascending order.
+func queryIDs(t *testing.T, db *sql.DB, input string) ([]int, error) {
+	t.Helper()
+
+	query, err := ParseQuery(input)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlQuery, args, err := query.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		t.Fatalf("query '%s' compiled to invalid SQL '%s': %v", input, sqlQuery, err)
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var (
+			timestamp, method, url string
+			id, status             int
+		)
+		if err := rows.Scan(&timestamp, &id, &method, &status, &url); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func TestMatches(t *testing.T) {
+	db := newFixtureDB(t)
+
+	tests := []struct {
+		where string
+		want  []int
+	}{
+		{"id matches '^[34]$'", []int{3, 4}},
+		{"method matches '^P'", []int{2, 3}},
+		{"path matches 'items/[0-9]+$'", []int{4}},
+		{"path matches 'upload'", []int{}},
+		{"path matches '(?i)upload'", []int{3}},
+		{"body matches '^user='", []int{2}},
+		{"header.content-type matches '^text/'", []int{3}},
+		{"raw matches 'other[.]org'", []int{3, 4}},
+		{"resp.body matches '^[{]'", []int{1}},
+		{"resp.header.content-type matches 'html$'", []int{3}},
+		{"resp.raw matches '^/home$'", []int{2}},
+		{"method matches '^P' and not path matches 'Upload'", []int{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			got, err := queryIDs(t, db, "query requests where "+tt.where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidMatches(t *testing.T) {
+	db := newFixtureDB(t)
+
+	tests := []string{
+		"path matches '('",
+		"header.host matches '[a-'",
+		"raw matches '*'",
+		"resp.status matches '^2'",
+		"timestamp matches '2024'",
+	}
+
+	for _, where := range tests {
+		t.Run(where, func(t *testing.T) {
+			if _, err := queryIDs(t, db, "query requests where "+where); err == nil {
+				t.Errorf("expected an error for '%s'", where)
+			}
+		})
+	}
+}
+
+// countGroups runs a count query and returns its rows, with the values of
+// the group by fields followed by the count, joined by spaces.
+func countGroups(t *testing.T, db *sql.DB, input string) []string {
+	t.Helper()
+
+	query, err := ParseQuery(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlQuery, args, err := query.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		t.Fatalf("query '%s' compiled to invalid SQL '%s': %v", input, sqlQuery, err)
+	}
+	defer rows.Close()
+
+	result := []string{}
+	for rows.Next() {
+		values := make([]string, len(query.GroupBy)+1)
+		dest := make([]any, len(values))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, strings.Join(values, " "))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestCount(t *testing.T) {
+	db := newFixtureDB(t)
+
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"query count", []string{"4"}},
+		{"query count where method = GET", []string{"1"}},
+		{"query count where header.content-type exists", []string{"4"}},
+		{"query count where resp.status >= 400", []string{"2"}},
+		{"query count group by method", []string{"DELETE 1", "GET 1", "POST 1", "PUT 1"}},
+		{"query count group by host", []string{"example.com 2", "other.org 2"}},
+		{"query count where resp.status >= 300 group by host", []string{"other.org 2", "example.com 1"}},
+		{"query count group by HOST, status", []string{"example.com 200 1", "example.com 302 1", "other.org 403 1", "other.org 500 1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got := countGroups(t, db, tt.input)
+
+			// Groups with the same count have no order
+			if len(got) > 1 && !strings.HasPrefix(tt.input, "query count where") {
+				slices.Sort(got)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got rows %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidCount(t *testing.T) {
+	tests := []string{
+		"query count group by",
+		"query count group by body",
+		"query count group by host,",
+		"query count group host",
+		"query count where method = GET extra",
+	}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if _, err := ParseQuery(input); err == nil {
+				t.Errorf("expected an error for '%s'", input)
+			}
+		})
+	}
+}
+
+func TestTimestampConditions(t *testing.T) {
+	db := newFixtureDB(t)
+
+	tests := []struct {
+		where string
+		want  []int
+	}{
+		{"timestamp = '2024-01-01T11:00:00Z'", []int{2}},
+		{"timestamp > '2024-01-01T11:00:00Z'", []int{3, 4}},
+		{"timestamp >= '2024-01-01T11:00:00Z'", []int{2, 3, 4}},
+		{"timestamp < '2024-01-01T11:00:00Z'", []int{1}},
+		{"timestamp <= '2024-01-01T11:00:00+00:00'", []int{1, 2}},
+		{"timestamp >= '2024-01-01T12:00:00+01:00'", []int{2, 3, 4}},
+		{"timestamp between '2024-01-01T10:30:00Z' and '2024-01-01T12:30:00Z'", []int{2, 3}},
+		{"timestamp between '2024-01-01T10:30:00Z' and '2024-01-01T12:30:00Z' and method = PUT", []int{3}},
+		{"timestamp > request 3", []int{4}},
+		{"timestamp <= request '2'", []int{1, 2}},
+		{"timestamp between request 2 and request 3", []int{2, 3}},
+		{"timestamp < 1d ago", []int{1, 2, 3, 4}},
+		{"timestamp > 1d12h ago", []int{}},
+		{"timestamp between 1000d ago and 1h30m ago", []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			got, err := queryIDs(t, db, "query requests where "+tt.where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidTimestampConditions(t *testing.T) {
+	tests := []string{
+		"timestamp > '2024-13-01'",
+		"timestamp > 1h",
+		"timestamp > request",
+		"timestamp between '2024-01-01'",
+		"timestamp between '2024-01-01' or '2024-01-02'",
+		"timestamp contains '2024'",
+	}
+
+	for _, where := range tests {
+		t.Run(where, func(t *testing.T) {
+			if _, err := ParseQuery("query requests where " + where); err == nil {
+				t.Errorf("expected an error for '%s'", where)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input string
+		want  time.Duration
+	}{
+		{"30s", 30 * time.Second},
+		{"1h30m", 90 * time.Minute},
+		{"2d12h", 60 * time.Hour},
+		{"0m", 0},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.input)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.input, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{"", "1", "h", "1w", "1h 30m", "-1h"} {
+		if _, err := ParseDuration(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+// orderedIDs runs a text query and returns the ids of the matching
+// requests, in the order they are returned.
+func orderedIDs(t *testing.T, db *sql.DB, input string) []int {
+	t.Helper()
+
+	query, err := ParseQuery(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlQuery, args, err := query.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		t.Fatalf("invalid SQL '%s': %v", sqlQuery, err)
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var (
+			timestamp, method, url string
+			id, status             int
+		)
+		if err := rows.Scan(&timestamp, &id, &method, &status, &url); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ids
+}
+
+func TestOrderByLimitOffset(t *testing.T) {
+	db := newFixtureDB(t)
+
+	tests := []struct {
+		input string
+		want  []int
+	}{
+		{"query requests", []int{4, 3, 2, 1}},
+		{"query requests order by status", []int{1, 2, 4, 3}},
+		{"query requests order by method desc", []int{3, 2, 1, 4}},
+		{"query requests order by host, id desc", []int{2, 1, 4, 3}},
+		{"query requests order by req_size desc, id asc", []int{2, 3, 1, 4}},
+		{"query requests where path contains 'api' order by ID", []int{1, 2, 4}},
+		{"query requests limit 2", []int{4, 3}},
+		{"query requests limit 2 offset 1", []int{3, 2}},
+		{"query requests offset 3", []int{1}},
+		{"query requests order by id limit 10 offset 2", []int{3, 4}},
+		{"query requests where method = GET limit 5", []int{1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := orderedIDs(t, db, tt.input); !slices.Equal(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	countTests := []struct {
+		input string
+		want  []string
+	}{
+		{"query count group by host order by host desc", []string{"other.org 2", "example.com 2"}},
+		{"query count group by method order by method limit 2", []string{"DELETE 1", "GET 1"}},
+		{"query count group by status order by status desc limit 2 offset 1", []string{"403 1", "302 1"}},
+		{"query count where resp.status >= 300 group by host order by count", []string{"example.com 1", "other.org 2"}},
+	}
+
+	for _, tt := range countTests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := countGroups(t, db, tt.input); !slices.Equal(got, tt.want) {
+				t.Errorf("got rows %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidOrderByLimitOffset(t *testing.T) {
+	tests := []string{
+		"query requests order by body",
+		"query requests order by",
+		"query requests order by id,",
+		"query requests limit",
+		"query requests limit 'a'",
+		"query requests limit 1 order by id",
+		"query requests offset 1 limit 2",
+		"query count group by host order by method",
+		"query requests order by count",
+	}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			query, err := ParseQuery(input)
+			if err != nil {
+				return
+			}
+
+			if _, _, err := query.Compile(); err == nil {
+				t.Errorf("expected an error for '%s'", input)
+			}
+		})
+	}
+}
+
+func TestOperatorMatrix(t *testing.T) {
+	db := newFixtureDB(t)
+
+	for _, tt := range qltest.OperatorMatrix {
+		t.Run(tt.Where, func(t *testing.T) {
+			got, err := queryIDs(t, db, "query requests where "+tt.Where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tt.Want) {
+				t.Errorf("got ids %v, want %v", got, tt.Want)
+			}
+		})
+	}
+}
+
+func TestInvalidOperators(t *testing.T) {
+	// Operators a field does not support are rejected by the parser.
+	// Conditions built by the Lua DSL skip the parser, so Compile rejects
+	// them too, along with the values that are only checked when compiling
+	tests := []struct {
+		where string
+		stage string
+	}{
+		{"id contains '1'", "parse"},
+		{"id exists", "parse"},
+		{"timestamp contains '2024'", "parse"},
+		{"timestamp in ('2024-01-01')", "parse"},
+		{"method gt 'GET'", "parse"},
+		{"method exists", "parse"},
+		{"path lt 'a'", "parse"},
+		{"body exists", "parse"},
+		{"header.host gt 'a'", "parse"},
+		{"header.host between 'a' and 'b'", "parse"},
+		{"raw eq 'a'", "parse"},
+		{"raw in ('a')", "parse"},
+		{"resp.status contains '2'", "parse"},
+		{"resp.status matches '^2'", "parse"},
+		{"resp.body ge 'a'", "parse"},
+		{"resp.header.location lt 'a'", "parse"},
+		{"resp.raw ne 'a'", "parse"},
+		{"method in ()", "parse"},
+		{"method eq 'FETCH'", "parse"},
+		{"path matches '('", "compile"},
+		{"method search 'GET'", "parse"},
+		{"header.host search 'example'", "parse"},
+		{"host exists", "parse"},
+		{"scheme gt 'http'", "parse"},
+		{"port contains '80'", "parse"},
+		{"port eq '80'", "parse"},
+		{"param.id search 'x'", "parse"},
+		{"param.id lt 'a'", "parse"},
+		{"form.user gt 'a'", "parse"},
+		{"json.id search 'a'", "parse"},
+		{"resp.multipart.file lt 'a'", "parse"},
+		{"req_size contains '1'", "parse"},
+		{"header_count eq '1'", "parse"},
+		{"resp.header.content-length.as_number contains '1'", "parse"},
+		{"resp.status class '6xx'", "parse"},
+		{"resp.status class 'abc'", "parse"},
+		{"resp.body class '2xx'", "parse"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			query, err := ParseQuery("query requests where " + tt.where)
+			if (err != nil) != (tt.stage == "parse") {
+				t.Fatalf("got parse error %v, want an error only if the stage is parse, not %s", err, tt.stage)
+			}
+			if err != nil {
+				return
+			}
+
+			if _, _, err := query.Compile(); err == nil {
+				t.Errorf("expected a compile error for '%s'", tt.where)
+			}
+		})
+	}
+}
+
+func TestHeaderConditions(t *testing.T) {
+	db := newFixtureDB(t)
+
+	// A request and response without any headers
+	if _, err := db.Exec("INSERT INTO requests (request_id, method, url, body, timestamp) VALUES (5, 'GET', 'https://example.com/health', '', '2024-01-01 14:00:00')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body, content_length) VALUES (5, 204, '', 0)"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		where string
+		want  []int
+	}{
+		{"method eq GET", []int{1, 5}},
+		{"not header.x-csrf exists", []int{1, 3, 4, 5}},
+		{"not header.content-type eq 'application/json'", []int{2, 3, 5}},
+		{"not resp.header.content-type exists", []int{2, 5}},
+		{"header.x-csrf exists or method eq GET", []int{1, 2, 5}},
+		{"resp.header.location exists or path contains 'health'", []int{2, 5}},
+		{"header.host eq 'example.com' and header.content-type contains 'json'", []int{1}},
+		{"header.host eq 'example.com' and header.content-type contains 'x-www'", []int{2}},
+		{"header.host eq 'example.com' and not header.x-csrf exists", []int{1}},
+		{"raw contains 'health'", []int{5}},
+		{"not raw contains 'example.com'", []int{3, 4}},
+		{"raw contains 'X-Csrf' or resp.raw contains 'forbidden'", []int{2, 4}},
+		{"not resp.raw contains 'text'", []int{1, 2, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			got, err := queryIDs(t, db, "query requests where "+tt.where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Requests matching several header conditions are counted once
+	query, err := ParseQuery("query count where header.host exists and header.content-type exists and raw contains 'e'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlQuery, args, err := query.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err := db.QueryRow(sqlQuery, args...).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 4 {
+		t.Errorf("got count %d, want 4", count)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db := newFixtureDB(t)
+	ctx := context.Background()
+
+	query, err := ParseQuery("query requests where body search 'admin'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlQuery, args, err := query.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Query(sqlQuery, args...); !IsMissingFullTextIndex(err) {
+		t.Fatalf("expected a missing index error, got %v", err)
+	}
+
+	added, err := BuildFullTextIndex(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != int64(len(qltest.Requests)) {
+		t.Errorf("got %d requests added to the index, want %d", added, len(qltest.Requests))
+	}
+
+	tests := []struct {
+		where string
+		want  []int
+	}{
+		{"body search 'admin'", []int{2}},
+		{"body search 'ADMIN'", []int{2}},
+		{"body search 'data OR admin'", []int{2, 3}},
+		{"body search 'adm*'", []int{2}},
+		{"body search 'forbidden'", []int{}},
+		{"resp.body search 'forbidden'", []int{4}},
+		{"resp.body search '\"internal error\"'", []int{3}},
+		{"raw search 'csrf'", []int{2}},
+		{"raw search 'other'", []int{3, 4}},
+		{"raw search 'forbidden'", []int{}},
+		{"resp.raw search 'location'", []int{2}},
+		{"resp.raw search 'html OR forbidden'", []int{3, 4}},
+		{"not body search 'admin' and method ne GET", []int{3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			got, err := queryIDs(t, db, "query requests where "+tt.where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Requests saved after the index was built are added by the next build,
+	// and the ones still waiting for their response once it arrives
+	if _, err := db.Exec("INSERT INTO requests (request_id, method, url, body) VALUES (5, 'POST', 'https://example.com/api/token', 'refresh_token=xyz'), (6, 'POST', 'https://example.com/api/token', 'refresh_token=abc'), (7, 'GET', 'https://example.com/api/me', '')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (5, 200, ''), (7, 200, '')"); err != nil {
+		t.Fatal(err)
+	}
+
+	added, err = BuildFullTextIndex(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 {
+		t.Errorf("got %d requests added to the index, want 2", added)
+	}
+
+	if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (6, 200, '')"); err != nil {
+		t.Fatal(err)
+	}
+
+	added, err = BuildFullTextIndex(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 {
+		t.Errorf("got %d requests added to the index, want 1", added)
+	}
+
+	got, err := queryIDs(t, db, "query requests where body search 'refresh_token'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []int{5, 6}) {
+		t.Errorf("got ids %v, want [5 6]", got)
+	}
+
+	// Only the requests after the mark are looked at by the next build
+	added, err = BuildFullTextIndex(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 {
+		t.Errorf("got %d requests added to the index, want 0", added)
+	}
+
+	var mark int
+	if err := db.QueryRow("SELECT mark FROM " + FullTextIndexTable + "_state").Scan(&mark); err != nil {
+		t.Fatal(err)
+	}
+	if mark != 7 {
+		t.Errorf("got mark %d, want 7", mark)
+	}
+}
+
+func TestURLConditions(t *testing.T) {
+	db := newFixtureDB(t)
+
+	for _, r := range []struct {
+		id  int
+		url string
+	}{
+		{5, "http://API.Internal:8080/v1/items?id=7&sort=asc"},
+		{6, "https://db.internal/query?q=select%20*&id=&id=9"},
+	} {
+		if _, err := db.Exec("INSERT INTO requests (request_id, method, url, body) VALUES (?, 'GET', ?, '')", r.id, r.url); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (?, 200, '')", r.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		where string
+		want  []int
+	}{
+		{"url eq 'https://other.org/Upload'", []int{3}},
+		{"url contains '?'", []int{5, 6}},
+		{"host eq 'example.com'", []int{1, 2}},
+		{"host eq 'api.internal'", []int{5}},
+		{"host eq 'API.INTERNAL'", []int{5}},
+		{"host matches '\\.internal$'", []int{5, 6}},
+		{"host in ('other.org', 'db.internal')", []int{3, 4, 6}},
+		{"scheme eq 'http'", []int{5}},
+		{"scheme eq 'HTTPS'", []int{1, 2, 3, 4, 6}},
+		{"port eq 443", []int{1, 2, 3, 4, 6}},
+		{"port ne 443", []int{5}},
+		{"port gt 1024", []int{5}},
+		{"port in (80, 8080)", []int{5}},
+		{"path eq '/v1/items'", []int{5}},
+		{"query_string contains 'sort=asc'", []int{5}},
+		{"query_string eq ''", []int{1, 2, 3, 4}},
+		{"param.id exists", []int{5, 6}},
+		{"param.id eq '7'", []int{5}},
+		{"param.id eq ''", []int{6}},
+		{"param.q eq 'select *'", []int{6}},
+		{"param.'sort' in ('asc', 'desc')", []int{5}},
+		{"not param.sort exists", []int{1, 2, 3, 4, 6}},
+		{"host matches '\\.internal$' and param.id exists", []int{5, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			got, err := queryIDs(t, db, "query requests where "+tt.where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyParamConditions(t *testing.T) {
+	db := newFixtureDB(t)
+
+	multipartBody := "--XyZ\r\n" +
+		"Content-Disposition: form-data; name=\"role\"\r\n\r\n" +
+		"admin\r\n" +
+		"--XyZ\r\n" +
+		"Content-Disposition: form-data; name=\"avatar\"; filename=\"a.png\"\r\n" +
+		"Content-Type: image/png\r\n\r\n" +
+		"PNG\r\n" +
+		"--XyZ--\r\n"
+
+	for _, r := range []struct {
+		id          int
+		body        string
+		contentType string
+	}{
+		{5, `{"user":{"id":7,"name":"bob"},"isAdmin":true,"tags":["a","b"]}`, "application/json"},
+		{6, multipartBody, "multipart/form-data; boundary=XyZ"},
+		{7, `{"user":{"id":"7"},"isAdmin":false}`, "application/json"},
+	} {
+		if _, err := db.Exec("INSERT INTO requests (request_id, method, url, body) VALUES (?, 'POST', 'https://example.com/api/users', ?)", r.id, []byte(r.body)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (?, 200, '')", r.id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO headers (request_id, name, value) VALUES (?, 'Content-Type', ?)", r.id, r.contentType); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		where string
+		want  []int
+	}{
+		{"form.user eq 'admin'", []int{2}},
+		{"form.user exists", []int{2}},
+		// '100%_secret' is not a valid escape, so the pair is skipped
+		{"form.pass exists", []int{}},
+		{"form.role exists", []int{}},
+		{"multipart.role eq 'admin'", []int{6}},
+		{"multipart.avatar contains 'PNG'", []int{6}},
+		{"multipart.missing exists", []int{}},
+		{"json.'$.user.id' eq '7'", []int{5, 7}},
+		{"json.'$.user.name' in ('bob', 'alice')", []int{5}},
+		{"json.isAdmin eq 'true'", []int{5}},
+		{"json.isAdmin exists", []int{5, 7}},
+		{"not json.isAdmin exists", []int{1, 2, 3, 4, 6}},
+		{"json.'$.tags[1]' eq 'b'", []int{5}},
+		{"json.tags contains '\"a\"'", []int{5}},
+		{"resp.json.ok eq 'true'", []int{1}},
+		{"resp.json.ok exists or resp.form.ok exists", []int{1}},
+		{"json.isAdmin eq 'true' or form.user eq 'admin' or multipart.role eq 'admin'", []int{2, 5, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			got, err := queryIDs(t, db, "query requests where "+tt.where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumericConditions(t *testing.T) {
+	db := newFixtureDB(t)
+
+	for _, h := range []struct {
+		id    int
+		value string
+	}{
+		{1, "11"},
+		{3, " 14 "},
+		{4, "abc"},
+	} {
+		if _, err := db.Exec("INSERT INTO headers (response_id, name, value) VALUES (?, 'Content-Length', ?)", h.id, h.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		where string
+		want  []int
+	}{
+		{"req_size eq 0", []int{1, 4}},
+		{"req_size gt 10", []int{2}},
+		{"req_size in (4, 27)", []int{2, 3}},
+		{"resp_size ge 11", []int{1, 3}},
+		{"resp_size lt 1", []int{2}},
+		{"header_count eq 3", []int{2}},
+		{"header_count ne 3", []int{1, 3, 4}},
+		{"resp_header_count eq 2", []int{1, 3, 4}},
+		{"resp.header.content-length.as_number gt 12", []int{3}},
+		{"resp.header.content-length.as_number le 14", []int{1, 3}},
+		{"resp.header.content-length.as_number in (11, 0)", []int{1}},
+		{"resp.header.content-length exists", []int{1, 3, 4}},
+		{"not resp.header.content-length.as_number ge 0", []int{2, 4}},
+		{"header.x-csrf.as_number eq 0", []int{}},
+		{"resp.status class '5xx'", []int{3}},
+		{"resp.status class '4XX' or resp.status class '3xx'", []int{2, 4}},
+		{"not resp.status class '2xx'", []int{2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			got, err := queryIDs(t, db, "query requests where "+tt.where)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	got, err := queryIDs(t, db, "query requests order by resp_size desc limit 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []int{1, 3}) {
+		t.Errorf("got ids %v, want [1 3]", got)
+	}
+}
+
+func TestSetOperationsAndSubqueries(t *testing.T) {
+	db := newFixtureDB(t)
+
+	// The same endpoints requested by another user
+	for _, r := range []struct {
+		id     int
+		url    string
+		status int
+	}{
+		{5, "https://example.com/api/users", 403},
+		{6, "https://other.org/api/items/4", 200},
+	} {
+		if _, err := db.Exec("INSERT INTO requests (request_id, method, url, body) VALUES (?, 'GET', ?, '')", r.id, r.url); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (?, ?, '')", r.id, r.status); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO headers (request_id, name, value) VALUES (?, 'Cookie', 'user=b')", r.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"query requests where id eq 1 union query requests where id eq 3", []int{1, 3}},
+		{"query requests where host eq 'example.com' intersect query requests where method eq POST", []int{2}},
+		{"query requests where host eq 'example.com' except query requests where resp.status eq 403", []int{1, 2}},
+		{"query requests except query requests where header.cookie exists", []int{1, 2, 3, 4}},
+		{"query requests where id le 2 union query requests where id eq 4 except query requests where id eq 1", []int{2, 4}},
+		{"query requests where path in (query requests where resp.status eq 403)", []int{1, 4, 5, 6}},
+		{"query requests where not header.cookie exists and path in (query requests where header.cookie exists and resp.status eq 403)", []int{1}},
+		{"query requests where status in (query requests where id in (1, 6))", []int{1, 6}},
+		{"query requests where host in (query requests where id eq 1 union query requests where id eq 3) and method ne GET", []int{2, 3, 4}},
+		{"query requests where not path in (query requests where header.cookie exists)", []int{2, 3}},
+		{"query requests where id in (3, 4)", []int{3, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := queryIDs(t, db, tt.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Counts and sorting apply to the result of the set operations
+	query, err := ParseQuery("query count where method eq GET except query requests where resp.status eq 403 group by host")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlQuery, args, err := query.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var host string
+		var count int
+		if err := rows.Scan(&host, &count); err != nil {
+			t.Fatal(err)
+		}
+		counts[host] = count
+	}
+
+	if len(counts) != 2 || counts["example.com"] != 1 || counts["other.org"] != 1 {
+		t.Errorf("got counts %v, want example.com: 1, other.org: 1", counts)
+	}
+
+	for _, input := range []string{
+		"query requests union query count",
+		"query requests where path in (query count)",
+		"query requests where path in (query requests",
+	} {
+		if _, err := ParseQuery(input); err == nil {
+			t.Errorf("expected an error for '%s'", input)
+		}
+	}
+}
+
+func TestQueryJSONEncoding(t *testing.T) {
+	db := newFixtureDB(t)
+
+	inputs := []string{
+		"query requests where id in (1, 3)",
+		"query requests where method eq POST and not path contains 'login' order by id desc limit 2 offset 1",
+		"query requests where timestamp gt 1h ago or timestamp lt '2024-01-02T10:00:00Z' or timestamp ge request 2",
+		"query requests where header.cookie exists and resp.header.'content-type' contains 'json'",
+		"query requests where header.'content-length'.as_number gt 10 or resp.status class '5xx'",
+		"query requests where port eq 443 and param.q eq 'x' and req_size ge 0 and endpoint ne '/'",
+		"query requests where form.user eq 'admin' or json.'$.user' exists or resp.json.error exists",
+		"query requests where raw contains 'csrf' or resp.raw contains 'Location' or body matches 'a.*'",
+		"query requests where path in (query requests where resp.status eq 403) except query requests where id eq 4",
+		"query count where method eq GET group by host, status",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			query, err := ParseQuery(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := json.Marshal(query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var decoded Query
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("unexpected error decoding %s: %v", data, err)
+			}
+
+			again, err := json.Marshal(&decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again) != string(data) {
+				t.Errorf("encoding is not stable:\n%s\n%s", data, again)
+			}
+
+			if query.Operation != QueryOperationGet {
+				return
+			}
+
+			want, err := queryIDs(t, db, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sqlQuery, args, err := decoded.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := db.Query(sqlQuery, args...)
+			if err != nil {
+				t.Fatalf("decoded query compiled to invalid SQL '%s': %v", sqlQuery, err)
+			}
+			defer rows.Close()
+
+			got := []int{}
+			for rows.Next() {
+				var (
+					timestamp, method, url string
+					id, status             int
+				)
+				if err := rows.Scan(&timestamp, &id, &method, &status, &url); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, id)
+			}
+
+			// Fixture requests share their timestamp, so the order is not defined
+			slices.Sort(got)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("got ids %v, want %v", got, want)
+			}
+		})
+	}
+
+	query, err := ParseQuery("query requests where method eq GET and not resp.status in (403, 500) limit 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"operation":"get","where":{"left":{"operator":"eq","type":"method","value":"GET"},"right":{"condition":{"operator":"in","type":"resp_status","values":[403,500]},"type":"not"},"type":"and"},"limit":5}`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+
+	// Durations are encoded in the format of the query language
+	query, err = ParseQuery("query requests where timestamp between 1d ago and 90m ago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = json.Marshal(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"value":{"ago":"1d"}`, `"end":{"ago":"1h30m"}`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("got %s, want it to contain %s", data, want)
+		}
+	}
+
+	for _, input := range []string{
+		`{"operation":"delete"}`,
+		`{"operation":"get","where":{"type":"timestamp","operator":"gt","value":{"ago":3600000000000}}}`,
+		`{"operation":"get","where":{"type":"timestamp","operator":"gt","value":{"ago":"1 hour"}}}`,
+		`{"operation":"get","where":{"type":"cookie","operator":"eq"}}`,
+		`{"operation":"get","where":{"type":"and","left":{"type":"method","operator":"eq","value":"GET"}}}`,
+	} {
+		var q Query
+		if err := json.Unmarshal([]byte(input), &q); err == nil {
+			t.Errorf("expected an error for '%s'", input)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/users/123/orders/9", "/users/{id}/orders/{id}"},
+		{"/users/456/orders/10/", "/users/{id}/orders/{id}/"},
+		{"/api/v1/items", "/api/v1/items"},
+		{"/files/3f2a9c1e-7b4d-4e8a-9c2b-1d5e6f7a8b9c", "/files/{id}"},
+		{"/blobs/5d41402abc4b2a76b9719d911017c592/raw", "/blobs/{id}/raw"},
+		{"/reset/eyJhbGciOiJIUzI1NiJ9abc123", "/reset/{id}"},
+		{"/authentication/deadbeefcafebabe", "/authentication/deadbeefcafebabe"},
+		{"/docs/getting_started_with_the_api", "/docs/getting_started_with_the_api"},
+		{"/2024/report", "/{id}/report"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := NormalizePath(tt.path); got != tt.want {
+				t.Errorf("got '%s', want '%s'", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	db := newFixtureDB(t)
+
+	for _, r := range []struct {
+		id     int
+		method string
+		url    string
+		status int
+	}{
+		{5, "DELETE", "https://other.org/api/items/5", 204},
+		{6, "DELETE", "https://other.org/api/items/6?force=1", 403},
+		{7, "GET", "https://other.org/api/items/6", 200},
+	} {
+		if _, err := db.Exec("INSERT INTO requests (request_id, method, url, body) VALUES (?, ?, ?, '')", r.id, r.method, r.url); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (?, ?, '')", r.id, r.status); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := queryIDs(t, db, "query requests where endpoint eq '/api/items/{id}' and method eq DELETE order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []int{4, 5, 6}) {
+		t.Errorf("got ids %v, want [4 5 6]", got)
+	}
+
+	query, err := ParseQuery("query requests where host eq 'other.org' group by endpoint order by count desc, method")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlQuery, args, err := query.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		t.Fatalf("invalid SQL '%s': %v", sqlQuery, err)
+	}
+	defer rows.Close()
+
+	endpoints := []string{}
+	for rows.Next() {
+		var host, method, endpoint, statuses string
+		var count int
+		if err := rows.Scan(&host, &method, &endpoint, &count, &statuses); err != nil {
+			t.Fatal(err)
+		}
+
+		codes := strings.Split(statuses, ",")
+		slices.Sort(codes)
+		endpoints = append(endpoints, fmt.Sprintf("%s %s %s %d %s", host, method, endpoint, count, strings.Join(codes, ",")))
+	}
+
+	want := []string{
+		"other.org DELETE /api/items/{id} 3 204,403",
+		"other.org GET /api/items/{id} 1 200",
+		"other.org PUT /Upload 1 500",
+	}
+	if !slices.Equal(endpoints, want) {
+		t.Errorf("got endpoints %q, want %q", endpoints, want)
+	}
+
+	for _, input := range []string{
+		"query requests group by host",
+		"query requests group by endpoint, status",
+		"query requests group by endpoint order by status",
+	} {
+		query, err := ParseQuery(input)
+		if err == nil {
+			_, _, err = query.Compile()
+		}
+		if err == nil {
+			t.Errorf("expected an error for '%s'", input)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input      string
+		pos        int
+		found      string
+		suggestion string
+	}{
+		{"query requests where methdo eq GET", 21, "methdo", "method"},
+		{"query requests where method cotains 'x'", 28, "cotains", "contains"},
+		{"query requests where path eq", 28, "", ""},
+		{"query requests where path eq 'abc", 29, "'abc", ""},
+		{"query requests where resp.stauts eq 200", 26, "stauts", "status"},
+		{"query reqests", 6, "reqests", "requests"},
+		{"query requests where id in (1, 2 3)", 33, "3", ""},
+		{"query count group by hots", 21, "hots", "host"},
+		{"query requests order by timestmp", 24, "timestmp", "timestamp"},
+		{"query requests where method eq FOO", 31, "FOO", ""},
+		{"query requests where path eq 'x' foo", 33, "foo", ""},
+		{"query requests where (path eq 'x'", 33, "", ""},
+		{"query requests where path eq 'x' $", 33, "$", ""},
+		{"query requests where resp.status class '7xx'", 39, "'7xx'", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := ParseQuery(tt.input)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			parseError, ok := AsParseError(err)
+			if !ok {
+				t.Fatalf("got error %v, want a ParseError", err)
+			}
+
+			if parseError.Pos != tt.pos || parseError.Found != tt.found || parseError.Suggestion != tt.suggestion {
+				t.Errorf("got position %d, found '%s' and suggestion '%s', want %d, '%s' and '%s'",
+					parseError.Pos, parseError.Found, parseError.Suggestion, tt.pos, tt.found, tt.suggestion)
+			}
+		})
+	}
+
+	input := "query requests\n\twhere methdo eq GET"
+	_, err := ParseQuery(input)
+	parseError, ok := AsParseError(err)
+	if !ok {
+		t.Fatalf("got error %v, want a ParseError", err)
+	}
+
+	want := parseError.Error() + "\n\twhere methdo eq GET\n\t      ^"
+	if got := parseError.Annotate(input); got != want {
+		t.Errorf("got annotation %q, want %q", got, want)
+	}
+}
+
+func TestCaseInsensitiveFields(t *testing.T) {
+	db := newFixtureDB(t)
+
+	if _, err := db.Exec("INSERT INTO requests (request_id, method, url, body, timestamp) VALUES (5, 'GET', 'https://example.com/search?Id=1', '', '2024-01-01 09:00:00')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (5, 200, '')"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input string
+		want  []int
+	}{
+		{"QUERY Requests WHERE METHOD eq 'GET'", []int{1, 5}},
+		{"query requests where Resp.Status ge 500", []int{3}},
+		{"query requests where RESPONSE.STATUS class '4XX'", []int{4}},
+		{"query requests where Header.Host eq 'other.org'", []int{3, 4}},
+		{"query requests where Timestamp ge Request 3", []int{3, 4}},
+		{"query requests where Host eq 'example.com' and Path eq '/search'", []int{5}},
+		{"query requests where Form.user eq 'admin'", []int{2}},
+		{"query requests where Req_Size ge 0 and ID le 2", []int{1, 2}},
+		{"query requests where PATH in (query requests where Id eq 3)", []int{3}},
+		// Parameter names are case-sensitive, only the field is not
+		{"query requests where PARAM.Id exists", []int{5}},
+		{"query requests where param.id exists", []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := queryIDs(t, db, tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := orderedIDs(t, db, "query requests order by ID desc limit 2"); !slices.Equal(got, []int{5, 4}) {
+		t.Errorf("got %v, want [5 4]", got)
+	}
+}
+
+func TestConditionPrecedence(t *testing.T) {
+	db := newFixtureDB(t)
+
+	tests := []struct {
+		where     string
+		formatted string
+		want      []int
+	}{
+		{
+			"method eq GET and id eq 3 or id eq 4",
+			"(method eq GET and id eq 3) or id eq 4",
+			[]int{4},
+		},
+		{
+			"id eq 4 or method eq GET and id eq 3",
+			"id eq 4 or (method eq GET and id eq 3)",
+			[]int{4},
+		},
+		{
+			"not method eq GET and not id eq 4 or id eq 1",
+			"(not method eq GET and not id eq 4) or id eq 1",
+			[]int{1, 2, 3},
+		},
+		{
+			"not (method eq GET or id eq 4)",
+			"not (method eq GET or id eq 4)",
+			[]int{2, 3},
+		},
+		{
+			"id eq 1 or id eq 2 or id eq 3 and method eq PUT",
+			"(id eq 1 or id eq 2) or (id eq 3 and method eq PUT)",
+			[]int{1, 2, 3},
+		},
+		{
+			"id le 3 and method ne GET and not method eq PUT",
+			"(id le 3 and method ne GET) and not method eq PUT",
+			[]int{2},
+		},
+		{
+			"timestamp between '2024-01-01T10:30:00Z' and '2024-01-01T12:30:00Z' and method eq POST",
+			"timestamp between '2024-01-01T10:30:00Z' and '2024-01-01T12:30:00Z' and method eq POST",
+			[]int{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			query, err := ParseQuery("query requests where " + tt.where)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := FormatCondition(query.RequestCondition); got != tt.formatted {
+				t.Errorf("got condition %s, want %s", got, tt.formatted)
+			}
+
+			got, err := queryIDs(t, db, "query requests where "+tt.where+" order by id")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryString(t *testing.T) {
+	inputs := []string{
+		"query requests where id in (1, 'abc', 3f2a9c1e-7b4d-4e8a-9c2b-1d5e6f7a8b9c) and method in (GET, POST)",
+		"query requests where timestamp gt 1d2h ago or timestamp lt request 5 or timestamp ge '2024-01-02T10:00:00Z'",
+		"query requests where header.cookie exists and header.'x-csrf token' eq \"it's\" and resp.header.content-type contains 'json'",
+		"query requests where header.content-length.as_number gt 10 or resp.status class '5xx' or resp.status in (200, 204)",
+		"query requests where port eq 443 and param.q eq 'x' and req_size ge 0 and endpoint ne '/'",
+		"query requests where form.user eq 'admin' or json.'$.user' exists or resp.json.error exists or multipart.'count' eq '1'",
+		"query requests where raw contains 'csrf' or resp.raw search 'Location' or body matches 'a.*' or resp.body icontains 'x'",
+		"query requests where path in (query requests where resp.status eq 403 union query requests where id eq 1) except query requests where id eq 4",
+		"query count where method contains 'P' group by host, status order by count desc limit 10 offset 5",
+		"query requests group by endpoint order by count desc",
+		"query requests where not (url contains 'a' or (host eq 'b' and scheme eq 'http')) and query_string contains 'x'",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			query, err := ParseQuery(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			formatted := query.String()
+			reparsed, err := ParseQuery(formatted)
+			if err != nil {
+				t.Fatalf("formatted query '%s' is invalid: %v", formatted, err)
+			}
+
+			if again := reparsed.String(); again != formatted {
+				t.Errorf("got '%s' after parsing '%s'", again, formatted)
+			}
+
+			want, _, err := query.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := reparsed.Compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uniqueIDRE.ReplaceAllString(got, "h") != uniqueIDRE.ReplaceAllString(want, "h") {
+				t.Errorf("formatted query '%s' compiles to\n%s\nwant\n%s", formatted, got, want)
+			}
+		})
+	}
+}
+
+// uniqueIDRE matches the aliases of the header subqueries, which depend on
+// the position of the condition in the input.
+var uniqueIDRE = regexp.MustCompile(`\bh[0-9]+\b`)
+
+// traceSteps runs the trace of a value and returns its rows as
+// "id origin location" strings, in the order they are returned.
+func traceSteps(t *testing.T, db *sql.DB, value string) []string {
+	t.Helper()
+
+	sqlQuery, args, err := CompileTrace(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		t.Fatalf("invalid SQL '%s': %v", sqlQuery, err)
+	}
+	defer rows.Close()
+
+	steps := []string{}
+	for rows.Next() {
+		var (
+			timestamp, method, url, location string
+			id, status                       int
+			origin                           bool
+		)
+		if err := rows.Scan(&timestamp, &id, &method, &status, &url, &origin, &location); err != nil {
+			t.Fatal(err)
+		}
+		steps = append(steps, fmt.Sprintf("%d %t %s", id, origin, location))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return steps
+}
+
+func TestTrace(t *testing.T) {
+	_, db := qltest.NewDB(t, append(slices.Clone(qltest.Requests), []qltest.Request{
+		{ID: 5, Method: "GET", URL: "https://example.com/api/early?sid=s3cr3t/tok", Timestamp: "2024-01-01 13:30:00", Status: 401},
+		{
+			ID: 6, Method: "POST", URL: "https://example.com/api/session", Timestamp: "2024-01-01 14:00:00", Status: 200,
+			RespBody:    `{"sid":"s3cr3t/tok"}`,
+			RespHeaders: [][2]string{{"Content-Type", "application/json"}, {"Set-Cookie", "sid=s3cr3t/tok; Path=/"}},
+		},
+		{
+			ID: 7, Method: "GET", URL: "https://example.com/api/items?sid=s3cr3t%2Ftok", Timestamp: "2024-01-01 14:05:00", Status: 200,
+			Headers: [][2]string{{"Cookie", "sid=s3cr3t/tok"}},
+		},
+		{ID: 8, Method: "POST", URL: "https://example.com/api/items", Body: "sid=s3cr3t/tok&name=x", Timestamp: "2024-01-01 14:10:00", Status: 201, RespBody: "s3cr3t/tok"},
+		{ID: 9, Method: "GET", URL: "https://example.com/api/other", Timestamp: "2024-01-01 14:20:00", Status: 200},
+	}...))
+
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		// Requests sent before the first response with the value are not
+		// part of its trace
+		{"s3cr3t/tok", []string{"6 true header Set-Cookie, body", "7 false url, header Cookie", "8 false body"}},
+		// Values that are not in any response are traced to every request
+		// that sends them
+		{"abc", []string{"2 false header X-Csrf"}},
+		{"/home", []string{"2 true header Location"}},
+		{"missing", []string{}},
+	}
+
+	for _, tt := range tests {
+		got := traceSteps(t, db, tt.value)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("trace '%s': got %q, want %q", tt.value, got, tt.want)
+		}
+	}
+
+	if _, _, err := CompileTrace(""); err == nil {
+		t.Error("expected an error for an empty value")
+	}
+}
+
+func TestQueryAfter(t *testing.T) {
+	db := newFixtureDB(t)
+
+	tests := []struct {
+		input string
+		after string
+		want  []int
+	}{
+		{"query requests", "2", []int{3, 4}},
+		{"query requests where method ne GET order by method desc limit 1", "1", []int{2, 3, 4}},
+		{"query requests where host eq 'other.org' union query requests where method eq GET", "0", []int{1, 3, 4}},
+		{"query requests where host eq 'other.org' except query requests where method eq PUT", "3", []int{4}},
+		{"query requests where method eq GET", "1", []int{}},
+	}
+
+	for _, tt := range tests {
+		query, err := ParseQuery(tt.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sqlQuery, args, err := query.After(tt.after).Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := db.Query(sqlQuery, args...)
+		if err != nil {
+			t.Fatalf("invalid SQL '%s': %v", sqlQuery, err)
+		}
+
+		// The rows are not sorted, their order is part of the result
+		got := []int{}
+		for rows.Next() {
+			var (
+				timestamp, method, url string
+				id, status             int
+			)
+			if err := rows.Scan(&timestamp, &id, &method, &status, &url); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, id)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("'%s' after %s: got ids %v, want %v", tt.input, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestCompileColumns(t *testing.T) {
+	db := newFixtureDB(t)
+
+	if _, err := db.Exec("INSERT INTO requests (request_id, method, url, body) VALUES (5, 'GET', 'https://example.com/page', '')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (5, 200, '<html><body>hi</body></html>')"); err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := ParseQuery("query requests order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := []string{"host", "resp_size", "content_type", "mime", "header:x-csrf", "resp_header:Location"}
+	sqlQuery, args, err := query.CompileColumns(columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		t.Fatalf("invalid SQL '%s': %v", sqlQuery, err)
+	}
+	defer rows.Close()
+
+	got := []string{}
+	for rows.Next() {
+		var (
+			timestamp, method, url string
+			id, status             int
+		)
+		values := make([]sql.NullString, len(columns))
+		dest := []any{&timestamp, &id, &method, &status, &url}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			t.Fatal(err)
+		}
+
+		row := []string{fmt.Sprint(id)}
+		for _, v := range values {
+			if !v.Valid {
+				row = append(row, "-")
+				continue
+			}
+			row = append(row, v.String)
+		}
+		got = append(got, strings.Join(row, " "))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"1 example.com 11 application/json application/json - -",
+		"2 example.com 0 - - abc /home",
+		"3 other.org 14 text/html text/html - -",
+		"4 other.org 9 text/plain text/plain - -",
+		"5 example.com 28 - text/html - -",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got rows %q, want %q", got, want)
+	}
+
+	for _, c := range []string{"nope", "header:", "resp_header:"} {
+		if CheckColumn(c) == nil {
+			t.Errorf("expected '%s' not to be a column", c)
+		}
+	}
+
+	count, err := ParseQuery("query count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := count.CompileColumns([]string{"host"}); err == nil {
+		t.Error("expected an error adding columns to a count query")
+	}
+}
+
+func TestIsConditionStart(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"method eq POST", true},
+		{"METHOD eq POST", true},
+		{"Resp.Status ge 500", true},
+		{"resp.status ge 40O", true},
+		{"not path contains 'x'", true},
+		{"(host eq 'a.com' or host eq 'b.com')", true},
+		{"methdo eq GET", true},
+		{"body", true},
+		{"alice", false},
+		{"alice bob", false},
+		{"/api/users", false},
+		{"'unterminated", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsConditionStart(tt.input); got != tt.expected {
+			t.Errorf("IsConditionStart(%q): got %v, want %v", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestCompilePage(t *testing.T) {
+	db := newFixtureDB(t)
+
+	for _, r := range []struct {
+		id     int
+		method string
+		url    string
+		status int
+	}{
+		{5, "GET", "https://other.org/a", 200},
+		{6, "GET", "%zz", 403},
+		{7, "POST", "https://example.com/b", 200},
+		{8, "GET", "%zz", 200},
+		{9, "DELETE", "https://b.org/c", 500},
+	} {
+		if _, err := db.Exec("INSERT INTO requests (request_id, method, url, body, timestamp) VALUES (?, ?, ?, '', '2024-01-01 12:00:00')", r.id, r.method, r.url); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (?, ?, '')", r.id, r.status); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// scanPage returns the ids of the rows of a page and the page key of the
+	// last one
+	scanPage := func(t *testing.T, query *Query, after PageKey, limit, offset int) ([]int, PageKey) {
+		t.Helper()
+
+		sqlQuery, args, err := query.CompilePage(nil, after, limit, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keySize, err := query.PageKeySize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := db.Query(sqlQuery, args...)
+		if err != nil {
+			t.Fatalf("invalid SQL '%s': %v", sqlQuery, err)
+		}
+		defer rows.Close()
+
+		ids := []int{}
+		var key PageKey
+		for rows.Next() {
+			var (
+				timestamp, method, url string
+				id, status             int
+			)
+			key = make(PageKey, keySize)
+			dest := []any{&timestamp, &id, &method, &status, &url}
+			for i := range key {
+				dest = append(dest, &key[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		return ids, key
+	}
+
+	tests := []struct {
+		input string
+		// ordered is the same query with the order of its pages
+		ordered string
+	}{
+		{"query requests", "query requests order by timestamp desc, id desc"},
+		{"query requests order by host", "query requests order by host, id"},
+		{"query requests order by status desc, method", "query requests order by status desc, method, id"},
+		{"query requests where method ne DELETE order by id desc", "query requests where method ne DELETE order by id desc"},
+	}
+
+	for _, tt := range tests {
+		query, err := ParseQuery(tt.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := orderedIDs(t, db, tt.ordered)
+
+		got := []int{}
+		var key PageKey
+		for range len(want) + 1 {
+			ids, last := scanPage(t, query, key, 2, 0)
+			if len(ids) == 0 {
+				break
+			}
+			got = append(got, ids...)
+			key = last
+		}
+
+		if !slices.Equal(got, want) {
+			t.Errorf("pages of '%s': got ids %v, want %v", tt.input, got, want)
+		}
+
+		if ids, _ := scanPage(t, query, nil, 3, 2); !slices.Equal(ids, want[2:5]) {
+			t.Errorf("page of '%s' with offset 2: got ids %v, want %v", tt.input, ids, want[2:5])
+		}
+	}
+
+	// Only the columns that can be NULL are replaced, in the order and in
+	// the page key condition
+	query, err := ParseQuery("query requests order by host, id desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlQuery, _, err := query.CompilePage(nil, PageKey{"b.org", 9}, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sqlQuery, "IFNULL(req.request_id") {
+		t.Errorf("expected the request id not to be replaced, got '%s'", sqlQuery)
+	}
+	for _, want := range []string{"IFNULL(url_host(req.url), -1) = ?", "req.request_id < ?", "ORDER BY IFNULL(url_host(req.url), -1) ASC, req.request_id DESC"} {
+		if !strings.Contains(sqlQuery, want) {
+			t.Errorf("expected '%s' in '%s'", want, sqlQuery)
+		}
+	}
+}
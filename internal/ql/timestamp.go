@@ -0,0 +1,130 @@
+package ql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var durationPartRE *regexp.Regexp = regexp.MustCompile("([0-9]+)([dhms])")
+
+// timestampLayouts are the ISO-8601 forms accepted for absolute timestamps.
+// Timestamps without a zone are interpreted in the local time zone.
+var timestampLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// dbTimestampLayout is the format SQLite uses for CURRENT_TIMESTAMP, which
+// is how the proxy stores request timestamps (always in UTC).
+const dbTimestampLayout = "2006-01-02 15:04:05"
+
+// TimestampValue is a point in time a timestamp condition is compared
+// against. Exactly one of its fields is used: RequestId if set, then Time if
+// not zero, and otherwise Ago.
+type TimestampValue struct {
+	Ago       time.Duration
+	Time      time.Time
+	RequestId string
+}
+
+func (v TimestampValue) sqlExpression() (string, []any) {
+	if v.RequestId != "" {
+		return "(SELECT anchor.timestamp FROM requests anchor WHERE anchor.request_id = ?)", []any{v.RequestId}
+	}
+
+	if !v.Time.IsZero() {
+		return "datetime(?)", []any{v.Time.UTC().Format(dbTimestampLayout)}
+	}
+
+	seconds := strconv.Itoa(int(v.Ago.Seconds()))
+	return "datetime('now', ?)", []any{"-" + seconds + " seconds"}
+}
+
+// ParseDuration parses durations made of one or more number and unit pairs,
+// like "30s", "1h30m" or "2d12h". Valid units are d, h, m and s.
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" || !durationRE.MatchString(s) {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+
+	var d time.Duration
+	for _, part := range durationPartRE.FindAllStringSubmatch(s, -1) {
+		n, err := strconv.Atoi(part[1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s'", s)
+		}
+
+		unit := time.Second
+		switch part[2] {
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		case "d":
+			unit = time.Hour * 24
+		}
+		d += time.Duration(n) * unit
+	}
+
+	return d, nil
+}
+
+// FormatDuration formats a duration with the units accepted by
+// ParseDuration, like "1d2h30m".
+func FormatDuration(d time.Duration) string {
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+
+	s := ""
+	for _, u := range units {
+		if n := d / u.size; n > 0 {
+			s += strconv.Itoa(int(n)) + u.name
+			d -= n * u.size
+		}
+	}
+
+	if s == "" {
+		return "0s"
+	}
+
+	return s
+}
+
+// ParseTimestamp parses an absolute ISO-8601 timestamp.
+func ParseTimestamp(s string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid timestamp '%s'", s)
+}
+
+// ParseTimestampValue parses either a duration, meaning that long ago, or an
+// absolute ISO-8601 timestamp.
+func ParseTimestampValue(s string) (TimestampValue, error) {
+	if d, err := ParseDuration(s); err == nil {
+		return TimestampValue{Ago: d}, nil
+	}
+
+	t, err := ParseTimestamp(s)
+	if err != nil {
+		return TimestampValue{}, fmt.Errorf("invalid timestamp value '%s': expected a duration like '1h30m' or an ISO-8601 timestamp", s)
+	}
+
+	return TimestampValue{Time: t}, nil
+}
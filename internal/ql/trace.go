@@ -0,0 +1,55 @@
+package ql
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// CompileTrace compiles the query that follows a value, like a CSRF token or
+// a session ID, across the requests: the request whose response is the first
+// one containing the value, in its headers or body, and every later request
+// that sends the value back, in its URL, headers or body. Values are also
+// matched URL encoded.
+//
+// The rows, ordered by timestamp, have the timestamp, id, method, status
+// code and URL of the request, whether it is the request whose response
+// contains the value, and the places where the value was found, like
+// "header Set-Cookie" or "url, body". When no response contains the value,
+// every request that sends it is returned.
+func CompileTrace(value string) (string, []any, error) {
+	if value == "" {
+		return "", nil, fmt.Errorf("the value to trace cannot be empty")
+	}
+
+	// ?1 is the value and ?2 the value URL encoded, which are used by all the
+	// conditions of the query
+	matches := func(column string) string {
+		return "(instr(" + column + ", ?1) > 0 OR instr(" + column + ", ?2) > 0)"
+	}
+
+	headerNames := func(correlation string) string {
+		return "(SELECT group_concat('header ' || h.name, ', ') FROM headers h WHERE h." + correlation + " AND " + matches("h.value") + ")"
+	}
+
+	responseLocation := "concat_ws(', ', " + headerNames("response_id = resp.response_id") + ", IIF(" + matches("resp.body") + ", 'body', NULL))"
+	requestLocation := "concat_ws(', ', IIF(" + matches("req.url") + ", 'url', NULL), " + headerNames("request_id = req.request_id") + ", IIF(" + matches("req.body") + ", 'body', NULL))"
+
+	var query strings.Builder
+	query.WriteString("WITH origin AS (")
+	query.WriteString("SELECT req.request_id, req.timestamp, " + responseLocation + " AS location")
+	query.WriteString(fromRequests)
+	query.WriteString(" WHERE " + matches("resp.body") + " OR EXISTS (SELECT 1 FROM headers h WHERE h.response_id = resp.response_id AND " + matches("h.value") + ")")
+	query.WriteString(" ORDER BY req.timestamp, req.request_id LIMIT 1)")
+
+	query.WriteString(" SELECT req.timestamp, req.request_id, req.method, resp.status_code, req.url, origin.request_id IS NOT NULL,")
+	query.WriteString(" IFNULL(origin.location, " + requestLocation + ")")
+	query.WriteString(fromRequests)
+	query.WriteString(" LEFT JOIN origin ON origin.request_id = req.request_id")
+	query.WriteString(" WHERE origin.request_id IS NOT NULL OR (")
+	query.WriteString("(" + matches("req.url") + " OR " + matches("req.body") + " OR EXISTS (SELECT 1 FROM headers h WHERE h.request_id = req.request_id AND " + matches("h.value") + "))")
+	query.WriteString(" AND (NOT EXISTS (SELECT 1 FROM origin) OR (req.timestamp, req.request_id) > (SELECT timestamp, request_id FROM origin)))")
+	query.WriteString(" ORDER BY req.timestamp, req.request_id")
+
+	return query.String(), []any{value, url.QueryEscape(value)}, nil
+}
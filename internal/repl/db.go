@@ -2,11 +2,13 @@ package repl
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"text/template"
@@ -20,38 +22,158 @@ import (
 	_ "modernc.org/sqlite"
 )
 
-func doRequestQuery(ctx context.Context, dbFile string, query *ql.Query) ([]RequestsTableRow, error) {
+// openDB opens the proxy DB at dbFile, which has to exist, since querying a
+// missing SQLite DB creates it.
+func openDB(dbFile string) (*sql.DB, error) {
+	if _, err := os.Stat(dbFile); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open SQLite database: %v", err)
+	}
+
+	return db, nil
+}
+
+// doRequestQuery runs a query that gets requests. The rows have the values
+// of the columns that are not default columns in their Columns.
+func doRequestQuery(ctx context.Context, db *sql.DB, query *ql.Query, columns []string) ([]RequestsTableRow, error) {
+	extra := extraColumns(columns)
+
 	compiled, values, err := query.Compile()
+	if len(extra) > 0 {
+		compiled, values, err = query.CompileColumns(extra)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := os.Stat(dbFile); err != nil {
+	// TODO: verify why ctx is being ignored
+	rows, err := db.QueryContext(ctx, compiled, values...)
+	if err != nil {
+		return nil, queryError(err)
+	}
+	defer rows.Close()
+
+	result := []RequestsTableRow{}
+
+	for rows.Next() {
+		row, err := scanRequestRow(rows, extra, nil)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	db, err := sql.Open("sqlite", dbFile)
+	return result, nil
+}
+
+// queryError explains errors caused by searching before the full-text index
+// is built.
+func queryError(err error) error {
+	if ql.IsMissingFullTextIndex(err) {
+		return fmt.Errorf("the full-text index has not been built yet, run 'efin index' to build it")
+	}
+
+	return err
+}
+
+type countResultRow struct {
+	groups []string
+	count  int
+}
+
+func doCountQuery(ctx context.Context, db *sql.DB, query *ql.Query) ([]countResultRow, error) {
+	compiled, values, err := query.Compile()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open SQLite database: %v", err)
+		return nil, err
 	}
-	defer db.Close()
 
-	// TODO: verify why ctx is being ignored
 	rows, err := db.QueryContext(ctx, compiled, values...)
 	if err != nil {
+		return nil, queryError(err)
+	}
+	defer rows.Close()
+
+	result := []countResultRow{}
+
+	for rows.Next() {
+		groups := make([]any, len(query.GroupBy))
+		dest := make([]any, len(groups)+1)
+		for i := range groups {
+			dest[i] = &groups[i]
+		}
+
+		row := countResultRow{}
+		dest[len(groups)] = &row.count
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		for _, g := range groups {
+			switch v := g.(type) {
+			case nil:
+				row.groups = append(row.groups, "-")
+			case []byte:
+				row.groups = append(row.groups, string(v))
+			default:
+				row.groups = append(row.groups, fmt.Sprint(v))
+			}
+		}
+		result = append(result, row)
+	}
+
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+
+	return result, nil
+}
+
+type endpointResultRow struct {
+	host     string
+	method   string
+	endpoint string
+	count    int
+	statuses []string
+}
+
+func doEndpointsQuery(ctx context.Context, db *sql.DB, query *ql.Query) ([]endpointResultRow, error) {
+	compiled, values, err := query.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, compiled, values...)
+	if err != nil {
+		return nil, queryError(err)
+	}
 	defer rows.Close()
 
-	result := []RequestsTableRow{}
+	result := []endpointResultRow{}
 
 	for rows.Next() {
-		var timestamp, requestId, method, url string
-		var status int
-		if err := rows.Scan(&timestamp, &requestId, &method, &status, &url); err != nil {
+		var host, endpoint, statuses sql.NullString
+		row := endpointResultRow{}
+		if err := rows.Scan(&host, &row.method, &endpoint, &row.count, &statuses); err != nil {
 			return nil, err
 		}
-		result = append(result, RequestsTableRow{timestamp, requestId, method, strconv.Itoa(status), url})
+
+		row.host = host.String
+		row.endpoint = endpoint.String
+		if statuses.Valid {
+			row.statuses = strings.Split(statuses.String, ",")
+			slices.SortFunc(row.statuses, func(a, b string) int {
+				return cmp.Or(cmp.Compare(len(a), len(b)), cmp.Compare(a, b))
+			})
+		}
+		result = append(result, row)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -61,34 +183,140 @@ func doRequestQuery(ctx context.Context, dbFile string, query *ql.Query) ([]Requ
 	return result, nil
 }
 
+// endpointsResultsString renders the endpoints of the requests, with the
+// number of requests to each one and the status codes they got.
+func endpointsResultsString(rows []endpointResultRow) string {
+	headers := []string{"host", "method", "endpoint", "count", "status codes"}
+	table := make([][]string, len(rows))
+	for i, r := range rows {
+		table[i] = []string{r.host, r.method, r.endpoint, strconv.Itoa(r.count), strings.Join(r.statuses, ", ")}
+	}
+
+	widths := make([]int, len(headers))
+	for i, h := range headers {
+		widths[i] = len(h)
+	}
+	total := 0
+	for i, r := range table {
+		for j, c := range r {
+			widths[j] = max(widths[j], len(c))
+		}
+		total += rows[i].count
+	}
+
+	var buf strings.Builder
+	writeRow := func(r []string) {
+		for i, c := range r {
+			switch {
+			case i == len(r)-1:
+				buf.WriteString(c + "\n")
+			case headers[i] == "count":
+				buf.WriteString(fmt.Sprintf("%*s  ", widths[i], c))
+			default:
+				buf.WriteString(fmt.Sprintf("%-*s  ", widths[i], c))
+			}
+		}
+	}
+
+	writeRow(headers)
+	for _, r := range table {
+		writeRow(r)
+	}
+
+	buf.WriteString(fmt.Sprintf("%d requests to %d endpoints", total, len(rows)))
+
+	return buf.String()
+}
+
+// countResultsString renders the rows of a count query as a table with a
+// histogram bar next to each count.
+func countResultsString(groupBy []string, rows []countResultRow) string {
+	const maxBarWidth = 40
+
+	widths := make([]int, len(groupBy)+1)
+	for i, g := range groupBy {
+		widths[i] = len(g)
+	}
+	widths[len(groupBy)] = len("count")
+
+	maxCount := 0
+	for _, r := range rows {
+		for i, g := range r.groups {
+			widths[i] = max(widths[i], len(g))
+		}
+		widths[len(groupBy)] = max(widths[len(groupBy)], len(strconv.Itoa(r.count)))
+		maxCount = max(maxCount, r.count)
+	}
+
+	var buf strings.Builder
+	for i, g := range groupBy {
+		buf.WriteString(fmt.Sprintf("%-*s  ", widths[i], g))
+	}
+	buf.WriteString(fmt.Sprintf("%*s\n", widths[len(groupBy)], "count"))
+
+	total := 0
+	for _, r := range rows {
+		for i, g := range r.groups {
+			buf.WriteString(fmt.Sprintf("%-*s  ", widths[i], g))
+		}
+
+		barWidth := max(1, r.count*maxBarWidth/max(maxCount, 1))
+		buf.WriteString(fmt.Sprintf("%*d  %s\n", widths[len(groupBy)], r.count, strings.Repeat("█", barWidth)))
+		total += r.count
+	}
+
+	buf.WriteString(fmt.Sprintf("%d requests in %d groups", total, len(rows)))
+
+	return buf.String()
+}
+
 type QueryResultsView struct {
 	requestsTableView *RequestsTableView
-	dbFile            string
+	db                *sql.DB
 	queryRunning      bool
+
+	// query is followed with the f key, adding the requests it matches as
+	// the proxy stores them. It is nil for results that do not come from a
+	// query, which cannot be followed. mark is the id after which the
+	// followed query looks for requests, and followedFrom is the first mark,
+	// after which the rows can come from following the query.
+	query        *ql.Query
+	following    bool
+	followID     int
+	mark         string
+	followedFrom string
+
+	// pager loads the rows of the query as the cursor gets near the last
+	// loaded row. It is nil if all the rows are loaded.
+	pager       *requestPager
+	loadingPage bool
+	cursor      int
 }
 
-func NewQueryResultsView(dbFile string, L *lua.LState, rows []RequestsTableRow, width, height int) *QueryResultsView {
+func NewQueryResultsView(db *sql.DB, L *lua.LState, rows []RequestsTableRow, width, height int) *QueryResultsView {
 	requestsTable := NewRequestsTableView(width, height)
-	requestsTable.SetRows([]RequestsTableRow(rows))
-	requestsTable.SetUpdateFns(func(r RequestsTableRow) string {
-		req, err := getRequest(dbFile, r[1])
+	requestsTable.SetRows(rows)
+	requestsTable.SetUpdateFns(func(r RequestsTableRow, pretty bool) string {
+		req, _, err := getCachedRequestResponse(db, r.ID)
 		if err != nil {
 			return fmt.Sprintf("Error getting request: %v", err)
 		}
 
-		return rawRequestString(req)
-	}, func(r RequestsTableRow) string {
-		resp, err := getResponse(dbFile, r[1])
+		return requestString(req, pretty)
+	}, func(r RequestsTableRow, pretty bool) string {
+		_, resp, err := getCachedRequestResponse(db, r.ID)
 		if err != nil {
 			return fmt.Sprintf("Error getting response: %v", err)
 		}
 
-		return rawResponseString(resp)
+		return responseString(resp, pretty)
 	})
 
+	requestsTable.SetFilterFn(queryFilterFn(db, L))
+
 	requestsTable.SetRowKeyBinding("enter", func(row RequestsTableRow) tea.Cmd {
 		return func() tea.Msg {
-			req, resp, err := getRequestResponse(dbFile, row[1])
+			req, resp, err := getCachedRequestResponse(db, row.ID)
 			if err != nil {
 				return replit.ExitView{
 					Error: err,
@@ -109,10 +337,10 @@ func NewQueryResultsView(dbFile string, L *lua.LState, rows []RequestsTableRow,
 	})
 
 	requestsTable.SetRowKeyBinding("t", func(row RequestsTableRow) tea.Cmd {
-		reqId := row[1]
+		reqId := row.ID
 
 		return func() tea.Msg {
-			req, err := getRequest(dbFile, reqId)
+			req, err := getRequest(db, reqId)
 			if err != nil {
 				return replit.ExitView{
 					Error: err,
@@ -160,10 +388,10 @@ func NewQueryResultsView(dbFile string, L *lua.LState, rows []RequestsTableRow,
 	})
 
 	requestsTable.SetRowKeyBinding("c", func(row RequestsTableRow) tea.Cmd {
-		reqId := row[1]
+		reqId := row.ID
 
 		return func() tea.Msg {
-			req, err := getRequest(dbFile, reqId)
+			req, err := getRequest(db, reqId)
 			if err != nil {
 				return replit.ExitView{
 					Error: err,
@@ -205,11 +433,14 @@ func NewQueryResultsView(dbFile string, L *lua.LState, rows []RequestsTableRow,
 		}
 	})
 
-	return &QueryResultsView{
+	v := &QueryResultsView{
 		requestsTableView: requestsTable,
-		dbFile:            dbFile,
+		db:                db,
 		queryRunning:      false,
 	}
+	requestsTable.SetSortFn(v.sortResults)
+
+	return v
 }
 
 func (v *QueryResultsView) View() string {
@@ -217,44 +448,196 @@ func (v *QueryResultsView) View() string {
 	if v.queryRunning {
 		output += "\ngetting request data..."
 	}
+	if v.following {
+		output += "\nfollowing new requests, press f to stop"
+	}
 	return output
 }
 
 func (v *QueryResultsView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case followTickMsg:
+		if !v.following || msg.id != v.followID {
+			return v, nil
+		}
+		return v, v.fetchNewRows()
+
+	case followRowsMsg:
+		if !v.following || msg.id != v.followID {
+			return v, nil
+		}
+
+		if msg.err != nil {
+			v.stopFollowing()
+			return v, func() tea.Msg {
+				return requestTableViewMessage{message: fmt.Sprintf("stopped following the query: %v", msg.err)}
+			}
+		}
+
+		// New requests come oldest first. The ones already in the table are
+		// skipped by InsertRows
+		atTop := newestFirst(v.query)
+		if atTop {
+			slices.Reverse(msg.rows)
+		}
+		cmd := v.requestsTableView.InsertRows(msg.rows, atTop)
+		v.mark = msg.mark
+
+		return v, tea.Batch(cmd, v.followTick())
+
+	case pageMsg:
+		// Pages of a pager that was replaced, when the results were sorted,
+		// are discarded
+		if msg.pager != v.pager {
+			return v, nil
+		}
+
+		v.loadingPage = false
+		if msg.err != nil {
+			v.pager = nil
+			return v, func() tea.Msg {
+				return requestTableViewMessage{message: fmt.Sprintf("could not load more requests: %v", msg.err)}
+			}
+		}
+
+		var cmd tea.Cmd
+		if msg.first {
+			cmd = v.requestsTableView.ReplaceRows(v.withFollowedRows(msg.rows))
+		} else {
+			cmd = v.requestsTableView.InsertRows(msg.rows, false)
+		}
+		if v.pager.done {
+			v.pager = nil
+		}
+		return v, tea.Batch(cmd, v.loadPage())
+
+	case countMsg:
+		if msg.err == nil {
+			v.requestsTableView.SetTotal(msg.count)
+		}
+		return v, nil
+	}
+
+	// Keys are for the filter while it is written
+	filtering := v.requestsTableView.filtering
+
 	m, cmd := v.requestsTableView.Update(msg)
 	v.requestsTableView = m.(*RequestsTableView)
+	if filtering {
+		return v, cmd
+	}
 
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "esc", "q":
+			v.stopFollowing()
 			output := v.requestsTableView.TableRawView()
 			return v, func() tea.Msg {
 				return replit.ExitView{
 					Output: output,
 				}
 			}
+
+		case "f":
+			if v.query == nil || v.requestsTableView.focus != focusTable {
+				return v, cmd
+			}
+
+			if v.following {
+				v.stopFollowing()
+				return v, cmd
+			}
+			return v, tea.Batch(cmd, v.follow())
 		}
 	}
 
-	return v, cmd
+	return v, tea.Batch(cmd, v.loadPage(), v.prefetch())
 }
 
 func (v *QueryResultsView) Init() tea.Cmd {
-	return nil
+	cmds := []tea.Cmd{v.prefetch()}
+	if v.pager != nil {
+		pager := v.pager
+		cmds = append(cmds, func() tea.Msg {
+			count, err := pager.count(context.Background())
+			return countMsg{count: count, err: err}
+		})
+	}
+
+	if v.following {
+		cmds = append(cmds, v.follow())
+	}
+
+	return tea.Batch(cmds...)
 }
 
-func getRequest(dbFile, id string) (*requestEntry, error) {
-	if _, err := os.Stat(dbFile); err != nil {
-		return nil, err
+// loadPage loads the next page of rows if the cursor is near the last
+// loaded row.
+func (v *QueryResultsView) loadPage() tea.Cmd {
+	rows := len(v.requestsTableView.rows)
+	if v.pager == nil || v.loadingPage || v.requestsTableView.currentRow < rows-pageThreshold {
+		return nil
 	}
 
-	db, err := sql.Open("sqlite", dbFile)
+	v.loadingPage = true
+	pager := v.pager
+	return func() tea.Msg {
+		rows, err := pager.next(context.Background())
+		return pageMsg{pager: pager, rows: rows, err: err}
+	}
+}
+
+// sortResults sorts the results by a column in their query when not all of
+// them are loaded, returning the command that loads them again sorted. It
+// reports whether the sort covers all the results, which is not the case
+// when only the loaded rows can be sorted, because the column cannot be
+// sorted in the query or the query has a limit or an offset.
+func (v *QueryResultsView) sortResults(column string, descending bool) (tea.Cmd, bool) {
+	if v.pager == nil {
+		return nil, true
+	}
+
+	if v.query == nil || v.query.Limit > 0 || v.query.Offset > 0 || column == "count" || !ql.IsOrderByField(column) {
+		return nil, false
+	}
+
+	sorted := *v.query
+	sorted.OrderBy = []ql.OrderBy{{Field: column, Descending: descending}}
+	pager, err := newRequestPager(v.db, &sorted, v.requestsTableView.columns)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open SQLite database: %v", err)
+		return func() tea.Msg {
+			return requestTableViewMessage{message: fmt.Sprintf("could not sort the requests: %v", err)}
+		}, false
+	}
+
+	v.pager = pager
+	v.loadingPage = true
+	return func() tea.Msg {
+		rows, err := pager.next(context.Background())
+		return pageMsg{pager: pager, first: true, rows: rows, err: err}
+	}, true
+}
+
+// prefetch loads the requests and responses of the rows after the cursor,
+// when it moves.
+func (v *QueryResultsView) prefetch() tea.Cmd {
+	cursor := v.requestsTableView.currentRow
+	if cursor == v.cursor && cursor != 0 {
+		return nil
 	}
-	defer db.Close()
+	v.cursor = cursor
 
+	rows := v.requestsTableView.rows
+	ids := []string{}
+	for i := cursor + 1; i < min(len(rows), cursor+1+prefetchRows); i++ {
+		ids = append(ids, rows[i].ID)
+	}
+
+	return prefetchDetails(v.db, ids)
+}
+
+func getRequest(db *sql.DB, id string) (*requestEntry, error) {
 	reqQuery := `
 		SELECT req.timestamp, req.request_id, req.method, req.url, req.body
 		FROM requests req
@@ -300,17 +683,7 @@ func getRequest(dbFile, id string) (*requestEntry, error) {
 	return &req, nil
 }
 
-func getResponse(dbFile, id string) (*responseEntry, error) {
-	if _, err := os.Stat(dbFile); err != nil {
-		return nil, err
-	}
-
-	db, err := sql.Open("sqlite", dbFile)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to open SQLite database: %v", err)
-	}
-	defer db.Close()
-
+func getResponse(db *sql.DB, id string) (*responseEntry, error) {
 	respQuery := `
 		SELECT resp.response_id, resp.status_code, resp.body
 		FROM responses resp
@@ -352,12 +725,12 @@ func getResponse(dbFile, id string) (*responseEntry, error) {
 	return &resp, nil
 }
 
-func getRequestResponse(dbFile, id string) (*requestEntry, *responseEntry, error) {
-	req, err := getRequest(dbFile, id)
+func getRequestResponse(db *sql.DB, id string) (*requestEntry, *responseEntry, error) {
+	req, err := getRequest(db, id)
 	if err != nil {
 		return nil, nil, err
 	}
-	resp, err := getResponse(dbFile, id)
+	resp, err := getResponse(db, id)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -377,7 +750,9 @@ type responseEntry struct {
 	liblua.HTTPResponse
 }
 
-func rawRequestString(req *requestEntry) string {
+// requestString returns a request as it is sent, with its body pretty
+// printed if pretty is true.
+func requestString(req *requestEntry, pretty bool) string {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf("%s %s HTTP/1.1\n", req.Method, req.URL))
 
@@ -386,12 +761,18 @@ func rawRequestString(req *requestEntry) string {
 	}
 
 	buf.WriteString("\n")
-	buf.Write([]byte(req.Body))
+	if pretty {
+		buf.WriteString(prettyBody(req.Headers, req.Body))
+	} else {
+		buf.WriteString(req.Body)
+	}
 
 	return string(buf.Bytes())
 }
 
-func rawResponseString(resp *responseEntry) string {
+// responseString returns a response as it is received, with its body pretty
+// printed if pretty is true.
+func responseString(resp *responseEntry, pretty bool) string {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\n", resp.StatusCode, http.StatusText(resp.StatusCode)))
 
@@ -400,7 +781,11 @@ func rawResponseString(resp *responseEntry) string {
 	}
 
 	buf.WriteString("\n")
-	buf.Write([]byte(resp.Body))
+	if pretty {
+		buf.WriteString(prettyBody(resp.Headers, resp.Body))
+	} else {
+		buf.WriteString(resp.Body)
+	}
 
 	return string(buf.Bytes())
 }
@@ -0,0 +1,127 @@
+package repl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/artilugio0/efin-suite/internal/ql"
+)
+
+// queryPlanStep is a row of the output of EXPLAIN QUERY PLAN.
+type queryPlanStep struct {
+	id     int
+	parent int
+	detail string
+}
+
+// explainQuery describes how a query is run: the query as it was read, the
+// SQL it compiles to with its parameters, the plan SQLite uses to run it and
+// how long it takes.
+func explainQuery(ctx context.Context, db *sql.DB, query *ql.Query) (string, error) {
+	compiled, values, err := query.Compile()
+	if err != nil {
+		return "", err
+	}
+
+	plan, err := queryPlan(ctx, db, compiled, values)
+	if err != nil {
+		return "", queryError(err)
+	}
+
+	start := time.Now()
+	rowCount, err := countRows(ctx, db, compiled, values)
+	if err != nil {
+		return "", queryError(err)
+	}
+	elapsed := time.Since(start)
+
+	var buf strings.Builder
+	buf.WriteString("Query:\n  " + query.String() + "\n\n")
+	buf.WriteString("SQL:\n  " + compiled + "\n\n")
+
+	buf.WriteString("Parameters:\n")
+	if len(values) == 0 {
+		buf.WriteString("  none\n")
+	}
+	for i, v := range values {
+		buf.WriteString(fmt.Sprintf("  %d: %s\n", i+1, formatParameter(v)))
+	}
+
+	buf.WriteString("\nQuery plan:\n")
+	writeQueryPlan(&buf, plan, 0, "  ")
+
+	buf.WriteString(fmt.Sprintf("\nElapsed: %s (%d rows)", elapsed.Round(time.Microsecond), rowCount))
+
+	return buf.String(), nil
+}
+
+func queryPlan(ctx context.Context, db *sql.DB, compiled string, values []any) ([]queryPlanStep, error) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN QUERY PLAN "+compiled, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plan := []queryPlanStep{}
+	for rows.Next() {
+		var step queryPlanStep
+		var notUsed int
+		if err := rows.Scan(&step.id, &step.parent, &notUsed, &step.detail); err != nil {
+			return nil, err
+		}
+		plan = append(plan, step)
+	}
+
+	return plan, rows.Err()
+}
+
+// countRows runs a query and returns the number of rows it returns.
+func countRows(ctx context.Context, db *sql.DB, compiled string, values []any) (int, error) {
+	rows, err := db.QueryContext(ctx, compiled, values...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		n++
+	}
+
+	return n, rows.Err()
+}
+
+// writeQueryPlan writes the steps of a query plan under parent as a tree,
+// like the sqlite3 shell does.
+func writeQueryPlan(buf *strings.Builder, plan []queryPlanStep, parent int, indent string) {
+	children := []queryPlanStep{}
+	for _, step := range plan {
+		if step.parent == parent {
+			children = append(children, step)
+		}
+	}
+
+	for i, step := range children {
+		branch, childIndent := "|--", "|  "
+		if i == len(children)-1 {
+			branch, childIndent = "`--", "   "
+		}
+
+		buf.WriteString(indent + branch + step.detail + "\n")
+		writeQueryPlan(buf, plan, step.id, indent+childIndent)
+	}
+}
+
+func formatParameter(v any) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q (text)", v)
+	case int:
+		return fmt.Sprintf("%d (integer)", v)
+	}
+
+	return fmt.Sprintf("%v (%T)", v, v)
+}
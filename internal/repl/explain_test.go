@@ -0,0 +1,129 @@
+package repl
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExplainQuery(t *testing.T) {
+	tests := []struct {
+		input      string
+		parameters []string
+		rows       int
+	}{
+		{
+			input:      "query requests where method eq POST and resp.status ge 200",
+			parameters: []string{`1: "POST" (text)`, "2: 200 (integer)"},
+			rows:       2,
+		},
+		{
+			input:      "query requests where url contains 'nothing'",
+			parameters: []string{`1: "nothing" (text)`},
+			rows:       0,
+		},
+		{
+			input:      "query requests",
+			parameters: []string{"none"},
+			rows:       4,
+		},
+	}
+
+	for _, test := range tests {
+		query, err := parseTextQuery(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compiled, _, err := query.Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := explainQuery(context.Background(), fixtureDB, query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.input, err)
+		}
+
+		expected := []string{
+			"Query:\n  " + query.String() + "\n\n",
+			"SQL:\n  " + compiled + "\n\n",
+			"Parameters:\n  " + strings.Join(test.parameters, "\n  ") + "\n\n",
+			"Query plan:\n  ",
+		}
+		for _, e := range expected {
+			if !strings.Contains(output, e) {
+				t.Errorf("%s: expected the output to have\n%s\ngot\n%s", test.input, e, output)
+			}
+		}
+
+		elapsed := regexp.MustCompile(`\nElapsed: \S+ \((\d+) rows\)$`).FindStringSubmatch(output)
+		if elapsed == nil || elapsed[1] != strconv.Itoa(test.rows) {
+			t.Errorf("%s: expected the elapsed time of %d rows, got\n%s", test.input, test.rows, output)
+		}
+	}
+}
+
+func TestExplainQueryErrors(t *testing.T) {
+	le := newTestEvaluator(t, "/does/not/exist.db")
+
+	if _, err := le.Eval(":explain query requests"); err == nil {
+		t.Errorf("expected an error for a missing DB")
+	}
+}
+
+func TestExplainCommand(t *testing.T) {
+	le := newTestEvaluator(t, fixtureDBFile)
+
+	tests := []struct {
+		input    string
+		expected string
+		err      string
+	}{
+		{input: ":explain query requests where method eq POST", expected: `1: "POST" (text)`},
+		{input: ":explain q.method.eq('GET'):limit(1)", expected: `1: "GET" (text)`},
+		{input: ":explain", err: "usage: :explain <query>"},
+		{input: ":explain query requests where", err: "expected"},
+	}
+
+	for _, test := range tests {
+		result, err := le.Eval(test.input)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.input, test.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		if !strings.Contains(result.Output, test.expected) {
+			t.Errorf("%s: expected the output to have %q, got\n%s", test.input, test.expected, result.Output)
+		}
+	}
+}
+
+func TestWriteQueryPlan(t *testing.T) {
+	plan := []queryPlanStep{
+		{id: 2, parent: 0, detail: "SCAN req"},
+		{id: 5, parent: 0, detail: "SEARCH resp USING INTEGER PRIMARY KEY (rowid=?)"},
+		{id: 8, parent: 0, detail: "CORRELATED SCALAR SUBQUERY 1"},
+		{id: 11, parent: 8, detail: "SCAN hd"},
+		{id: 14, parent: 8, detail: "USE TEMP B-TREE FOR ORDER BY"},
+	}
+
+	var buf strings.Builder
+	writeQueryPlan(&buf, plan, 0, "  ")
+
+	expected := "  |--SCAN req\n" +
+		"  |--SEARCH resp USING INTEGER PRIMARY KEY (rowid=?)\n" +
+		"  `--CORRELATED SCALAR SUBQUERY 1\n" +
+		"     |--SCAN hd\n" +
+		"     `--USE TEMP B-TREE FOR ORDER BY\n"
+	if buf.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
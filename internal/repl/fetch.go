@@ -0,0 +1,76 @@
+package repl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/artilugio0/efin-suite/internal/ql"
+	"github.com/artilugio0/efin-testifier/pkg/liblua"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// fetchQuery runs a query and returns its requests as a Lua array. Each
+// entry has the timestamp, id, method, status and url of the request, and
+// its request and response tables, which are loaded from the DB the first
+// time they are used:
+//
+//	for _, r in ipairs(fetch(q.method.eq('POST'))) do
+//	  print(r.id, r.request.body, r.response.status_code)
+//	end
+func fetchQuery(ctx context.Context, L *lua.LState, db *sql.DB, query *ql.Query) (*lua.LTable, error) {
+	if query.Operation == ql.QueryOperationCount || query.IsEndpointsQuery() {
+		return nil, fmt.Errorf("only the rows of queries that get requests can be fetched")
+	}
+
+	rows, err := doRequestQuery(ctx, db, query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := L.NewTable()
+	for _, r := range rows {
+		result.Append(newLazyRowTable(L, db, r))
+	}
+
+	return result, nil
+}
+
+// newLazyRowTable creates the Lua table of a row of a query, whose request
+// and response fields are loaded when they are first read.
+func newLazyRowTable(L *lua.LState, db *sql.DB, row RequestsTableRow) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("timestamp", lua.LString(row.Timestamp))
+	t.RawSetString("id", lua.LString(row.ID))
+	t.RawSetString("method", lua.LString(row.Method))
+	if status, err := strconv.Atoi(row.Status); err == nil {
+		t.RawSetString("status", lua.LNumber(status))
+	}
+	t.RawSetString("url", lua.LString(row.URL))
+
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		self := L.CheckTable(1)
+		key := L.CheckString(2)
+		if key != "request" && key != "response" {
+			L.Push(lua.LNil)
+			return 1
+		}
+
+		req, resp, err := getCachedRequestResponse(db, row.ID)
+		if err != nil {
+			L.RaiseError("failed to load request %s: %v", row.ID, err)
+		}
+
+		// Both tables are stored in the row, so the DB is read only once
+		self.RawSetString("request", liblua.HTTPRequestToTable(L, req.HTTPRequest))
+		self.RawSetString("response", liblua.HTTPResponseToTable(L, resp.HTTPResponse))
+
+		L.Push(self.RawGetString(key))
+		return 1
+	}))
+	L.SetMetatable(t, mt)
+
+	return t
+}
@@ -0,0 +1,90 @@
+package repl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFetch(t *testing.T) {
+	dbFile, _ := newFixtureDB(t)
+	le := newTestEvaluator(t, dbFile)
+
+	tests := []struct {
+		code     string
+		expected string
+		err      string
+	}{
+		{
+			code:     "local n = 0; for _, r in ipairs(fetch(q.method.eq('POST'))) do n = n + 1 end; return n",
+			expected: "2",
+		},
+		{
+			code:     "local r = fetch('requests where id eq 3')[1]; return r.id .. ' ' .. r.method .. ' ' .. r.status .. ' ' .. r.url",
+			expected: "3 GET 500 https://other.org/home",
+		},
+		{
+			code:     "local r = fetch(q.id.eq(2))[1]; return r.request.body .. ' ' .. r.response.status_code",
+			expected: "user=alice&pass=a%26b 302",
+		},
+		{
+			// The request and response are loaded when they are first read
+			code:     "local r = fetch(q.id.eq(1))[1]; local before = rawget(r, 'response') == nil; local body = r.response.body; return tostring(before) .. ' ' .. tostring(rawget(r, 'request') ~= nil) .. ' ' .. body",
+			expected: `true true {"id":1,"name":"alice","session":"s3cr3t"}`,
+		},
+		{
+			code:     "return tostring(fetch(q.id.eq(1))[1].other)",
+			expected: "nil",
+		},
+		{
+			code:     "return #fetch(q.id.eq(99))",
+			expected: "0",
+		},
+		{
+			code: "fetch('count group by method')",
+			err:  "only the rows of queries that get requests can be fetched",
+		},
+	}
+
+	for _, test := range tests {
+		value, _, err := execLua(le.l, test.code)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.code, test.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.code, err)
+			continue
+		}
+		if got := le.l.ToStringMeta(value).String(); got != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.code, test.expected, got)
+		}
+	}
+}
+
+func TestFetchLoadsRequestsLazily(t *testing.T) {
+	dbFile, db := newFixtureDB(t)
+	le := newTestEvaluator(t, dbFile)
+
+	if _, _, err := execLua(le.l, "rows = fetch(q.method.eq('GET'))"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests that are removed after the fetch can only be read if they
+	// were loaded before
+	if _, _, err := execLua(le.l, "body = rows[1].response.body"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DELETE FROM requests"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := execLua(le.l, "body = rows[1].request.method"); err != nil {
+		t.Errorf("expected the loaded request to be kept, got %v", err)
+	}
+	if _, _, err := execLua(le.l, "body = rows[2].request.method"); err == nil || !strings.Contains(err.Error(), "failed to load request") {
+		t.Errorf("expected the second request to be loaded when read, got %v", err)
+	}
+}
@@ -0,0 +1,373 @@
+package repl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/artilugio0/efin-suite/internal/ql"
+	"github.com/artilugio0/replit"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	lua "github.com/yuin/gopher-lua"
+)
+
+var matchStyle = lipgloss.NewStyle().
+	Background(lipgloss.Color("228")).
+	Foreground(lipgloss.Color("0"))
+
+// ansiSequence matches the escape sequences that color pretty printed
+// bodies.
+var ansiSequence = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// rowMatcher returns the ids of the rows that match a filter expression.
+type rowMatcher func([]RequestsTableRow) (map[string]bool, error)
+
+// filterMsg has the ids of the rows a filter expression matched. filterID
+// is the one of the filter when the rows were matched.
+type filterMsg struct {
+	filterID int
+	ids      map[string]bool
+	err      error
+}
+
+// SetFilterFn sets the function that parses a filter expression. It returns
+// the function that matches rows with the expression, which is run outside
+// of Update, or nil if the filter is not an expression, in which case the
+// rows are filtered by the text.
+func (v *RequestsTableView) SetFilterFn(fn func(string) (rowMatcher, error)) {
+	v.filterFn = fn
+}
+
+func (v *RequestsTableView) startFiltering() tea.Cmd {
+	v.filterInput = textinput.New()
+	v.filterInput.Prompt = "/"
+	v.filterInput.SetValue(v.filter)
+	v.filterInput.Focus()
+	v.filtering = true
+
+	return textinput.Blink
+}
+
+// updateFilterInput handles the keys pressed while the filter is written.
+// The rows are filtered by the text as it is written, and by the expression
+// when enter is pressed. esc removes the filter.
+func (v *RequestsTableView) updateFilterInput(msg tea.KeyMsg) tea.Cmd {
+	switch msg.String() {
+	case "enter":
+		v.filtering = false
+
+		filter := v.filterInput.Value()
+		if filter == "" || v.filterFn == nil {
+			return nil
+		}
+
+		match, err := v.filterFn(filter)
+		if err != nil {
+			return func() tea.Msg {
+				return requestTableViewMessage{message: "invalid filter: " + err.Error()}
+			}
+		}
+		if match == nil {
+			return nil
+		}
+
+		// No rows are shown until they are matched
+		v.setFilter(filter, map[string]bool{})
+		v.filterID++
+		v.filterMatch = match
+		v.message = fmt.Sprintf("filtering by '%s'", filter)
+		return v.matchRows(v.allRows)
+
+	case "esc":
+		v.filtering = false
+		v.setFilter("", nil)
+		return nil
+	}
+
+	var cmd tea.Cmd
+	v.filterInput, cmd = v.filterInput.Update(msg)
+	if v.filterInput.Value() != v.filter || v.filterIDs != nil {
+		v.setFilter(v.filterInput.Value(), nil)
+	}
+
+	return cmd
+}
+
+// setFilter shows the rows that match a filter, keeping the selected row if
+// it matches the filter.
+func (v *RequestsTableView) setFilter(filter string, ids map[string]bool) {
+	selectedID := ""
+	if len(v.rows) > 0 {
+		selectedID = v.rows[v.currentRow].ID
+	}
+
+	if ids == nil {
+		v.filterMatch = nil
+		v.filterID++
+	}
+
+	v.filter = filter
+	v.filterIDs = ids
+	v.applyFilter()
+
+	v.currentRow = 0
+	for i, r := range v.rows {
+		if r.ID == selectedID {
+			v.currentRow = i
+		}
+	}
+
+	v.setTable(v.currentRow)
+	v.message = v.summaryMessage()
+	v.updateViewports()
+}
+
+// matchRows returns a command that matches rows with the filter expression,
+// or nil if the rows are not filtered by an expression.
+func (v *RequestsTableView) matchRows(rows []RequestsTableRow) tea.Cmd {
+	if v.filterMatch == nil || len(rows) == 0 {
+		return nil
+	}
+
+	match := v.filterMatch
+	filterID := v.filterID
+	rows = slices.Clone(rows)
+	return func() tea.Msg {
+		ids, err := match(rows)
+		return filterMsg{filterID: filterID, ids: ids, err: err}
+	}
+}
+
+// addFilterMatches shows the rows a filter expression matched, unless the
+// filter changed since they were matched.
+func (v *RequestsTableView) addFilterMatches(msg filterMsg) tea.Cmd {
+	if msg.filterID != v.filterID || v.filterIDs == nil {
+		return nil
+	}
+
+	if msg.err != nil {
+		return func() tea.Msg {
+			return requestTableViewMessage{message: fmt.Sprintf("could not filter the requests: %v", msg.err)}
+		}
+	}
+
+	ids := maps.Clone(v.filterIDs)
+	maps.Copy(ids, msg.ids)
+	v.setFilter(v.filter, ids)
+
+	return nil
+}
+
+func (v *RequestsTableView) applyFilter() {
+	if v.filter == "" {
+		v.rows = v.allRows
+		return
+	}
+
+	v.rows = []RequestsTableRow{}
+	for _, r := range v.allRows {
+		if v.rowMatches(r) {
+			v.rows = append(v.rows, r)
+		}
+	}
+}
+
+func (v *RequestsTableView) rowMatches(r RequestsTableRow) bool {
+	if v.filterIDs != nil {
+		return v.filterIDs[r.ID]
+	}
+
+	if strings.Contains(r.URL, v.filter) || strings.Contains(r.Method, v.filter) || strings.Contains(r.Status, v.filter) {
+		return true
+	}
+
+	for _, c := range v.columns {
+		if strings.Contains(r.Value(c), v.filter) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// searchTerm returns the text that is highlighted in the viewports, which is
+// the filter unless it is an expression.
+func (v *RequestsTableView) searchTerm() string {
+	if v.filterIDs != nil {
+		return ""
+	}
+
+	return v.filter
+}
+
+// setViewportContent shows content in a viewport with the matches of term
+// highlighted, going to the first one. n and N go to the next and previous
+// matches.
+func setViewportContent(vp *replit.Viewport, content, term string) {
+	vp.Clear()
+	if term == "" {
+		vp.AppendBlock(replit.StringBlock{S: content})
+		vp.GotoTop()
+		vp.EnableNormalMode()
+		return
+	}
+
+	vp.AppendBlock(replit.StringBlock{S: highlight(content, term)})
+	vp.GotoTop()
+	vp.Search(term)
+}
+
+// highlight highlights term in content. Escape sequences in content are
+// skipped, so terms like "38" do not break its colors, and terms that cross
+// the colors of pretty printed bodies, like `"id": 1`, are found. Each match
+// is written without the escape sequences inside it, so the viewports can
+// search for term in the highlighted content.
+func highlight(content, term string) string {
+	if term == "" {
+		return content
+	}
+
+	// plain is content without escape sequences, and offsets has the
+	// position in content of each byte of plain
+	sequences := ansiSequence.FindAllStringIndex(content, -1)
+	var plain strings.Builder
+	offsets := make([]int, 0, len(content))
+	last := 0
+	for _, loc := range append(sequences, []int{len(content), len(content)}) {
+		plain.WriteString(content[last:loc[0]])
+		for i := last; i < loc[0]; i++ {
+			offsets = append(offsets, i)
+		}
+		last = loc[1]
+	}
+
+	var buf strings.Builder
+	text := plain.String()
+	written := 0
+	seq := -1
+	for start := 0; ; {
+		i := strings.Index(text[start:], term)
+		if i < 0 {
+			break
+		}
+		matchStart := offsets[start+i]
+		matchEnd := offsets[start+i+len(term)-1] + 1
+		start += i + len(term)
+
+		buf.WriteString(content[written:matchStart])
+		buf.WriteString(matchStyle.Render(term))
+		written = matchEnd
+
+		// The colors of the text after the match are the ones set by the
+		// last sequence before its end
+		for seq+1 < len(sequences) && sequences[seq+1][1] <= matchEnd {
+			seq++
+		}
+		if seq >= 0 {
+			buf.WriteString(content[sequences[seq][0]:sequences[seq][1]])
+		}
+	}
+	buf.WriteString(content[written:])
+
+	return buf.String()
+}
+
+// queryFilterFn returns a filter function for RequestsTableView that filters
+// the rows with text query conditions, like "method eq POST and
+// resp.status ge 400", or with Lua expressions that start with "q.". Other
+// filters are not expressions, unless they start like a condition, in which
+// case the error parsing them is returned.
+//
+// The filter is parsed, and Lua expressions run, when the filter function
+// is called. The query that matches the rows runs when the returned
+// rowMatcher is called.
+func queryFilterFn(db *sql.DB, L *lua.LState) func(string) (rowMatcher, error) {
+	return func(filter string) (rowMatcher, error) {
+		var query *ql.Query
+		if strings.HasPrefix(strings.TrimSpace(filter), "q.") {
+			value, _, err := execLua(L, filter)
+			if err != nil {
+				return nil, err
+			}
+
+			query, err = luaValueToQuery(value)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			const prefix = "query requests where "
+			var err error
+			query, err = ql.ParseQuery(prefix + filter)
+			if err != nil {
+				// Only text that starts like a condition is a misspelled
+				// condition, other text filters the rows by the text
+				if !ql.IsConditionStart(filter) {
+					return nil, nil
+				}
+
+				if parseError, ok := ql.AsParseError(err); ok {
+					parseError.Pos = max(parseError.Pos-len(prefix), 0)
+				}
+				return nil, err
+			}
+		}
+
+		return func(rows []RequestsTableRow) (map[string]bool, error) {
+			return matchQueryRows(db, query, rows)
+		}, nil
+	}
+}
+
+// matchQueryRows returns the ids of the rows matched by query's conditions
+// and set operations, but not by its limit. Only the requests between the
+// lowest and highest ids of the rows are queried, and they are matched with
+// the rows here, so the query does not need a parameter per row.
+func matchQueryRows(db *sql.DB, query *ql.Query, rows []RequestsTableRow) (map[string]bool, error) {
+	result := map[string]bool{}
+	if len(rows) == 0 {
+		return result, nil
+	}
+
+	rowIDs := make(map[string]bool, len(rows))
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, r := range rows {
+		id, err := strconv.ParseInt(r.ID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request id '%s'", r.ID)
+		}
+		first, last = min(first, id), max(last, id)
+		rowIDs[r.ID] = true
+	}
+
+	filterQuery := &ql.Query{
+		Operation: ql.QueryOperationGet,
+		RequestCondition: &ql.AndCondition{
+			Condition1: &ql.AndCondition{
+				Condition1: &ql.RequestIdCondition{Operator: "ge", Id: strconv.FormatInt(first, 10)},
+				Condition2: &ql.RequestIdCondition{Operator: "le", Id: strconv.FormatInt(last, 10)},
+			},
+			Condition2: &ql.RequestSubqueryCondition{Field: "id", Query: query},
+		},
+	}
+
+	matches, err := doRequestQuery(context.Background(), db, filterQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range matches {
+		if rowIDs[r.ID] {
+			result[r.ID] = true
+		}
+	}
+
+	return result, nil
+}
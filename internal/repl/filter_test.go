@@ -0,0 +1,159 @@
+package repl
+
+import (
+	"slices"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestQueryFilterFn(t *testing.T) {
+	le := newTestEvaluator(t, fixtureDBFile)
+	filterFn := queryFilterFn(fixtureDB, le.l)
+	rows := queryRows(t, fixtureDB, "query requests order by id")
+
+	tests := []struct {
+		filter   string
+		text     bool
+		expected []string
+		err      bool
+	}{
+		{filter: "method eq POST", expected: []string{"2", "4"}},
+		{filter: "resp.status ge 300 and host eq 'example.com'", expected: []string{"2"}},
+		{filter: "q.method.eq('GET')", expected: []string{"1", "3"}},
+		{filter: "id in (query requests where path contains 'api')", expected: []string{"1", "2", "4"}},
+		{filter: "alice", text: true},
+		{filter: "/api/users", text: true},
+		{filter: "resp.status ge 40O", err: true},
+		{filter: "methdo eq GET", err: true},
+		{filter: "q.nothing()", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			match, err := filterFn(test.filter)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.text {
+				if match != nil {
+					t.Fatal("expected a text filter")
+				}
+				return
+			}
+
+			ids, err := match(rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			matched := []string{}
+			for id := range ids {
+				matched = append(matched, id)
+			}
+			slices.Sort(matched)
+			if !slices.Equal(matched, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, matched)
+			}
+		})
+	}
+}
+
+func TestMatchQueryRowsOnlyMatchesRows(t *testing.T) {
+	query, err := parseTextQuery("query requests where method eq GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Request 3 is a GET between the rows, but it is not one of them
+	rows := queryRows(t, fixtureDB, "query requests where id in (1, 2, 4)")
+	ids, err := matchQueryRows(fixtureDB, query, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 1 || !ids["1"] {
+		t.Errorf("expected only request 1 to match, got %v", ids)
+	}
+}
+
+// runCmd runs cmd and the commands of its batches, and returns their
+// messages of type M.
+func runCmd[M any](cmd tea.Cmd) []M {
+	if cmd == nil {
+		return nil
+	}
+
+	switch msg := cmd().(type) {
+	case tea.BatchMsg:
+		result := []M{}
+		for _, c := range msg {
+			result = append(result, runCmd[M](c)...)
+		}
+		return result
+	case M:
+		return []M{msg}
+	}
+
+	return nil
+}
+
+func TestFilterExpressionInView(t *testing.T) {
+	dbFile, db := newFixtureDB(t)
+	le := newTestEvaluator(t, dbFile)
+
+	v := NewRequestsTableView(120, 40)
+	v.SetRows(queryRows(t, db, "query requests order by id"))
+	v.SetFilterFn(queryFilterFn(db, le.l))
+
+	filter := func(s string) tea.Cmd {
+		v.startFiltering()
+		v.filterInput.SetValue(s)
+		return v.updateFilterInput(tea.KeyMsg{Type: tea.KeyEnter})
+	}
+
+	// The rows are shown when the matches arrive
+	cmd := filter("method eq POST")
+	if len(v.rows) != 0 {
+		t.Errorf("expected no rows before the matches, got %v", rowIDs(v.rows))
+	}
+	for _, msg := range runCmd[filterMsg](cmd) {
+		v.Update(msg)
+	}
+	if ids := rowIDs(v.rows); !slices.Equal(ids, []string{"2", "4"}) {
+		t.Errorf("expected rows 2 and 4, got %v", ids)
+	}
+
+	// New rows are matched with the filter before they are shown
+	if _, err := db.Exec("INSERT INTO requests (request_id, method, url, body) VALUES (5, 'POST', 'https://example.com/new', ''), (6, 'GET', 'https://example.com/new', '')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (5, 200, ''), (6, 200, '')"); err != nil {
+		t.Fatal(err)
+	}
+	cmd = v.InsertRows(queryRows(t, db, "query requests where id gt 4 order by id"), false)
+	for _, msg := range runCmd[filterMsg](cmd) {
+		v.Update(msg)
+	}
+	if ids := rowIDs(v.rows); !slices.Equal(ids, []string{"2", "4", "5"}) {
+		t.Errorf("expected rows 2, 4 and 5, got %v", ids)
+	}
+
+	// Matches of a filter that changed are discarded
+	cmd = filter("method eq GET")
+	v.startFiltering()
+	v.updateFilterInput(tea.KeyMsg{Type: tea.KeyEsc})
+	for _, msg := range runCmd[filterMsg](cmd) {
+		v.Update(msg)
+	}
+	if len(v.rows) != 6 || v.filterIDs != nil {
+		t.Errorf("expected the filter to be removed, got rows %v", rowIDs(v.rows))
+	}
+}
@@ -0,0 +1,184 @@
+package repl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/artilugio0/efin-suite/internal/ql"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// followInterval is how often a followed query looks for new requests.
+const followInterval = time.Second
+
+// followPendingRequests is how many requests behind the newest one a
+// followed query waits for the response of a request. Requests whose
+// response never arrives, like the ones that failed, stop being waited for
+// once they are further behind.
+const followPendingRequests = 1000
+
+// followTickMsg asks a followed query to look for new requests. id tells
+// apart the ticks of the current follow mode from the ones of a follow mode
+// that was stopped.
+type followTickMsg struct {
+	id int
+}
+
+// followRowsMsg has the requests a followed query found after its mark,
+// and the new mark.
+type followRowsMsg struct {
+	id   int
+	rows []RequestsTableRow
+	mark string
+	err  error
+}
+
+// tailedQuery is the userdata returned by tail(expr) in Lua. The REPL shows
+// the results of the query and follows it when it is the result of the
+// input.
+type tailedQuery struct {
+	query *ql.Query
+}
+
+// followMark returns the id after which a followed query looks for
+// requests, which is never less than mark. The proxy stores the response
+// of a request after the request, and queries only match requests with a
+// response, so the mark stays before the oldest request that is still
+// waiting for its response. Without any, it is the id of the last request
+// stored, or "0" if there are no requests.
+func followMark(ctx context.Context, db *sql.DB, mark string) (string, error) {
+	after, err := strconv.ParseInt(mark, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid request id '%s'", mark)
+	}
+
+	var id int64
+	err = db.QueryRowContext(ctx, `SELECT IFNULL(
+		(SELECT MIN(r.request_id) - 1 FROM requests r
+			WHERE r.request_id > MAX(?1, (SELECT MAX(request_id) FROM requests) - ?2)
+			AND NOT EXISTS (SELECT 1 FROM responses WHERE response_id = r.request_id)),
+		(SELECT IFNULL(MAX(request_id), 0) FROM requests))`,
+		after, followPendingRequests,
+	).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(max(id, after), 10), nil
+}
+
+// pollFollowedQuery returns the requests matched by query after mark, and
+// the mark for the next poll. The rows can include requests returned by a
+// previous poll, when the mark stays before a request waiting for its
+// response.
+func pollFollowedQuery(ctx context.Context, db *sql.DB, query *ql.Query, mark string, columns []string) ([]RequestsTableRow, string, error) {
+	// The new mark is found before querying the rows: every request up to
+	// it has its response, so the query finds them if they match
+	next, err := followMark(ctx, db, mark)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := doRequestQuery(ctx, db, query.After(mark), columns)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return rows, next, nil
+}
+
+// follow starts following the query of the view, adding the requests stored
+// after the last one in the DB, or the ones still waiting for a response, as
+// the proxy stores them.
+func (v *QueryResultsView) follow() tea.Cmd {
+	mark, err := followMark(context.Background(), v.db, "0")
+	if err != nil {
+		return func() tea.Msg {
+			return requestTableViewMessage{message: fmt.Sprintf("could not follow the query: %v", err)}
+		}
+	}
+
+	v.following = true
+	v.followID++
+	v.mark = mark
+	if v.followedFrom == "" {
+		v.followedFrom = mark
+	}
+
+	return v.followTick()
+}
+
+// withFollowedRows adds the rows found by following the query to the first
+// page of its results loaded again, since the pager only gets to them when
+// it loads the page they are in.
+func (v *QueryResultsView) withFollowedRows(rows []RequestsTableRow) []RequestsTableRow {
+	if v.followedFrom == "" {
+		return rows
+	}
+
+	from, err := strconv.ParseInt(v.followedFrom, 10, 64)
+	if err != nil {
+		return rows
+	}
+
+	ids := make(map[string]bool, len(rows))
+	for _, r := range rows {
+		ids[r.ID] = true
+	}
+
+	result := slices.Clone(rows)
+	for _, r := range v.requestsTableView.allRows {
+		id, err := strconv.ParseInt(r.ID, 10, 64)
+		if err == nil && id > from && !ids[r.ID] {
+			result = append(result, r)
+		}
+	}
+
+	return result
+}
+
+func (v *QueryResultsView) stopFollowing() {
+	v.following = false
+	v.followID++
+}
+
+func (v *QueryResultsView) followTick() tea.Cmd {
+	id := v.followID
+	return tea.Tick(followInterval, func(time.Time) tea.Msg {
+		return followTickMsg{id: id}
+	})
+}
+
+// fetchNewRows looks for the requests matched by the query of the view
+// after its mark.
+func (v *QueryResultsView) fetchNewRows() tea.Cmd {
+	id := v.followID
+	query := v.query
+	db := v.db
+	mark := v.mark
+	columns := v.requestsTableView.columns
+
+	return func() tea.Msg {
+		rows, mark, err := pollFollowedQuery(context.Background(), db, query, mark, columns)
+		if err != nil {
+			return followRowsMsg{id: id, err: err}
+		}
+
+		return followRowsMsg{id: id, rows: rows, mark: mark}
+	}
+}
+
+// newestFirst reports whether the newest requests of the query are shown
+// first, which is where the new requests of a followed query are added.
+func newestFirst(query *ql.Query) bool {
+	if len(query.OrderBy) == 0 {
+		return true
+	}
+
+	first := query.OrderBy[0]
+	return first.Descending && (first.Field == "timestamp" || first.Field == "id")
+}
@@ -0,0 +1,140 @@
+package repl
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestPollFollowedQuery(t *testing.T) {
+	_, db := newFixtureDB(t)
+	ctx := context.Background()
+
+	query, err := parseTextQuery("query requests where method = 'POST'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mark, err := followMark(ctx, db, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark != "4" {
+		t.Fatalf("expected the follow mark to start at the last request, got %s", mark)
+	}
+
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	poll := func(expected []string, expectedMark string) {
+		t.Helper()
+
+		rows, next, err := pollFollowedQuery(ctx, db, query, mark, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := rowIDs(rows); !slices.Equal(ids, expected) {
+			t.Errorf("expected rows %v, got %v", expected, ids)
+		}
+		if next != expectedMark {
+			t.Errorf("expected mark %s, got %s", expectedMark, next)
+		}
+		mark = next
+	}
+
+	// Request 5 waits for its response while request 6 gets one, so the
+	// mark stays before request 5
+	exec("INSERT INTO requests (request_id, method, url, body) VALUES (5, 'POST', 'https://example.com/slow', '')")
+	exec("INSERT INTO requests (request_id, method, url, body) VALUES (6, 'POST', 'https://example.com/fast', '')")
+	exec("INSERT INTO responses (response_id, status_code, body) VALUES (6, 200, '')")
+	poll([]string{"6"}, "4")
+
+	exec("INSERT INTO responses (response_id, status_code, body) VALUES (5, 200, '')")
+	poll([]string{"5", "6"}, "6")
+
+	// Requests that do not match the query also move the mark
+	exec("INSERT INTO requests (request_id, method, url, body) VALUES (7, 'GET', 'https://example.com/', '')")
+	exec("INSERT INTO responses (response_id, status_code, body) VALUES (7, 200, '')")
+	poll([]string{}, "7")
+	poll([]string{}, "7")
+}
+
+func TestFollowMarkGivesUpOnOldRequests(t *testing.T) {
+	_, db := newFixtureDB(t)
+
+	// Request 5 never gets a response, and after followPendingRequests
+	// newer requests it is no longer waited for
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := 5 + followPendingRequests
+	for id := 5; id <= last; id++ {
+		if _, err := tx.Exec("INSERT INTO requests (request_id, method, url, body) VALUES (?, 'GET', 'https://example.com/', '')", id); err != nil {
+			t.Fatal(err)
+		}
+		if id == 5 {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (?, 200, '')", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		mark     string
+		expected string
+	}{
+		{mark: "0", expected: "1005"},
+		{mark: "1005", expected: "1005"},
+	}
+
+	for _, test := range tests {
+		mark, err := followMark(context.Background(), db, test.mark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mark != test.expected {
+			t.Errorf("mark %s: expected %s, got %s", test.mark, test.expected, mark)
+		}
+	}
+
+	if _, err := db.Exec("DELETE FROM requests WHERE request_id > 100"); err != nil {
+		t.Fatal(err)
+	}
+	mark, err := followMark(context.Background(), db, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark != "4" {
+		t.Errorf("expected the mark to stay before request 5, got %s", mark)
+	}
+}
+
+func TestInsertRowsSkipsAddedRows(t *testing.T) {
+	query, err := parseTextQuery("query requests order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := doRequestQuery(context.Background(), fixtureDB, query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewRequestsTableView(120, 40)
+	v.SetRows(rows[:2])
+
+	// A followed query finds request 2 again while it waits for request 3
+	v.InsertRows(rows[1:3], false)
+	v.InsertRows(rows[1:], false)
+	if ids := rowIDs(v.rows); !slices.Equal(ids, []string{"1", "2", "3", "4"}) {
+		t.Errorf("expected rows [1 2 3 4], got %v", ids)
+	}
+}
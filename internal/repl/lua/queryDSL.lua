@@ -3,6 +3,12 @@ local allowed_fields = {
   id = true,
   timestamp = true,
   path = true,
+  endpoint = true,
+  url = true,
+  host = true,
+  scheme = true,
+  port = true,
+  query_string = true,
   method = true,
   body = true,
   resp_status = true,
@@ -11,8 +17,157 @@ local allowed_fields = {
   resp_header = true,
   raw = true,
   resp_raw = true,
+  req_size = true,
+  resp_size = true,
+  header_count = true,
+  resp_header_count = true,
 }
 
+-- Methods on expressions and queries can be called either as expr.m(...)
+-- or as expr:m(...); drop the implicit self argument in the latter case
+local function method_args(self, first, ...)
+  if first == self then
+    return ...
+  end
+  return first, ...
+end
+
+-- Metatable for whole queries (an optional expression plus an operation,
+-- sorting and paging)
+local query_mt = {
+  __mt_id = 'query_mt',
+}
+
+-- Copy a query so that chained methods do not modify the original one.
+-- Query data keys (order, row_limit, ...) must not clash with method names,
+-- and rawget is used because missing keys would resolve to query methods
+local function copy_query(query)
+  local copy = {}
+  for k, v in pairs(query) do
+    copy[k] = v
+  end
+  copy.order = {}
+  for i, o in ipairs(rawget(query, 'order') or {}) do
+    copy.order[i] = o
+  end
+  copy.set_ops = {}
+  for i, o in ipairs(rawget(query, 'set_ops') or {}) do
+    copy.set_ops[i] = o
+  end
+  return setmetatable(copy, query_mt)
+end
+
+-- Build a set operation method; the operand can be an expression or a query
+-- with only conditions: q.method.eq('GET').except(q.resp_status.eq(403))
+local function set_op_method(op)
+  return function(query, other)
+    if type(other) ~= 'table' then
+      error("The operand of " .. op .. " must be a query, got: " .. type(other))
+    end
+    local copy = copy_query(query)
+    table.insert(copy.set_ops, {op = op, query = other})
+    return copy
+  end
+end
+
+local function group_by_fields(...)
+  local group_by = {...}
+  for _, field in ipairs(group_by) do
+    if type(field) ~= 'string' then
+      error("Group by field must be a string, got: " .. type(field))
+    end
+  end
+  return group_by
+end
+
+local query_methods = {
+  order_by = function(query, field, direction)
+    if type(field) ~= 'string' then
+      error("Order by field must be a string, got: " .. type(field))
+    end
+    direction = direction or 'asc'
+    if direction ~= 'asc' and direction ~= 'desc' then
+      error("Order by direction must be 'asc' or 'desc', got: " .. tostring(direction))
+    end
+    local copy = copy_query(query)
+    table.insert(copy.order, {field = field, direction = direction})
+    return copy
+  end,
+
+  limit = function(query, n)
+    if type(n) ~= 'number' then
+      error("Limit must be a number, got: " .. type(n))
+    end
+    local copy = copy_query(query)
+    copy.row_limit = n
+    return copy
+  end,
+
+  offset = function(query, n)
+    if type(n) ~= 'number' then
+      error("Offset must be a number, got: " .. type(n))
+    end
+    local copy = copy_query(query)
+    copy.row_offset = n
+    return copy
+  end,
+
+  -- Count the requests of a query, like the result of a set operation
+  count = function(query)
+    local copy = copy_query(query)
+    copy.operation = 'count'
+    copy.group_by = {}
+    return copy
+  end,
+
+  count_by = function(query, ...)
+    local copy = copy_query(query)
+    copy.operation = 'count'
+    copy.group_by = group_by_fields(...)
+    return copy
+  end,
+
+  -- List the endpoints of the requests instead of the requests:
+  -- q.host.eq('example.com'):group_by('endpoint')
+  group_by = function(query, ...)
+    local copy = copy_query(query)
+    copy.operation = 'get'
+    copy.group_by = group_by_fields(...)
+    return copy
+  end,
+
+  -- Run the query and return its requests as a Lua array, like fetch:
+  -- for _, r in ipairs(q.method.eq('POST'):rows()) do print(r.request.url) end
+  rows = function(query)
+    return fetch(query)
+  end,
+
+  -- Show the results of the query and the requests it matches as the proxy
+  -- stores them, like tail
+  tail = function(query)
+    return tail(query)
+  end,
+
+  union = set_op_method('union'),
+  intersect = set_op_method('intersect'),
+  except = set_op_method('except'),
+}
+
+query_mt.__index = function(self, key)
+  local method = query_methods[key]
+  if method then
+    return function(...)
+      return method(self, method_args(self, ...))
+    end
+  end
+  error("Unknown method: " .. tostring(key))
+end
+
+-- Build a count query over expr, optionally grouped by the given fields
+local function count_query(expr, ...)
+  return setmetatable({operation = 'count', where = expr, group_by = group_by_fields(...)}, query_mt)
+end
+
 -- Metatable for expressions (with .and_ and .or_ methods via __index)
 local expr_mt = {
   __index = function(self, key)
@@ -25,6 +180,20 @@ local expr_mt = {
       return function(next_expr)
         return setmetatable({op = 'or', left = self, right = next_expr}, mt)
       end
+    elseif key == 'count' then
+      return function(...)
+        return count_query(self)
+      end
+    elseif key == 'count_by' then
+      return function(...)
+        return count_query(self, method_args(self, ...))
+      end
+    elseif query_methods[key] then
+      -- order_by, limit, etc. turn the expression into a query
+      return function(...)
+        local query = setmetatable({operation = 'get', where = self}, query_mt)
+        return query_methods[key](query, method_args(self, ...))
+      end
     else
       error("Unknown method: " .. tostring(key))
     end
@@ -44,14 +213,32 @@ local field_mt = {
       lt = 'lt',
       le = 'le',
       ge = 'ge',
-      contains = 'contains'
-      -- Add more, e.g., matches = 'matches' for regex
+      contains = 'contains',
+      icontains = 'icontains',
+      matches = 'matches',
+      -- full-text search, requires the index built with 'efin index'
+      search = 'search',
+      exists = 'exists',
+      -- 'in' is a Lua keyword: q.method.in_({'GET', 'POST'}), or with a
+      -- subquery: q.path.in_(q.resp_status.eq(403))
+      in_ = 'in',
+      between = 'between',
+      -- status classes: q.resp_status.class('5xx')
+      class = 'class',
     }
+    if op_name == 'as_number' then
+      -- Compare header values as numbers:
+      -- q.resp_header('content-length').as_number().gt(1000)
+      return function()
+        return setmetatable({field = self.field, as_number = true}, getmetatable(self))
+      end
+    end
     local op = op_map[op_name]
     if op then
-      -- Return a function that builds the leaf expression when called
-      return function(value)
-        return setmetatable({field = self.field, op = op, value = value}, expr_mt)
+      -- Return a function that builds the leaf expression when called;
+      -- value2 is only used by between
+      return function(value, value2)
+        return setmetatable({field = self.field, as_number = rawget(self, 'as_number'), op = op, value = value, value2 = value2}, expr_mt)
       end
     else
       error("Unknown operation: " .. tostring(op_name))
@@ -61,7 +248,66 @@ local field_mt = {
   __mt_id = 'field_mt',
 }
 
--- The DSL entry point: q.field.op(value), plus q.not_(expr)
+-- Keys of q that are not fields, which macros cannot be named after
+local builtin_keys = {
+  not_ = true,
+  request_time = true,
+  count = true,
+  count_by = true,
+  header = true,
+  resp_header = true,
+  form = true,
+  multipart = true,
+  json = true,
+  resp_form = true,
+  resp_multipart = true,
+  resp_json = true,
+  param = true,
+}
+
+-- Macros defined with defq, by name
+local macros = {}
+
+-- Define a parameterized predicate that can be used like a field of q:
+-- defq('api_of', function(host)
+--   return q.header('host').eq(host).and_(q.path.contains('/api/'))
+-- end)
+-- q.api_of('example.com').and_(q.method.eq('POST'))
+function defq(name, fn)
+  if type(name) ~= 'string' or not name:match('^[%a_][%w_]*$') then
+    error("Macro name must be an identifier, got: " .. tostring(name))
+  end
+  if allowed_fields[name] or builtin_keys[name] or query_methods[name] then
+    error("Macro name clashes with a built-in: " .. name)
+  end
+  if type(fn) ~= 'function' then
+    error("Macro must be a function, got: " .. type(fn))
+  end
+  macros[name] = fn
+  return "macro '" .. name .. "' defined"
+end
+
+function undefq(name)
+  if not macros[name] then
+    error("Unknown macro: " .. tostring(name))
+  end
+  macros[name] = nil
+  return "macro '" .. name .. "' removed"
+end
+
+-- Names of the defined macros, one per line
+function macro_names()
+  local names = {}
+  for name in pairs(macros) do
+    table.insert(names, name)
+  end
+  table.sort(names)
+  return table.concat(names, '\n')
+end
+
+-- The DSL entry point: q.field.op(value), plus q.not_(expr),
+-- q.count_by(field, ...) to count every request and q.order_by(...) or
+-- q.limit(n) to list every request
 q = setmetatable({}, {
   __index = function(self, key)
     if key == 'not_' then
@@ -69,6 +315,26 @@ q = setmetatable({}, {
       return function(expr)
         return setmetatable({op = 'not', expr = expr}, expr_mt)
       end
+    elseif key == 'request_time' then
+      -- Timestamp of a request, to be used as a timestamp value:
+      -- q.timestamp.gt(q.request_time('123'))
+      return function(...)
+        local id = method_args(self, ...)
+        return {request_id = tostring(id)}
+      end
+    elseif key == 'count' then
+      return function(...)
+        return count_query(nil)
+      end
+    elseif key == 'count_by' then
+      return function(...)
+        return count_query(nil, method_args(self, ...))
+      end
+    elseif query_methods[key] then
+      return function(...)
+        local query = setmetatable({operation = 'get'}, query_mt)
+        return query_methods[key](query, method_args(self, ...))
+      end
     elseif key == 'header' or key == 'resp_header' then
       -- Special handling for header and resp_header: return a function to capture the header name
       return function(header_name)
@@ -77,10 +343,38 @@ q = setmetatable({}, {
         end
         return setmetatable({field = key .. ':' .. header_name}, field_mt)
       end
+    elseif key == 'form' or key == 'multipart' or key == 'json'
+        or key == 'resp_form' or key == 'resp_multipart' or key == 'resp_json' then
+      -- Body parameters: q.form('role').eq('admin'), q.json('$.user.id').eq('1')
+      return function(param_name)
+        if type(param_name) ~= 'string' then
+          error("Parameter name must be a string, got: " .. type(param_name))
+        end
+        return setmetatable({field = key .. ':' .. param_name}, field_mt)
+      end
+    elseif key == 'param' then
+      -- URL query parameters: q.param('id').exists()
+      return function(param_name)
+        if type(param_name) ~= 'string' then
+          error("Parameter name must be a string, got: " .. type(param_name))
+        end
+        return setmetatable({field = 'param:' .. param_name}, field_mt)
+      end
+    elseif macros[key] then
+      local macro = macros[key]
+      return function(...)
+        local expr = macro(method_args(self, ...))
+        -- Only conditions can be composed with and_, or_ and not_, so a
+        -- macro cannot return a whole query
+        if getmetatable(expr) ~= expr_mt then
+          error("Macro " .. key .. " must return a condition, got: " .. type(expr))
+        end
+        return expr
+      end
     else
       -- Validate field
       if not allowed_fields[key] then
-        error("Invalid field: " .. tostring(key) .. ". Allowed fields are: path, method, body, resp_status, resp_body, header, resp_header")
+        error("Invalid field: " .. tostring(key) .. ". Allowed fields are: id, timestamp, path, endpoint, url, host, scheme, port, query_string, param, method, body, form, multipart, json, raw, resp_status, resp_body, resp_form, resp_multipart, resp_json, header, resp_header, resp_raw, req_size, resp_size, header_count, resp_header_count")
       end
       -- Regular field access
       return setmetatable({field = key}, field_mt)
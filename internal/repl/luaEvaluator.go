@@ -2,11 +2,15 @@ package repl
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
 	_ "embed"
 
@@ -23,55 +27,283 @@ type luaEvaluator struct {
 	l      *lua.LState
 	repl   *replit.REPL
 	dbFile string
+
+	// db is the handle of the proxy DB, shared by all the queries and views
+	// of the REPL. It is opened by proxyDB when it is first needed, so the
+	// REPL starts before the proxy stores any request.
+	db *sql.DB
+
+	// suggestedMacros are the macros that have a suggestion in the prompt
+	suggestedMacros map[string]bool
+
+	// columns are the columns of the tables of query results
+	columns []string
 }
 
-func newLuaEvaluator(dbFile string) *luaEvaluator {
+// newLuaEvaluator creates the Lua state of the REPL, with the query DSL and
+// the macros of the macros file next to the suite DB, if there is one.
+func newLuaEvaluator(dbFile, suiteDBFile string) (*luaEvaluator, error) {
 	L := lua.NewState()
 	L.OpenLibs()
 	liblua.RegisterCommonRuntimeFunctions(L, 20)
+	registerSavedQueryFunctions(L, suiteDBFile)
+
+	le := &luaEvaluator{
+		l:               L,
+		dbFile:          dbFile,
+		suggestedMacros: map[string]bool{},
+		columns:         defaultColumns,
+	}
+
+	// columns(...) sets the columns of the tables of query results, like
+	// columns('timestamp', 'method', 'host', 'mime', 'header:Cookie', 'url').
+	// 'default' restores the default columns, and without arguments it
+	// returns the current columns.
+	L.SetGlobal("columns", L.NewFunction(func(L *lua.LState) int {
+		if L.GetTop() == 0 {
+			L.Push(lua.LString(strings.Join(le.columns, ", ")))
+			return 1
+		}
+
+		if L.GetTop() == 1 && L.Get(1).String() == "default" {
+			le.columns = defaultColumns
+			return 0
+		}
+
+		columns := []string{}
+		for i := 1; i <= L.GetTop(); i++ {
+			column := L.CheckString(i)
+			if err := ql.CheckColumn(column); err != nil {
+				L.RaiseError("%v", err)
+			}
+			columns = append(columns, column)
+		}
+		le.columns = columns
+
+		return 0
+	}))
+
+	// show_query(expr) shows how a query was read, with parentheses around
+	// its and and or conditions
+	L.SetGlobal("show_query", L.NewFunction(func(L *lua.LState) int {
+		query, err := luaValueToQuery(L.CheckAny(1))
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		L.Push(lua.LString(query.String()))
+		return 1
+	}))
+
+	// explain(expr) shows the SQL a query compiles to, its parameters, its
+	// query plan and how long it takes
+	L.SetGlobal("explain", L.NewFunction(func(L *lua.LState) int {
+		query, err := luaValueToQuery(L.CheckAny(1))
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		db, err := le.proxyDB()
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		output, err := explainQuery(context.TODO(), db, query)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		L.Push(lua.LString(output))
+		return 1
+	}))
+
+	// fetch(expr) returns the requests of a query as a Lua array, instead of
+	// showing them
+	L.SetGlobal("fetch", L.NewFunction(func(L *lua.LState) int {
+		query, err := luaValueToQuery(L.CheckAny(1))
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		db, err := le.proxyDB()
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		rows, err := fetchQuery(context.TODO(), L, db, query)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		L.Push(rows)
+		return 1
+	}))
+
+	// tail(expr) shows the results of a query and adds the requests it
+	// matches as the proxy stores them
+	L.SetGlobal("tail", L.NewFunction(func(L *lua.LState) int {
+		query, err := luaValueToQuery(L.CheckAny(1))
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		ud := L.NewUserData()
+		ud.Value = &tailedQuery{query: query}
+		L.Push(ud)
+		return 1
+	}))
+
+	// trace(value) shows the request whose response is the first one with a
+	// value, like a CSRF token or a session ID, and the later requests that
+	// send it back
+	L.SetGlobal("trace", L.NewFunction(func(L *lua.LState) int {
+		ud := L.NewUserData()
+		ud.Value = &tracedValue{value: L.CheckString(1)}
+		L.Push(ud)
+		return 1
+	}))
 
 	if err := L.DoString(queryDSLSource); err != nil {
 		panic(err)
 	}
 
-	return &luaEvaluator{
-		l:      L,
-		dbFile: dbFile,
+	macrosFile := filepath.Join(filepath.Dir(suiteDBFile), macrosFileName)
+	if _, err := os.Stat(macrosFile); err == nil {
+		if err := L.DoFile(macrosFile); err != nil {
+			return nil, fmt.Errorf("failed to load macros file '%s': %v", macrosFile, err)
+		}
+	}
+
+	return le, nil
+}
+
+// proxyDB returns the handle of the proxy DB, opening it the first time.
+func (le *luaEvaluator) proxyDB() (*sql.DB, error) {
+	if le.db == nil {
+		db, err := openDB(le.dbFile)
+		if err != nil {
+			return nil, err
+		}
+		le.db = db
+	}
+
+	return le.db, nil
+}
+
+// Close closes the proxy DB, if it was opened, and the Lua state.
+func (le *luaEvaluator) Close() {
+	if le.db != nil {
+		le.db.Close()
+	}
+	le.l.Close()
+}
+
+// macrosFileName is the name of the Lua file loaded when the REPL starts,
+// where macros can be defined with defq.
+const macrosFileName = "macros.lua"
+
+// macroNames returns the names of the macros defined with defq.
+func (le *luaEvaluator) macroNames() []string {
+	if err := le.l.CallByParam(lua.P{
+		Fn:      le.l.GetGlobal("macro_names"),
+		NRet:    1,
+		Protect: true,
+	}); err != nil {
+		return nil
+	}
+
+	names := le.l.Get(-1).String()
+	le.l.Pop(1)
+
+	if names == "" {
+		return nil
+	}
+	return strings.Split(names, "\n")
+}
+
+// macroSuggestions returns the suggestions for the macros that do not have
+// one yet, like the ones defined with defq since the last call.
+func (le *luaEvaluator) macroSuggestions() []string {
+	suggestions := []string{}
+	for _, name := range le.macroNames() {
+		if !le.suggestedMacros[name] {
+			le.suggestedMacros[name] = true
+			suggestions = append(suggestions, "q."+name+"(")
+		}
 	}
+
+	return suggestions
 }
 
+// suggestMacros adds the suggestions of the macros defined since the last
+// call to the prompt. Suggestions cannot be removed from the prompt, so the
+// ones of macros removed with undefq stay, like the inputs in the history,
+// and they are not added again if the macros are defined again.
+//
+// The prompt is not used while an input is evaluated, so this can be called
+// from Eval.
+func (le *luaEvaluator) suggestMacros() {
+	if le.repl == nil {
+		return
+	}
+
+	if suggestions := le.macroSuggestions(); len(suggestions) > 0 {
+		replit.WithPromptInitialSuggestions(suggestions)(le.repl)
+	}
+}
+
+// explainCommand is the REPL meta-command that explains the query that
+// follows it, which can be a text query or a Lua expression:
+//
+//	:explain query requests where method eq POST
+//	:explain q.method.eq('POST')
+const explainCommand = ":explain"
+
 func (le *luaEvaluator) Eval(input string) (*replit.Result, error) {
 	ctx := context.TODO()
 
+	// Macros can be defined with defq in any input
+	defer le.suggestMacros()
+
+	if rest, ok := strings.CutPrefix(strings.TrimSpace(input), explainCommand); ok {
+		return le.evalExplain(ctx, strings.TrimSpace(rest))
+	}
+
+	if isTextQuery(input) {
+		query, err := ql.ParseQuery(input)
+		if err != nil {
+			return nil, annotateParseError(err, input)
+		}
+
+		return le.evalQuery(ctx, query, le.repl.GetWidth(), le.repl.GetHeight())
+	}
+
 	value, out, err := execLua(le.l, input)
 	if err != nil {
 		return nil, err
 	}
 
 	if value != nil {
+		if ud, ok := value.(*lua.LUserData); ok {
+			switch v := ud.Value.(type) {
+			case *ql.Query:
+				return le.evalQuery(ctx, v, le.repl.GetWidth(), le.repl.GetHeight())
+			case *tailedQuery:
+				return le.evalTail(ctx, v.query, le.repl.GetWidth(), le.repl.GetHeight())
+			case *tracedValue:
+				return le.evalTrace(ctx, v.value, le.repl.GetWidth(), le.repl.GetHeight())
+			}
+		}
+
 		if mt, ok := le.l.GetMetatable(value).(*lua.LTable); ok {
 			if mtID, ok := le.l.GetField(mt, "__mt_id").(lua.LString); ok {
-				if mtID == "expr_mt" || mtID == "field_mt" {
-					query, err := le.toQuery(value.(*lua.LTable))
-					if err != nil {
-						return nil, err
-					}
-					rows, err := doRequestQuery(ctx, le.dbFile, query)
+				if mtID == "expr_mt" || mtID == "field_mt" || mtID == "query_mt" {
+					query, err := toQuery(value.(*lua.LTable))
 					if err != nil {
 						return nil, err
 					}
 
-					if len(rows) == 0 {
-						return &replit.Result{
-							Output: "0 requests found",
-						}, nil
-					}
-
-					width, height := le.repl.GetWidth(), le.repl.GetHeight()
-
-					return &replit.Result{
-						View: NewQueryResultsView(le.dbFile, le.l, rows, width, height),
-					}, nil
+					return le.evalQuery(ctx, query, le.repl.GetWidth(), le.repl.GetHeight())
 				}
 			}
 		}
@@ -84,6 +316,224 @@ func (le *luaEvaluator) Eval(input string) (*replit.Result, error) {
 	}, nil
 }
 
+func (le *luaEvaluator) evalExplain(ctx context.Context, input string) (*replit.Result, error) {
+	var query *ql.Query
+	if isTextQuery(input) {
+		var err error
+		query, err = ql.ParseQuery(input)
+		if err != nil {
+			return nil, annotateParseError(err, input)
+		}
+	} else {
+		value, _, err := execLua(le.l, input)
+		if err != nil {
+			return nil, err
+		}
+
+		if value == nil {
+			return nil, fmt.Errorf("usage: %s <query>", explainCommand)
+		}
+
+		query, err = luaValueToQuery(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := le.proxyDB()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := explainQuery(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &replit.Result{
+		Output: output,
+	}, nil
+}
+
+// textQueryRE matches the start of a text query, which is evaluated with
+// ql.ParseQuery instead of being run as Lua code.
+var textQueryRE = regexp.MustCompile(`(?i)^\s*query\s+(requests|count)\b`)
+
+func isTextQuery(input string) bool {
+	return textQueryRE.MatchString(input)
+}
+
+// parseTextQuery parses a text query, with or without the leading 'query'
+// keyword. The positions of its errors refer to input.
+func parseTextQuery(input string) (*ql.Query, error) {
+	if isTextQuery(input) {
+		return ql.ParseQuery(input)
+	}
+
+	const prefix = "query "
+	query, err := ql.ParseQuery(prefix + input)
+	if parseError, ok := ql.AsParseError(err); ok {
+		parseError.Pos = max(parseError.Pos-len(prefix), 0)
+		return nil, parseError
+	}
+
+	return query, err
+}
+
+// annotateParseError adds the line of the input where a parse error was
+// found to the error, with a caret under the position of the error.
+func annotateParseError(err error, input string) error {
+	parseError, ok := ql.AsParseError(err)
+	if !ok {
+		return err
+	}
+
+	return errors.New(parseError.Annotate(input))
+}
+
+// evalQuery runs a query and returns a view with the resulting requests, or
+// the counts and endpoints as text output for count queries and queries
+// grouped by endpoint.
+func (le *luaEvaluator) evalQuery(ctx context.Context, query *ql.Query, width, height int) (*replit.Result, error) {
+	if query.Operation == ql.QueryOperationCount {
+		return le.evalCountQuery(ctx, query)
+	}
+
+	db, err := le.proxyDB()
+	if err != nil {
+		return nil, err
+	}
+
+	if query.IsEndpointsQuery() {
+		rows, err := doEndpointsQuery(ctx, db, query)
+		if err != nil {
+			return nil, err
+		}
+
+		return &replit.Result{
+			Output: endpointsResultsString(rows),
+		}, nil
+	}
+
+	pager, rows, err := le.firstPage(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return &replit.Result{
+			Output: "0 requests found",
+		}, nil
+	}
+
+	view := NewQueryResultsView(db, le.l, rows, width, height)
+	view.requestsTableView.SetColumns(le.columns)
+	view.query = query
+	view.pager = pager
+
+	return &replit.Result{
+		View: view,
+	}, nil
+}
+
+// evalTail returns a view with the results of a query that follows it from
+// the start, even if no requests match it yet.
+func (le *luaEvaluator) evalTail(ctx context.Context, query *ql.Query, width, height int) (*replit.Result, error) {
+	if query.Operation == ql.QueryOperationCount || query.IsEndpointsQuery() {
+		return nil, fmt.Errorf("only queries that get requests can be followed")
+	}
+
+	db, err := le.proxyDB()
+	if err != nil {
+		return nil, err
+	}
+
+	pager, rows, err := le.firstPage(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+
+	view := NewQueryResultsView(db, le.l, rows, width, height)
+	view.requestsTableView.SetColumns(le.columns)
+	view.query = query
+	view.pager = pager
+	view.following = true
+
+	return &replit.Result{
+		View: view,
+	}, nil
+}
+
+// firstPage loads the first page of the rows of a query. The pager it
+// returns loads the rest, and it is nil if there are no more rows.
+func (le *luaEvaluator) firstPage(ctx context.Context, db *sql.DB, query *ql.Query) (*requestPager, []RequestsTableRow, error) {
+	pager, err := newRequestPager(db, query, le.columns)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := pager.next(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pager.done {
+		return nil, rows, nil
+	}
+
+	return pager, rows, nil
+}
+
+// evalTrace returns a view with the trace of a value.
+func (le *luaEvaluator) evalTrace(ctx context.Context, value string, width, height int) (*replit.Result, error) {
+	db, err := le.proxyDB()
+	if err != nil {
+		return nil, err
+	}
+
+	steps, err := doTraceQuery(ctx, db, value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(steps) == 0 {
+		return &replit.Result{
+			Output: fmt.Sprintf("'%s' not found in any request or response", value),
+		}, nil
+	}
+
+	return &replit.Result{
+		View: newTraceResultsView(db, le.l, value, steps, width, height),
+	}, nil
+}
+
+func (le *luaEvaluator) evalCountQuery(ctx context.Context, query *ql.Query) (*replit.Result, error) {
+	db, err := le.proxyDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := doCountQuery(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(query.GroupBy) == 0 {
+		count := 0
+		if len(rows) > 0 {
+			count = rows[0].count
+		}
+
+		return &replit.Result{
+			Output: fmt.Sprintf("%d requests found", count),
+		}, nil
+	}
+
+	return &replit.Result{
+		Output: countResultsString(query.GroupBy, rows),
+	}, nil
+}
+
 func execLua(L *lua.LState, code string) (lua.LValue, string, error) {
 	oldTop := L.GetTop()
 	defer L.SetTop(oldTop)
@@ -131,21 +581,124 @@ func execLua(L *lua.LState, code string) (lua.LValue, string, error) {
 	return resultValue, strings.Join(prints, "\n"), nil
 }
 
-func (le *luaEvaluator) toQuery(t *lua.LTable) (*ql.Query, error) {
+func toQuery(t *lua.LTable) (*ql.Query, error) {
 	query := &ql.Query{
 		Operation: ql.QueryOperationGet,
 	}
-	_ = query
 
-	condition, err := toRequestCondition(t)
+	operation := t.RawGet(lua.LString("operation"))
+	if operation == lua.LNil {
+		condition, err := toRequestCondition(t)
+		if err != nil {
+			return nil, err
+		}
+
+		query.RequestCondition = condition
+		return query, nil
+	}
+
+	switch operation.String() {
+	case "get":
+	case "count":
+		query.Operation = ql.QueryOperationCount
+	default:
+		return nil, fmt.Errorf("invalid query operation '%s'", operation.String())
+	}
+
+	if groupBy, ok := t.RawGet(lua.LString("group_by")).(*lua.LTable); ok {
+		for i := 1; i <= groupBy.Len(); i++ {
+			field := strings.ToLower(groupBy.RawGetInt(i).String())
+			if !ql.IsGroupByField(field) {
+				return nil, fmt.Errorf("invalid group by field '%s'", field)
+			}
+			query.GroupBy = append(query.GroupBy, field)
+		}
+	}
+
+	if orderBy, ok := t.RawGet(lua.LString("order")).(*lua.LTable); ok {
+		for i := 1; i <= orderBy.Len(); i++ {
+			o, ok := orderBy.RawGetInt(i).(*lua.LTable)
+			if !ok {
+				return nil, fmt.Errorf("invalid order by entry")
+			}
+
+			field := strings.ToLower(o.RawGet(lua.LString("field")).String())
+			if !ql.IsOrderByField(field) {
+				return nil, fmt.Errorf("invalid order by field '%s'", field)
+			}
+
+			query.OrderBy = append(query.OrderBy, ql.OrderBy{
+				Field:      field,
+				Descending: o.RawGet(lua.LString("direction")).String() == "desc",
+			})
+		}
+	}
+
+	if limit, ok := t.RawGet(lua.LString("row_limit")).(lua.LNumber); ok {
+		query.Limit = int(limit)
+	}
+
+	if offset, ok := t.RawGet(lua.LString("row_offset")).(lua.LNumber); ok {
+		query.Offset = int(offset)
+	}
+
+	if where, ok := t.RawGet(lua.LString("where")).(*lua.LTable); ok {
+		condition, err := toRequestCondition(where)
+		if err != nil {
+			return nil, err
+		}
+		query.RequestCondition = condition
+	}
+
+	if setOps, ok := t.RawGet(lua.LString("set_ops")).(*lua.LTable); ok {
+		for i := 1; i <= setOps.Len(); i++ {
+			o, ok := setOps.RawGetInt(i).(*lua.LTable)
+			if !ok {
+				return nil, fmt.Errorf("invalid set operation entry")
+			}
+
+			operator := o.RawGet(lua.LString("op")).String()
+			operand, ok := o.RawGet(lua.LString("query")).(*lua.LTable)
+			if !ok {
+				return nil, fmt.Errorf("invalid operand for %s", operator)
+			}
+
+			operandQuery, err := toOperandQuery(operand)
+			if err != nil {
+				return nil, err
+			}
+
+			query.SetOperations = append(query.SetOperations, ql.SetOperation{
+				Operator: operator,
+				Query:    operandQuery,
+			})
+		}
+	}
+
+	return query, nil
+}
+
+// toOperandQuery converts the operand of a set operation or a subquery,
+// which can only have conditions and set operations.
+func toOperandQuery(t *lua.LTable) (*ql.Query, error) {
+	query, err := toQuery(t)
 	if err != nil {
 		return nil, err
 	}
 
-	query.RequestCondition = condition
+	if query.Operation != ql.QueryOperationGet || len(query.OrderBy) > 0 || query.Limit > 0 || query.Offset > 0 {
+		return nil, fmt.Errorf("subqueries and set operation operands can only have conditions")
+	}
+
 	return query, nil
 }
 
+// isQueryTable reports whether t is an expression or a query built with the
+// DSL, as opposed to a list of values.
+func isQueryTable(t *lua.LTable) bool {
+	return t.RawGet(lua.LString("op")) != lua.LNil || t.RawGet(lua.LString("operation")) != lua.LNil
+}
+
 func toRequestCondition(t *lua.LTable) (ql.RequestCondition, error) {
 	op := t.RawGet(lua.LString("op"))
 	if op == lua.LNil {
@@ -220,65 +773,156 @@ func toRequestCondition(t *lua.LTable) (ql.RequestCondition, error) {
 	}
 
 	value := t.RawGet(lua.LString("value"))
-	if value == lua.LNil {
+	if value == lua.LNil && op.String() != "exists" {
 		return nil, fmt.Errorf("the query is missing a value")
 	}
 
+	// The in operator takes a list of values instead of a single one
+	var values []string
+	if op.String() == "in" {
+		list, ok := value.(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("the in operator requires a list of values")
+		}
+
+		if isQueryTable(list) {
+			return toSubqueryCondition(field.String(), list)
+		}
+
+		for i := 1; i <= list.Len(); i++ {
+			values = append(values, list.RawGetInt(i).String())
+		}
+	}
+
+	// Headers compared as numbers, with as_number()
+	if t.RawGet(lua.LString("as_number")) == lua.LTrue {
+		n, numbers, err := toNumberValues(field.String(), op.String(), value, values)
+		if err != nil {
+			return nil, err
+		}
+
+		if name, ok := strings.CutPrefix(field.String(), "header:"); ok {
+			return &ql.RequestHeaderNumberCondition{
+				UniqueID: strconv.Itoa(rand.Int()),
+				Name:     name,
+				Operator: op.String(),
+				Value:    n,
+				Values:   numbers,
+			}, nil
+		}
+
+		if name, ok := strings.CutPrefix(field.String(), "resp_header:"); ok {
+			return &ql.RequestResponseHeaderNumberCondition{
+				UniqueID: strconv.Itoa(rand.Int()),
+				Name:     name,
+				Operator: op.String(),
+				Value:    n,
+				Values:   numbers,
+			}, nil
+		}
+
+		return nil, fmt.Errorf("as_number can only be used with headers, not '%s'", field.String())
+	}
+
 	switch field.String() {
 	case "id":
-		return &ql.RequestIdCondition{Id: value.String(), Operator: op.String()}, nil
+		return &ql.RequestIdCondition{Id: value.String(), Ids: values, Operator: op.String()}, nil
 
 	case "timestamp":
-		end := len(value.String()) - 1
-		vstr := value.String()
-		d, err := strconv.Atoi(vstr[:end])
+		tsValue, err := toTimestampValue(value)
 		if err != nil {
-			return nil, fmt.Errorf("invalid duration value '%s'", value.String())
+			return nil, err
 		}
 
-		tk := time.Duration(d)
-		switch vstr[end] {
-		case 's':
-			tk *= time.Second
-		case 'm':
-			tk *= time.Minute
-		case 'h':
-			tk *= time.Hour
-		case 'd':
-			tk *= time.Hour * 24
-		default:
-			return nil, fmt.Errorf("invalid duration suffix: '%c'", vstr[end])
+		cond := &ql.RequestTimestampCondition{Value: tsValue, Operator: op.String()}
+		if op.String() == "between" {
+			value2 := t.RawGet(lua.LString("value2"))
+			if value2 == lua.LNil {
+				return nil, fmt.Errorf("between requires two timestamp values")
+			}
+
+			cond.End, err = toTimestampValue(value2)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		return &ql.RequestTimestampCondition{TimeAgo: tk, Operator: op.String()}, nil
+		return cond, nil
 
 	case "path":
-		return &ql.RequestPathCondition{Value: value.String(), Operator: op.String()}, nil
+		return &ql.RequestPathCondition{Value: value.String(), Values: values, Operator: op.String()}, nil
+
+	case "endpoint":
+		return &ql.RequestEndpointCondition{Value: value.String(), Values: values, Operator: op.String()}, nil
+
+	case "url":
+		return &ql.RequestURLCondition{Value: value.String(), Values: values, Operator: op.String()}, nil
+
+	case "host":
+		return &ql.RequestHostCondition{Value: value.String(), Values: values, Operator: op.String()}, nil
+
+	case "scheme":
+		return &ql.RequestSchemeCondition{Value: value.String(), Values: values, Operator: op.String()}, nil
+
+	case "query_string":
+		return &ql.RequestQueryStringCondition{Value: value.String(), Values: values, Operator: op.String()}, nil
+
+	case "port":
+		port, ports, err := toNumberValues("port", op.String(), value, values)
+		if err != nil {
+			return nil, err
+		}
+		return &ql.RequestPortCondition{Value: port, Values: ports, Operator: op.String()}, nil
 
 	case "method":
-		return &ql.RequestMethodCondition{Value: strings.ToUpper(value.String())}, nil
+		switch op.String() {
+		case "eq", "ne", "in":
+			for i := range values {
+				values[i] = strings.ToUpper(values[i])
+			}
+			return &ql.RequestMethodCondition{Value: strings.ToUpper(value.String()), Values: values, Operator: op.String()}, nil
+		}
+		return &ql.RequestMethodCondition{Value: value.String(), Operator: op.String()}, nil
 
 	case "body":
-		return &ql.RequestBodyCondition{Value: value.String(), Operator: op.String()}, nil
+		return &ql.RequestBodyCondition{Value: value.String(), Values: values, Operator: op.String()}, nil
 
 	case "raw":
 		return &ql.RequestRawCondition{
 			UniqueID: strconv.Itoa(rand.Int()),
+			Operator: op.String(),
 			Value:    value.String(),
 		}, nil
 
 	case "resp_status":
-		status, err := strconv.Atoi(value.String())
+		if op.String() == "class" {
+			class, err := ql.ParseStatusClass(value.String())
+			if err != nil {
+				return nil, err
+			}
+			return &ql.RequestResponseStatusCondition{Value: class, Operator: op.String()}, nil
+		}
+
+		status, statuses, err := toNumberValues("status", op.String(), value, values)
+		if err != nil {
+			return nil, err
+		}
+		return &ql.RequestResponseStatusCondition{Value: status, Values: statuses, Operator: op.String()}, nil
+
+	case "req_size", "resp_size", "header_count", "resp_header_count":
+		n, numbers, err := toNumberValues(field.String(), op.String(), value, values)
 		if err != nil {
-			return nil, fmt.Errorf("invalid status value '%s'", value.String())
+			return nil, err
 		}
-		return &ql.RequestResponseStatusCondition{Value: status, Operator: op.String()}, nil
+		return &ql.RequestNumericFieldCondition{Field: field.String(), Value: n, Values: numbers, Operator: op.String()}, nil
+
 	case "resp_body":
-		return &ql.RequestResponseBodyCondition{Value: value.String(), Operator: op.String()}, nil
+		return &ql.RequestResponseBodyCondition{Value: value.String(), Values: values, Operator: op.String()}, nil
 
 	case "resp_raw":
 		return &ql.RequestResponseRawCondition{
 			UniqueID: strconv.Itoa(rand.Int()),
+			Operator: op.String(),
 			Value:    value.String(),
 		}, nil
 
@@ -290,9 +934,42 @@ func toRequestCondition(t *lua.LTable) (ql.RequestCondition, error) {
 				Name:     name,
 				Operator: op.String(),
 				Value:    value.String(),
+				Values:   values,
 			}, nil
 		}
 
+		if strings.HasPrefix(field.String(), "param:") {
+			name := strings.TrimPrefix(field.String(), "param:")
+			return &ql.RequestParamCondition{
+				Name:     name,
+				Operator: op.String(),
+				Value:    value.String(),
+				Values:   values,
+			}, nil
+		}
+
+		if format, name, ok := strings.Cut(field.String(), ":"); ok {
+			switch format {
+			case ql.BodyFormatForm, ql.BodyFormatMultipart, ql.BodyFormatJSON:
+				return &ql.RequestBodyParamCondition{
+					Format:   format,
+					Name:     name,
+					Operator: op.String(),
+					Value:    value.String(),
+					Values:   values,
+				}, nil
+
+			case "resp_" + ql.BodyFormatForm, "resp_" + ql.BodyFormatMultipart, "resp_" + ql.BodyFormatJSON:
+				return &ql.RequestResponseBodyParamCondition{
+					Format:   strings.TrimPrefix(format, "resp_"),
+					Name:     name,
+					Operator: op.String(),
+					Value:    value.String(),
+					Values:   values,
+				}, nil
+			}
+		}
+
 		if strings.HasPrefix(field.String(), "resp_header:") {
 			name := strings.TrimPrefix(field.String(), "resp_header:")
 			return &ql.RequestResponseHeaderCondition{
@@ -300,9 +977,67 @@ func toRequestCondition(t *lua.LTable) (ql.RequestCondition, error) {
 				Name:     name,
 				Operator: op.String(),
 				Value:    value.String(),
+				Values:   values,
 			}, nil
 		}
 
-		return nil, fmt.Errorf("invalid field '%s'", op.String())
+		return nil, fmt.Errorf("invalid field '%s'", field.String())
+	}
+}
+
+// toSubqueryCondition converts conditions like
+// q.path.in_(q.resp_status.eq(403)).
+func toSubqueryCondition(field string, t *lua.LTable) (ql.RequestCondition, error) {
+	if field == "resp_status" {
+		field = "status"
+	}
+
+	if !ql.IsSubqueryField(field) {
+		return nil, fmt.Errorf("field '%s' cannot be compared with a subquery", field)
+	}
+
+	query, err := toOperandQuery(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ql.RequestSubqueryCondition{Field: field, Query: query}, nil
+}
+
+// toNumberValues converts the value of a numeric condition, or its list of
+// values for the in operator, into integers.
+func toNumberValues(field, operator string, value lua.LValue, values []string) (int, []int, error) {
+	if operator == "in" {
+		numbers := []int{}
+		for _, v := range values {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, nil, fmt.Errorf("invalid %s value '%s'", field, v)
+			}
+			numbers = append(numbers, n)
+		}
+		return 0, numbers, nil
+	}
+
+	n, err := strconv.Atoi(value.String())
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid %s value '%s'", field, value.String())
+	}
+
+	return n, nil, nil
+}
+
+// toTimestampValue converts a duration or ISO-8601 string, or a table
+// created with q.request_time(id), into a timestamp value.
+func toTimestampValue(value lua.LValue) (ql.TimestampValue, error) {
+	if t, ok := value.(*lua.LTable); ok {
+		id := t.RawGet(lua.LString("request_id"))
+		if id == lua.LNil {
+			return ql.TimestampValue{}, fmt.Errorf("invalid timestamp value")
+		}
+
+		return ql.TimestampValue{RequestId: id.String()}, nil
 	}
+
+	return ql.ParseTimestampValue(value.String())
 }
@@ -0,0 +1,274 @@
+package repl
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/artilugio0/efin-suite/internal/ql/qltest"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaQueryIDs evaluates a Lua query expression and returns the ids of the
+// requests it matches.
+func luaQueryIDs(t *testing.T, le *luaEvaluator, expr string) ([]string, error) {
+	t.Helper()
+
+	value, _, err := execLua(le.l, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	table, ok := value.(*lua.LTable)
+	if !ok {
+		t.Fatalf("%s: expected a query, got %s", expr, value)
+	}
+
+	query, err := toQuery(table)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := le.proxyDB()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := doRequestQuery(context.Background(), db, query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := rowIDs(rows)
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func TestIsTextQuery(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{input: "query requests where method eq POST", expected: true},
+		{input: "  QUERY count group by host", expected: true},
+		{input: "query requests", expected: true},
+		{input: "query responses where status eq 200", expected: false},
+		{input: "query requestsx", expected: false},
+		{input: "query(q.method.eq('POST'))", expected: false},
+		{input: "print('query requests')", expected: false},
+	}
+
+	for _, test := range tests {
+		if got := isTextQuery(test.input); got != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.input, test.expected, got)
+		}
+	}
+}
+
+func TestEvalTextQuery(t *testing.T) {
+	le := newTestEvaluator(t, fixtureDBFile)
+
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{input: "query requests", expected: []string{"4", "3", "2", "1"}},
+		{input: "query requests where method = POST", expected: []string{"4", "2"}},
+		{input: "Query Requests where path contains 'api' order by id limit 2", expected: []string{"1", "2"}},
+	}
+
+	for _, test := range tests {
+		result, err := le.Eval(test.input)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+			continue
+		}
+
+		view, ok := result.View.(*QueryResultsView)
+		if !ok {
+			t.Errorf("%q: expected a query results view, got %#v", test.input, result)
+			continue
+		}
+
+		if ids := rowIDs(view.requestsTableView.rows); !slices.Equal(ids, test.expected) {
+			t.Errorf("%q: expected rows %v, got %v", test.input, test.expected, ids)
+		}
+	}
+}
+
+func TestEvalTextCountQuery(t *testing.T) {
+	le := newTestEvaluator(t, fixtureDBFile)
+
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{input: "query count", expected: []string{"4 requests found"}},
+		{input: "query requests where method = PUT", expected: []string{"0 requests found"}},
+		{input: "query count where method = GET group by host", expected: []string{"example.com", "other.org"}},
+	}
+
+	for _, test := range tests {
+		result, err := le.Eval(test.input)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.input, err)
+			continue
+		}
+
+		for _, e := range test.expected {
+			if !strings.Contains(result.Output, e) {
+				t.Errorf("%q: expected output with %q, got %q", test.input, e, result.Output)
+			}
+		}
+	}
+}
+
+func TestEvalTextQueryErrors(t *testing.T) {
+	le := newTestEvaluator(t, fixtureDBFile)
+
+	for _, input := range []string{
+		"query requests where",
+		"query requests where method = GET limit",
+		"query count group by body",
+	} {
+		if _, err := le.Eval(input); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestLuaOperatorMatrix(t *testing.T) {
+	dbFile, _ := qltest.NewDB(t, qltest.Requests)
+	le := newTestEvaluator(t, dbFile)
+
+	for _, test := range qltest.OperatorMatrix {
+		t.Run(test.Lua, func(t *testing.T) {
+			ids, err := luaQueryIDs(t, le, test.Lua)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expected := make([]string, len(test.Want))
+			for i, id := range test.Want {
+				expected[i] = strconv.Itoa(id)
+			}
+
+			if !slices.Equal(ids, expected) {
+				t.Errorf("expected rows %v, got %v", expected, ids)
+			}
+		})
+	}
+}
+
+func TestLuaInvalidOperators(t *testing.T) {
+	dbFile, _ := qltest.NewDB(t, qltest.Requests)
+	le := newTestEvaluator(t, dbFile)
+
+	// The DSL builds a condition for any operator, which is rejected when
+	// the query is compiled
+	for _, expr := range []string{
+		"q.id.contains('1')",
+		"q.timestamp.in_({'2024-01-01'})",
+		"q.method.gt('GET')",
+		"q.method.exists()",
+		"q.body.exists()",
+		"q.header('host').between('a', 'b')",
+		"q.raw.eq('a')",
+		"q.resp_status.contains(2)",
+		"q.resp_status.matches('^2')",
+		"q.resp_header('location').lt('a')",
+		"q.path.matches('(')",
+	} {
+		if _, err := luaQueryIDs(t, le, expr); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	le := newTestEvaluator(t, fixtureDBFile)
+
+	for _, def := range []string{
+		"defq('api_of', function(host) return q.header('host').eq(host).and_(q.path.contains('/api/')) end)",
+		"defq('api_posts_of', function(host) return q.api_of(host).and_(q.method.eq('POST')) end)",
+		"defq('failed', function() return q.resp_status.ge(500) end)",
+		"defq('whole_query', function() return q.method.eq('GET'):limit(1) end)",
+	} {
+		if _, _, err := execLua(le.l, def); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		expr     string
+		expected []string
+		err      bool
+	}{
+		{expr: "q.api_of('example.com')", expected: []string{"1", "2", "4"}},
+		{expr: "q.api_of('example.com').and_(q.method.eq('GET'))", expected: []string{"1"}},
+		{expr: "q.api_posts_of('example.com')", expected: []string{"2", "4"}},
+		{expr: "q.api_of('other.org').or_(q.failed())", expected: []string{"3"}},
+		{expr: "q.failed():limit(1)", expected: []string{"3"}},
+		{expr: "q.failed().or_(q.api_posts_of('example.com'))", expected: []string{"2", "3", "4"}},
+		{expr: "q.method.eq('GET').and_(q.api_of('example.com'))", expected: []string{"1"}},
+		{expr: "q.not_(q.api_of('example.com'))", expected: []string{"3"}},
+		{expr: "q.not_(q.failed()).and_(q.api_of('example.com'))", expected: []string{"1", "2", "4"}},
+		{expr: "q.unknown('x')", err: true},
+		{expr: "q.whole_query()", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			ids, err := luaQueryIDs(t, le, test.expr)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", ids)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(ids, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, ids)
+			}
+		})
+	}
+
+	if _, _, err := execLua(le.l, "undefq('failed')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := luaQueryIDs(t, le, "q.failed()"); err == nil {
+		t.Error("expected an error using a removed macro")
+	}
+	if names := le.macroNames(); !slices.Equal(names, []string{"api_of", "api_posts_of", "whole_query"}) {
+		t.Errorf("expected the macros api_of, api_posts_of and whole_query, got %v", names)
+	}
+}
+
+func TestMacroSuggestions(t *testing.T) {
+	le := newTestEvaluator(t, fixtureDBFile)
+
+	if _, _, err := execLua(le.l, "defq('posts', function() return q.method.eq('POST') end)"); err != nil {
+		t.Fatal(err)
+	}
+	if suggestions := le.macroSuggestions(); !slices.Equal(suggestions, []string{"q.posts("}) {
+		t.Errorf("expected a suggestion for posts, got %v", suggestions)
+	}
+	if suggestions := le.macroSuggestions(); len(suggestions) != 0 {
+		t.Errorf("expected no new suggestions, got %v", suggestions)
+	}
+
+	// Macros defined in the REPL are suggested after the input is evaluated
+	if _, err := le.Eval("defq('gets', function() return q.method.eq('GET') end)"); err != nil {
+		t.Fatal(err)
+	}
+	if !le.suggestedMacros["gets"] {
+		t.Error("expected a suggestion for the macro defined in the REPL")
+	}
+	if suggestions := le.macroSuggestions(); len(suggestions) != 0 {
+		t.Errorf("expected no new suggestions, got %v", suggestions)
+	}
+}
@@ -0,0 +1,141 @@
+package repl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/artilugio0/efin-suite/internal/ql/qltest"
+	"github.com/artilugio0/replit"
+)
+
+var fixtureRequests = []qltest.Request{
+	{
+		ID:          1,
+		Method:      "GET",
+		URL:         "https://example.com/api/users?id=1",
+		Timestamp:   "2024-01-01 10:00:00",
+		Status:      200,
+		RespBody:    `{"id":1,"name":"alice","session":"s3cr3t"}`,
+		Headers:     [][2]string{{"Host", "example.com"}},
+		RespHeaders: [][2]string{{"Content-Type", "application/json"}, {"Set-Cookie", "session=s3cr3t"}},
+	},
+	{
+		ID:          2,
+		Method:      "POST",
+		URL:         "https://example.com/api/login",
+		Body:        "user=alice&pass=a%26b",
+		Timestamp:   "2024-01-01 11:00:00",
+		Status:      302,
+		Headers:     [][2]string{{"Host", "example.com"}, {"Content-Type", "application/x-www-form-urlencoded"}, {"Cookie", "session=s3cr3t"}},
+		RespHeaders: [][2]string{{"Location", "/home"}},
+	},
+	{
+		ID:          3,
+		Method:      "GET",
+		URL:         "https://other.org/home",
+		Timestamp:   "2024-01-01 12:00:00",
+		Status:      500,
+		RespBody:    "<html><body><p>error</p></body></html>",
+		Headers:     [][2]string{{"Host", "other.org"}},
+		RespHeaders: [][2]string{{"Content-Type", "text/html"}},
+	},
+	{
+		ID:          4,
+		Method:      "POST",
+		URL:         "https://example.com/api/items?session=s3cr3t",
+		Body:        `{"name":"item"}`,
+		Timestamp:   "2024-01-01 13:00:00",
+		Status:      201,
+		RespBody:    `{"id":4}`,
+		Headers:     [][2]string{{"Host", "example.com"}, {"Content-Type", "application/json"}},
+		RespHeaders: [][2]string{{"Content-Type", "application/json"}},
+	},
+}
+
+// fixtureDBFile is a DB with fixtureRequests, shared by the tests that do
+// not change it, and fixtureDB is its handle.
+var (
+	fixtureDBFile string
+	fixtureDB     *sql.DB
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "repl-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fixtureDBFile = filepath.Join(dir, "proxy.db")
+	if err := qltest.CreateDB(fixtureDBFile, fixtureRequests); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	fixtureDB, err = openDB(fixtureDBFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	fixtureDB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// rowIDs returns the ids of rows, in order.
+func rowIDs(rows []RequestsTableRow) []string {
+	ids := make([]string, len(rows))
+	for i, r := range rows {
+		ids[i] = r.ID
+	}
+
+	return ids
+}
+
+// newTestEvaluator creates a Lua evaluator for the requests of dbFile, with
+// an empty suite DB, in a REPL so it can show the results of queries.
+func newTestEvaluator(t *testing.T, dbFile string) *luaEvaluator {
+	t.Helper()
+
+	le, err := newLuaEvaluator(dbFile, filepath.Join(t.TempDir(), "suite.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	le.repl = replit.NewREPL(le)
+	t.Cleanup(le.Close)
+
+	return le
+}
+
+// newFixtureDB creates a DB with fixtureRequests for a test that changes
+// it, and returns its file and a handle to it.
+func newFixtureDB(t *testing.T) (string, *sql.DB) {
+	t.Helper()
+
+	return qltest.NewDB(t, fixtureRequests)
+}
+
+// queryRows runs a text query and returns its rows.
+func queryRows(t *testing.T, db *sql.DB, input string) []RequestsTableRow {
+	t.Helper()
+
+	query, err := parseTextQuery(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := doRequestQuery(context.Background(), db, query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rows
+}
@@ -0,0 +1,276 @@
+package repl
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+
+	"github.com/artilugio0/efin-suite/internal/ql"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// pageSize is the number of rows of query results loaded at a time.
+const pageSize = 200
+
+// pageThreshold is how close to the last loaded row the cursor has to be
+// for the next page to be loaded.
+const pageThreshold = 50
+
+// prefetchRows is the number of rows after the cursor whose requests and
+// responses are loaded in the background.
+const prefetchRows = 3
+
+// detailsCache keeps the requests and responses that were shown most
+// recently, evicting the least recently used ones.
+type detailsCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[detailsKey]*list.Element
+	order    *list.List
+}
+
+// detailsKey identifies a request by its id and the DB it is in.
+type detailsKey struct {
+	db *sql.DB
+	id string
+}
+
+type detailsEntry struct {
+	key  detailsKey
+	req  *requestEntry
+	resp *responseEntry
+}
+
+func newDetailsCache(capacity int) *detailsCache {
+	return &detailsCache{
+		capacity: capacity,
+		entries:  map[detailsKey]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (c *detailsCache) get(key detailsKey) (*requestEntry, *responseEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	c.order.MoveToFront(e)
+
+	entry := e.Value.(*detailsEntry)
+	return entry.req, entry.resp, true
+}
+
+func (c *detailsCache) put(key detailsKey, req *requestEntry, resp *responseEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		e.Value = &detailsEntry{key: key, req: req, resp: resp}
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&detailsEntry{key: key, req: req, resp: resp})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*detailsEntry).key)
+	}
+}
+
+var requestDetails = newDetailsCache(256)
+
+// getCachedRequestResponse returns a request and its response from the
+// details cache, loading them from the DB if they are not there.
+func getCachedRequestResponse(db *sql.DB, id string) (*requestEntry, *responseEntry, error) {
+	key := detailsKey{db: db, id: id}
+	if req, resp, ok := requestDetails.get(key); ok {
+		return req, resp, nil
+	}
+
+	req, resp, err := getRequestResponse(db, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	requestDetails.put(key, req, resp)
+
+	return req, resp, nil
+}
+
+// prefetchDetails loads the requests and responses with the given ids into
+// the details cache in the background.
+func prefetchDetails(db *sql.DB, ids []string) tea.Cmd {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return func() tea.Msg {
+		for _, id := range ids {
+			// Errors are shown when the rows are selected
+			getCachedRequestResponse(db, id)
+		}
+		return nil
+	}
+}
+
+// requestPager loads the results of a query a page at a time, getting each
+// page from where the previous one ended instead of skipping rows with an
+// offset.
+type requestPager struct {
+	db      *sql.DB
+	query   *ql.Query
+	columns []string
+	keySize int
+
+	key    ql.PageKey
+	loaded int
+	done   bool
+}
+
+// pageMsg has the next page of the rows of a query results view, loaded
+// by pager. The rows replace the ones of the view if first is set.
+type pageMsg struct {
+	pager *requestPager
+	first bool
+	rows  []RequestsTableRow
+	err   error
+}
+
+// countMsg has the number of rows of the query of a query results view.
+type countMsg struct {
+	count int
+	err   error
+}
+
+// newRequestPager creates a pager for the results of a query, with the
+// values of the columns that are not default columns.
+func newRequestPager(db *sql.DB, query *ql.Query, columns []string) (*requestPager, error) {
+	keySize, err := query.PageKeySize()
+	if err != nil {
+		return nil, err
+	}
+
+	return &requestPager{
+		db:      db,
+		query:   query,
+		columns: extraColumns(columns),
+		keySize: keySize,
+	}, nil
+}
+
+// next returns the next page of rows, which is empty once all of them were
+// loaded.
+func (p *requestPager) next(ctx context.Context) ([]RequestsTableRow, error) {
+	if p.done {
+		return nil, nil
+	}
+
+	// The offset of the query only skips rows of the first page, and its
+	// limit is the number of rows of all the pages
+	limit := pageSize
+	offset := 0
+	if p.key == nil {
+		offset = p.query.Offset
+	}
+	if p.query.Limit > 0 {
+		limit = min(limit, p.query.Limit-p.loaded)
+	}
+	if limit <= 0 {
+		p.done = true
+		return nil, nil
+	}
+
+	compiled, values, err := p.query.CompilePage(p.columns, p.key, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.QueryContext(ctx, compiled, values...)
+	if err != nil {
+		return nil, queryError(err)
+	}
+	defer rows.Close()
+
+	result := []RequestsTableRow{}
+	key := make(ql.PageKey, p.keySize)
+	for rows.Next() {
+		row, err := scanRequestRow(rows, p.columns, key)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(result) > 0 {
+		p.key = key
+	}
+	p.loaded += len(result)
+	p.done = len(result) < limit || (p.query.Limit > 0 && p.loaded >= p.query.Limit)
+
+	return result, nil
+}
+
+// count returns the number of rows of all the pages.
+func (p *requestPager) count(ctx context.Context) (int, error) {
+	countQuery := *p.query
+	countQuery.Operation = ql.QueryOperationCount
+	countQuery.GroupBy = nil
+	countQuery.OrderBy = nil
+	countQuery.Limit = 0
+	countQuery.Offset = 0
+
+	compiled, values, err := countQuery.Compile()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	if err := p.db.QueryRowContext(ctx, compiled, values...).Scan(&count); err != nil {
+		return 0, queryError(err)
+	}
+
+	count = max(0, count-p.query.Offset)
+	if p.query.Limit > 0 {
+		count = min(count, p.query.Limit)
+	}
+
+	return count, nil
+}
+
+// scanRequestRow scans a row with the timestamp, id, method, status code and
+// URL of a request, followed by the values of the extra columns and the
+// values of key, if any.
+func scanRequestRow(rows *sql.Rows, extra []string, key ql.PageKey) (RequestsTableRow, error) {
+	var status int
+	row := RequestsTableRow{}
+	extraValues := make([]sql.NullString, len(extra))
+	dest := []any{&row.Timestamp, &row.ID, &row.Method, &status, &row.URL}
+	for i := range extraValues {
+		dest = append(dest, &extraValues[i])
+	}
+	for i := range key {
+		dest = append(dest, &key[i])
+	}
+
+	if err := rows.Scan(dest...); err != nil {
+		return RequestsTableRow{}, err
+	}
+
+	row.Status = strconv.Itoa(status)
+	if len(extra) > 0 {
+		row.Columns = map[string]string{}
+		for i, c := range extra {
+			row.Columns[c] = extraValues[i].String
+		}
+	}
+
+	return row, nil
+}
@@ -0,0 +1,309 @@
+package repl
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+
+	"github.com/artilugio0/efin-testifier/pkg/liblua"
+	"github.com/charmbracelet/lipgloss"
+	"golang.org/x/net/html"
+)
+
+// prettyBodyLimit is the size of the biggest body that is pretty printed.
+// Bigger bodies are shown raw, so moving through the results of a query
+// stays fast.
+const prettyBodyLimit = 2 << 20
+
+var (
+	keyStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("75"))
+	stringStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("114"))
+	numberStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("215"))
+	literalStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("176"))
+	tagStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("75"))
+	commentStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("244"))
+)
+
+// prettyBody formats a body for its content type: JSON is indented and
+// colorized, XML and HTML are indented, and form bodies have a parameter per
+// line. Bodies of other types, or that cannot be parsed as their type, are
+// returned as they are.
+func prettyBody(headers []liblua.HeaderEntry, body string) string {
+	if body == "" || len(body) > prettyBodyLimit {
+		return body
+	}
+
+	mediaType := ""
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, "Content-Type") {
+			mediaType, _, _ = mime.ParseMediaType(h.Value)
+			break
+		}
+	}
+
+	var (
+		output string
+		err    error
+	)
+	switch {
+	case strings.Contains(mediaType, "json"):
+		output, err = prettyJSON(body)
+	case mediaType == "text/html":
+		output, err = prettyHTML(body)
+	case strings.Contains(mediaType, "xml"):
+		output, err = prettyXML(body)
+	case mediaType == "application/x-www-form-urlencoded":
+		output = prettyForm(body)
+	case mediaType == "" || mediaType == "text/plain":
+		// Many APIs do not set the content type of their JSON bodies
+		trimmed := strings.TrimSpace(body)
+		if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+			return body
+		}
+		output, err = prettyJSON(body)
+	default:
+		return body
+	}
+
+	if err != nil {
+		return body
+	}
+
+	return output
+}
+
+// prettyJSON indents a JSON body, with different colors for keys, strings,
+// numbers and true, false and null.
+func prettyJSON(body string) (string, error) {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, []byte(body), "", "  "); err != nil {
+		return "", err
+	}
+
+	src := indented.String()
+	var buf strings.Builder
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+
+			// Keys are the strings followed by a colon, which json.Indent
+			// writes right after them
+			style := stringStyle
+			if end < len(src) && src[end] == ':' {
+				style = keyStyle
+			}
+			buf.WriteString(style.Render(src[i:end]))
+			i = end
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + strings.IndexFunc(src[i:]+" ", func(r rune) bool {
+				return !strings.ContainsRune("-+.eE0123456789", r)
+			})
+			buf.WriteString(numberStyle.Render(src[i:end]))
+			i = end
+
+		case c == 't' || c == 'f' || c == 'n':
+			end := i + strings.IndexFunc(src[i:]+" ", func(r rune) bool {
+				return r < 'a' || r > 'z'
+			})
+			buf.WriteString(literalStyle.Render(src[i:end]))
+			i = end
+
+		default:
+			buf.WriteByte(c)
+			i++
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// prettyXML indents an XML body, with an element or text per line. Elements
+// without content are written as empty elements.
+func prettyXML(body string) (string, error) {
+	var buf strings.Builder
+	depth := 0
+	writeLine := func(s string) {
+		buf.WriteString(strings.Repeat("  ", depth))
+		buf.WriteString(s)
+		buf.WriteString("\n")
+	}
+
+	// open is the last start element, which is written when the next token
+	// shows whether it has content
+	var open *xml.StartElement
+	writeOpen := func() {
+		if open != nil {
+			writeLine(tagStyle.Render("<" + startTag(*open) + ">"))
+			depth++
+			open = nil
+		}
+	}
+
+	// Raw tokens keep the prefixes of the names, which are replaced by
+	// namespace URLs in the ones of Token
+	d := xml.NewDecoder(strings.NewReader(body))
+	for {
+		token, err := d.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			writeOpen()
+			t = t.Copy()
+			open = &t
+
+		case xml.EndElement:
+			if open != nil {
+				writeLine(tagStyle.Render("<" + startTag(*open) + "/>"))
+				open = nil
+				continue
+			}
+			depth = max(0, depth-1)
+			writeLine(tagStyle.Render("</" + xmlName(t.Name) + ">"))
+
+		case xml.CharData:
+			for _, line := range strings.Split(string(t), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					writeOpen()
+					writeLine(xmlTextEscaper.Replace(line))
+				}
+			}
+
+		case xml.Comment:
+			writeOpen()
+			writeLine(commentStyle.Render("<!--" + string(t) + "-->"))
+
+		case xml.ProcInst:
+			writeOpen()
+			writeLine(tagStyle.Render("<?" + t.Target + " " + string(t.Inst) + "?>"))
+
+		case xml.Directive:
+			writeOpen()
+			writeLine(tagStyle.Render("<!" + string(t) + ">"))
+		}
+	}
+	writeOpen()
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+var xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// startTag returns the name and attributes of a start element.
+func startTag(e xml.StartElement) string {
+	tag := xmlName(e.Name)
+	for _, a := range e.Attr {
+		tag += " " + xmlName(a.Name) + `="` + strings.ReplaceAll(xmlTextEscaper.Replace(a.Value), `"`, "&quot;") + `"`
+	}
+
+	return tag
+}
+
+func xmlName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+
+	return n.Space + ":" + n.Local
+}
+
+// voidElements are the HTML elements that have no end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"source": true, "track": true, "wbr": true,
+}
+
+// prettyHTML indents an HTML body, with a tag or text per line. Text is
+// written as it is in the body, so scripts and styles are only reindented.
+func prettyHTML(body string) (string, error) {
+	var buf strings.Builder
+	depth := 0
+	writeLine := func(s string) {
+		buf.WriteString(strings.Repeat("  ", depth))
+		buf.WriteString(s)
+		buf.WriteString("\n")
+	}
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if !errors.Is(z.Err(), io.EOF) {
+				return "", z.Err()
+			}
+			return strings.TrimSuffix(buf.String(), "\n"), nil
+
+		case html.TextToken:
+			for _, line := range strings.Split(string(z.Raw()), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					writeLine(line)
+				}
+			}
+
+		case html.StartTagToken:
+			token := z.Token()
+			writeLine(tagStyle.Render(token.String()))
+			if !voidElements[token.Data] {
+				depth++
+			}
+
+		case html.EndTagToken:
+			depth = max(0, depth-1)
+			writeLine(tagStyle.Render(z.Token().String()))
+
+		case html.CommentToken:
+			writeLine(commentStyle.Render(z.Token().String()))
+
+		default:
+			writeLine(tagStyle.Render(z.Token().String()))
+		}
+	}
+}
+
+// prettyForm writes each parameter of a form body in its own line, URL
+// decoded, in the order they are in the body.
+func prettyForm(body string) string {
+	lines := []string{}
+	for _, param := range strings.Split(body, "&") {
+		if param == "" {
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(param, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if !hasValue {
+			lines = append(lines, keyStyle.Render(name))
+			continue
+		}
+
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		lines = append(lines, keyStyle.Render(name)+" = "+value)
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,147 @@
+package repl
+
+import (
+	"testing"
+
+	"github.com/artilugio0/efin-testifier/pkg/liblua"
+)
+
+func TestPrettyBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{
+			name:        "json",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"id":1,"tags":["a","b"],"ok":true,"next":null}`,
+			expected:    "{\n  \"id\": 1,\n  \"tags\": [\n    \"a\",\n    \"b\"\n  ],\n  \"ok\": true,\n  \"next\": null\n}",
+		},
+		{
+			name:        "json without a content type",
+			contentType: "",
+			body:        `[1, -2.5e3]`,
+			expected:    "[\n  1,\n  -2.5e3\n]",
+		},
+		{
+			name:        "invalid json",
+			contentType: "application/json",
+			body:        `{"id":`,
+			expected:    `{"id":`,
+		},
+		{
+			name:        "plain text",
+			contentType: "text/plain",
+			body:        "hello",
+			expected:    "hello",
+		},
+		{
+			name:        "xml",
+			contentType: "application/xml",
+			body:        `<?xml version="1.0"?><a:root x="1&amp;2"><item>one &lt; two</item><empty></empty><!-- note --></a:root>`,
+			expected: "<?xml version=\"1.0\"?>\n" +
+				"<a:root x=\"1&amp;2\">\n" +
+				"  <item>\n" +
+				"    one &lt; two\n" +
+				"  </item>\n" +
+				"  <empty/>\n" +
+				"  <!-- note -->\n" +
+				"</a:root>",
+		},
+		{
+			name:        "html",
+			contentType: "text/html",
+			body:        "<html><body><p>error</p><br><!-- x --></body></html>",
+			expected: "<html>\n" +
+				"  <body>\n" +
+				"    <p>\n" +
+				"      error\n" +
+				"    </p>\n" +
+				"    <br>\n" +
+				"    <!-- x -->\n" +
+				"  </body>\n" +
+				"</html>",
+		},
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "user=alice&pass=a%26b&&flag&q=%zz",
+			expected:    "user = alice\npass = a&b\nflag\nq = %zz",
+		},
+		{
+			name:        "other type",
+			contentType: "image/png",
+			body:        `{"id":1}`,
+			expected:    `{"id":1}`,
+		},
+	}
+
+	for _, test := range tests {
+		headers := []liblua.HeaderEntry{}
+		if test.contentType != "" {
+			headers = append(headers, liblua.HeaderEntry{Name: "content-type", Value: test.contentType})
+		}
+
+		if got := prettyBody(headers, test.body); got != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	const (
+		key    = "\x1b[38;5;75m"
+		number = "\x1b[38;5;215m"
+		reset  = "\x1b[0m"
+	)
+	match := func(s string) string {
+		return matchStyle.Render(s)
+	}
+
+	tests := []struct {
+		content  string
+		term     string
+		expected string
+	}{
+		{
+			content:  "no colors, no match",
+			term:     "id",
+			expected: "no colors, no match",
+		},
+		{
+			content:  "an id and an id",
+			term:     "id",
+			expected: "an " + match("id") + " and an " + match("id"),
+		},
+		{
+			// The term is in the sequences, not in the text
+			content:  key + `"a"` + reset,
+			term:     "38",
+			expected: key + `"a"` + reset,
+		},
+		{
+			// The color of the rest of the key is set again after the match
+			content:  key + `"id"` + reset + ": " + number + "1" + reset,
+			term:     "i",
+			expected: key + `"` + match("i") + key + `d"` + reset + ": " + number + "1" + reset,
+		},
+		{
+			content:  key + `"id"` + reset + ": " + number + "1" + reset + ",",
+			term:     `"id": 1`,
+			expected: key + match(`"id": 1`) + number + reset + ",",
+		},
+		{
+			content:  "  " + key + `"id"` + reset + ": " + number + "10" + reset,
+			term:     `id": 1`,
+			expected: "  " + key + `"` + match(`id": 1`) + number + "0" + reset,
+		},
+	}
+
+	for _, test := range tests {
+		if got := highlight(test.content, test.term); got != test.expected {
+			t.Errorf("%q in %q: expected %q, got %q", test.term, test.content, test.expected, got)
+		}
+	}
+}
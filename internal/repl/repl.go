@@ -1,47 +1,263 @@
 package repl
 
 import (
+	"context"
 	"fmt"
 	"os"
 
+	"github.com/artilugio0/efin-suite/internal/ql"
 	"github.com/artilugio0/replit"
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-func initialModel(dbFile string) *replit.REPL {
+func initialModel(dbFile, suiteDBFile string) (*replit.REPL, *luaEvaluator, error) {
 	suggestions := []string{
 		"q.",
 		"q.timestamp.gt('1m')",
+		"q.timestamp.between('",
+		"q.timestamp.gt(q.request_time('",
 		"q.id.eq('",
 		"q.method.eq('POST')",
 		"q.method.eq('GET')",
 		"q.method.eq('",
 		"q.path.contains('",
+		"q.path.matches('",
 		"q.header('",
 		"q.header('host').eq('",
 		"q.header('content-type').contains('",
 		"q.header('content-type').eq('",
+		"q.header('authorization').exists()",
+		"q.method.in_({'POST', 'PUT'})",
+		"q.resp_status.in_({",
 		"q.body.contains('",
 		"q.raw.contains('",
+		"q.raw.search('",
 		"q.resp_header('",
 		"q.resp_header('content-type').contains('",
 		"q.resp_header('content-type').eq('",
 		"q.resp_body.contains('",
+		"q.resp_body.matches('",
+		"q.resp_body.search('",
 		"q.resp_raw.contains('",
+		"q.count_by('host', 'status')",
+		"q.endpoint.eq('",
+		"q.group_by('endpoint')",
+		"query requests group by endpoint",
+		"query requests where ",
+		"query count group by host, status",
+		"q.method.eq('POST'):count_by('status')",
+		"q.method.eq('GET'):order_by('status', 'desc'):limit(50)",
+		"save_query('",
+		"run('",
+		"saved_queries()",
+		"delete_query('",
+		"export_queries('",
+		"import_queries('",
+		"show_query(",
+		"explain(",
+		":explain ",
+		"trace(",
+		"fetch(",
+		"q.method.eq('POST'):rows()",
+		"q.method.eq('POST'):tail()",
+		"tail(",
+		"columns('timestamp', 'id', 'method', 'status', 'host', 'mime', 'resp_size', 'url')",
+		"columns('default')",
+		"defq('",
+		"undefq('",
+		"macro_names()",
 	}
 
-	ev := newLuaEvaluator(dbFile)
+	ev, err := newLuaEvaluator(dbFile, suiteDBFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Macros are completed like fields, starting with the ones defined in
+	// the macros file. The ones defined later are added by Eval.
+	suggestions = append(suggestions, ev.macroSuggestions()...)
 
 	repl := replit.NewREPL(ev, replit.WithPromptInitialSuggestions(suggestions))
 	ev.repl = repl
 
-	return repl
+	return repl, ev, nil
 }
 
-func Run(dbFile string) {
-	p := tea.NewProgram(initialModel(dbFile), tea.WithAltScreen())
+func Run(dbFile, suiteDBFile string) {
+	model, ev, err := initialModel(dbFile, suiteDBFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer ev.Close()
+
+	p := tea.NewProgram(model, tea.WithAltScreen())
 	if _, err := p.Run(); err != nil {
 		fmt.Printf("Alas, there's been an error: %v", err)
 		os.Exit(1)
 	}
 }
+
+// RunQuery evaluates a single text query, like the ones accepted by the
+// REPL, and shows its results without starting the REPL. If explain is set,
+// it shows how the query is run instead.
+func RunQuery(dbFile, suiteDBFile, input string, explain bool) {
+	query, err := parseTextQuery(input)
+	if err != nil {
+		fmt.Printf("Error: %v\n", annotateParseError(err, input))
+		os.Exit(1)
+	}
+
+	if explain {
+		runExplain(dbFile, query)
+		return
+	}
+
+	runQueryProgram(dbFile, suiteDBFile, query)
+}
+
+// RunSavedQuery shows the results of a query saved with save_query, or how
+// it is run if explain is set.
+func RunSavedQuery(dbFile, suiteDBFile, name string, explain bool) {
+	query, err := getSavedQuery(suiteDBFile, name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if explain {
+		runExplain(dbFile, query)
+		return
+	}
+
+	runQueryProgram(dbFile, suiteDBFile, query)
+}
+
+func runExplain(dbFile string, query *ql.Query) {
+	db, err := openDB(dbFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	output, err := explainQuery(context.Background(), db, query)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(output)
+}
+
+func runQueryProgram(dbFile, suiteDBFile string, query *ql.Query) {
+	ev, err := newLuaEvaluator(dbFile, suiteDBFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer ev.Close()
+
+	m := &queryProgram{
+		evaluator: ev,
+		query:     query,
+	}
+
+	p := tea.NewProgram(m, tea.WithAltScreen())
+	if _, err := p.Run(); err != nil {
+		fmt.Printf("Alas, there's been an error: %v", err)
+		os.Exit(1)
+	}
+
+	if m.err != nil {
+		fmt.Printf("Error: %v\n", m.err)
+		os.Exit(1)
+	}
+
+	if m.output != "" {
+		fmt.Println(m.output)
+	}
+}
+
+// RunIndex builds the full-text index used by the search operator, or adds
+// the requests saved since it was last built.
+func RunIndex(dbFile string) {
+	db, err := openDB(dbFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	added, err := ql.BuildFullTextIndex(context.Background(), db)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d requests added to the index\n", added)
+}
+
+// queryProgram shows the results of a query on its own. The query is run
+// once the terminal size is known, since the results view needs it.
+type queryProgram struct {
+	evaluator *luaEvaluator
+	query     *ql.Query
+	view      tea.Model
+
+	output string
+	err    error
+}
+
+func (m *queryProgram) Init() tea.Cmd {
+	return nil
+}
+
+func (m *queryProgram) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		if m.view != nil {
+			break
+		}
+
+		result, err := m.evaluator.evalQuery(context.TODO(), m.query, msg.Width, msg.Height)
+		if err != nil {
+			m.err = err
+			return m, tea.Quit
+		}
+
+		if result.View == nil {
+			m.output = result.Output
+			return m, tea.Quit
+		}
+
+		m.view = result.View
+		return m, m.view.Init()
+
+	case replit.ExitView:
+		m.output = msg.Output
+		m.err = msg.Error
+		return m, tea.Quit
+
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			return m, tea.Quit
+		}
+	}
+
+	if m.view == nil {
+		return m, nil
+	}
+
+	view, cmd := m.view.Update(msg)
+	m.view = view
+	return m, cmd
+}
+
+func (m *queryProgram) View() string {
+	if m.view == nil {
+		return "running query..."
+	}
+
+	return m.view.View()
+}
@@ -1,11 +1,16 @@
 package repl
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/artilugio0/replit"
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 )
@@ -16,21 +21,97 @@ const (
 	focusVp2
 )
 
-type RequestsTableRow []string
+// RequestsTableRow is a request shown in a RequestsTableView. Columns has
+// the values of the columns other than the default ones, by column name.
+type RequestsTableRow struct {
+	Timestamp string
+	ID        string
+	Method    string
+	Status    string
+	URL       string
+	Columns   map[string]string
+}
+
+// Value returns the value of a column of the row.
+func (r RequestsTableRow) Value(column string) string {
+	switch column {
+	case "timestamp":
+		return r.Timestamp
+	case "id":
+		return r.ID
+	case "method":
+		return r.Method
+	case "status":
+		return r.Status
+	case "url":
+		return r.URL
+	}
+
+	return r.Columns[column]
+}
+
+// defaultColumns are the columns of a RequestsTableView unless others are
+// set with SetColumns. Rows always have their values.
+var defaultColumns = []string{"timestamp", "id", "method", "status", "url"}
+
+var columnTitles = map[string]string{
+	"timestamp": "Timestamp",
+	"id":        "ID",
+	"method":    "Method",
+	"status":    "Status",
+	"url":       "URL",
+}
+
+func columnTitle(column string) string {
+	if title, ok := columnTitles[column]; ok {
+		return title
+	}
+
+	return column
+}
+
+// extraColumns returns the columns that are not default columns, whose
+// values are stored in the Columns of the rows.
+func extraColumns(columns []string) []string {
+	extra := []string{}
+	for _, c := range columns {
+		if !slices.Contains(defaultColumns, c) {
+			extra = append(extra, c)
+		}
+	}
+
+	return extra
+}
 
 type RequestsTableView struct {
 	width  int
 	height int
 
+	// rows are the rows of allRows that match the filter of the view
 	rows       []RequestsTableRow
+	allRows    []RequestsTableRow
 	currentRow int
 	table      table.Model
 
+	// columns are the names of the columns of the table. The rows are
+	// sorted by the column at sortColumn, unless it is -1.
+	columns        []string
+	sortColumn     int
+	sortDescending bool
+	// sortFn sorts all the results, when not all of them are loaded. It
+	// returns the command that loads them sorted, and whether the sort
+	// covers all the results, which are then not only the loaded rows.
+	sortFn     func(column string, descending bool) (tea.Cmd, bool)
+	sortLoaded bool
+
 	vp1 *replit.Viewport
 	vp2 *replit.Viewport
 
-	updateVp1Fn func(RequestsTableRow) string
-	updateVp2Fn func(RequestsTableRow) string
+	// updateVp1Fn and updateVp2Fn return the contents of the viewports for
+	// a row, with the bodies pretty printed unless raw is true
+	updateVp1Fn func(RequestsTableRow, bool) string
+	updateVp2Fn func(RequestsTableRow, bool) string
+	raw         bool
 
 	rowKeyBindings map[string](func(RequestsTableRow) tea.Cmd)
 
@@ -39,6 +120,22 @@ type RequestsTableView struct {
 	unfocusStyle lipgloss.Style
 
 	message string
+	summary string
+	// total is the number of rows of the results, which can be more than
+	// the loaded ones, or -1 if it is not known
+	total int
+
+	// filter has the rows whose URL, method, status or columns contain it,
+	// or the ones filterMatch matches if it is an expression, in which case
+	// filterIDs has the ids of those rows. filterID changes with the filter,
+	// to discard the matches of a previous filter.
+	filter      string
+	filterIDs   map[string]bool
+	filterFn    func(string) (rowMatcher, error)
+	filterMatch rowMatcher
+	filterID    int
+	filtering   bool
+	filterInput textinput.Model
 }
 
 func NewRequestsTableView(width, height int) *RequestsTableView {
@@ -70,6 +167,9 @@ func NewRequestsTableView(width, height int) *RequestsTableView {
 		height:         height,
 		vp1:            vp1,
 		vp2:            vp2,
+		columns:        defaultColumns,
+		sortColumn:     -1,
+		total:          -1,
 		rowKeyBindings: map[string](func(RequestsTableRow) tea.Cmd){},
 		focusStyle:     focusStyle,
 		unfocusStyle:   unfocusStyle,
@@ -77,18 +177,180 @@ func NewRequestsTableView(width, height int) *RequestsTableView {
 }
 
 func (v *RequestsTableView) SetRows(rows []RequestsTableRow) {
-	v.rows = rows
+	v.allRows = rows
 	v.currentRow = 0
+	v.sortRows()
+	v.applyFilter()
+
+	v.setTable(0)
+	v.message = v.summaryMessage()
+
+	v.updateViewports()
+}
+
+// SetColumns sets the columns of the table. The rows must have the values
+// of the columns that are not default columns.
+func (v *RequestsTableView) SetColumns(columns []string) {
+	v.columns = columns
+	v.sortColumn = -1
+	v.setTable(v.currentRow)
+}
+
+// InsertRows adds rows to the table, before its rows if atTop is set and
+// after them otherwise, or in their place if the table is sorted by a
+// column. The selected row and the viewports are kept. If the rows are
+// filtered by an expression, the new rows are shown once the returned
+// command matches them.
+func (v *RequestsTableView) InsertRows(rows []RequestsTableRow, atTop bool) tea.Cmd {
+	// Rows that were already added, like the ones a followed query finds
+	// again while it waits for a response, are skipped
+	ids := make(map[string]bool, len(v.allRows))
+	for _, r := range v.allRows {
+		ids[r.ID] = true
+	}
+	rows = slices.DeleteFunc(slices.Clone(rows), func(r RequestsTableRow) bool {
+		return ids[r.ID]
+	})
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	wasEmpty := len(v.rows) == 0
+	selectedID := ""
+	if !wasEmpty {
+		selectedID = v.rows[v.currentRow].ID
+	}
+
+	if atTop {
+		v.allRows = append(slices.Clone(rows), v.allRows...)
+	} else {
+		v.allRows = append(v.allRows, rows...)
+	}
+	v.sortRows()
+	v.applyFilter()
+
+	v.currentRow = max(0, slices.IndexFunc(v.rows, func(r RequestsTableRow) bool {
+		return r.ID == selectedID
+	}))
+	v.setTable(v.currentRow)
+	v.message = v.summaryMessage()
+
+	// The selected row is the same, so the viewports only change if the
+	// table had no rows before
+	if wasEmpty {
+		v.updateViewports()
+	}
+
+	return v.matchRows(rows)
+}
+
+// SetSortFn sets the function that sorts all the results by a column, for
+// tables that do not have all of them.
+func (v *RequestsTableView) SetSortFn(fn func(column string, descending bool) (tea.Cmd, bool)) {
+	v.sortFn = fn
+}
+
+// sortBy sorts the rows by the column at index i, in descending order if
+// they are already sorted by it in ascending order. The selected row is
+// kept. The loaded rows are sorted right away, and all the results are
+// sorted by sortFn, if they can be.
+func (v *RequestsTableView) sortBy(i int) tea.Cmd {
+	v.sortDescending = v.sortColumn == i && !v.sortDescending
+	v.sortColumn = i
+
+	var cmd tea.Cmd
+	v.sortLoaded = false
+	if v.sortFn != nil {
+		var all bool
+		cmd, all = v.sortFn(v.columns[i], v.sortDescending)
+		v.sortLoaded = !all
+	}
+
+	if len(v.rows) == 0 {
+		v.setTable(0)
+		v.message = v.summaryMessage()
+		return cmd
+	}
+
+	selectedID := v.rows[v.currentRow].ID
+	v.sortRows()
+	v.applyFilter()
+	v.currentRow = slices.IndexFunc(v.rows, func(r RequestsTableRow) bool {
+		return r.ID == selectedID
+	})
+	v.setTable(v.currentRow)
+	v.message = v.summaryMessage()
+
+	return cmd
+}
+
+// ReplaceRows replaces the rows of the table with the ones of the results
+// loaded again, like after sorting them. The selected row is kept if it is
+// one of the new rows.
+func (v *RequestsTableView) ReplaceRows(rows []RequestsTableRow) tea.Cmd {
+	selectedID := ""
+	if len(v.rows) > 0 {
+		selectedID = v.rows[v.currentRow].ID
+	}
+
+	v.allRows = rows
+	v.sortRows()
+	v.applyFilter()
+	v.currentRow = max(0, slices.IndexFunc(v.rows, func(r RequestsTableRow) bool {
+		return r.ID == selectedID
+	}))
+	v.setTable(v.currentRow)
+	v.message = v.summaryMessage()
+	v.updateViewports()
+
+	return v.matchRows(rows)
+}
+
+// sortRows sorts the rows by the sort column, comparing values as numbers
+// when both of them are numbers.
+func (v *RequestsTableView) sortRows() {
+	if v.sortColumn < 0 || v.sortColumn >= len(v.columns) {
+		return
+	}
 
-	maxColWidths := make([]int, 5)
+	column := v.columns[v.sortColumn]
+	slices.SortStableFunc(v.allRows, func(a, b RequestsTableRow) int {
+		c := compareColumnValues(a.Value(column), b.Value(column))
+		if v.sortDescending {
+			return -c
+		}
+		return c
+	})
+}
+
+func compareColumnValues(a, b string) int {
+	na, errA := strconv.ParseFloat(a, 64)
+	nb, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		return cmp.Compare(na, nb)
+	}
+
+	return cmp.Compare(a, b)
+}
+
+// setTable creates the table with the rows and the columns of the view,
+// selecting the row at cursor.
+func (v *RequestsTableView) setTable(cursor int) {
+	maxColWidths := make([]int, len(v.columns))
+	for i, c := range v.columns {
+		maxColWidths[i] = min(max(10, len(columnTitle(c))+2), v.width/2)
+	}
 
-	tableRows := make([]table.Row, len(rows))
-	for i, r := range rows {
-		tableRows[i] = table.Row(r)
-		for j, c := range r {
+	tableRows := make([]table.Row, len(v.rows))
+	for i, r := range v.rows {
+		row := make(table.Row, len(v.columns))
+		for j, c := range v.columns {
+			row[j] = r.Value(c)
 			// max colum size is width / 2
-			maxColWidths[j] = max(maxColWidths[j], min(max(10, len(c)), v.width/2))
+			maxColWidths[j] = max(maxColWidths[j], min(max(10, len(row[j])), v.width/2))
 		}
+		tableRows[i] = row
 	}
 
 	maxColWidthsSum := 0
@@ -96,62 +358,126 @@ func (v *RequestsTableView) SetRows(rows []RequestsTableRow) {
 		maxColWidthsSum += w
 	}
 
-	columns := []table.Column{
-		{Title: "Timestamp", Width: int(float32(maxColWidths[0]) / float32(maxColWidthsSum) * 0.95 * float32(v.width))},
-		{Title: "ID", Width: int(float32(maxColWidths[1]) / float32(maxColWidthsSum) * 0.95 * float32(v.width))},
-		{Title: "Method", Width: int(float32(maxColWidths[2]) / float32(maxColWidthsSum) * 0.95 * float32(v.width))},
-		{Title: "Status", Width: int(float32(maxColWidths[3]) / float32(maxColWidthsSum) * 0.95 * float32(v.width))},
-		{Title: "URL", Width: int(float32(maxColWidths[4]) / float32(maxColWidthsSum) * 0.95 * float32(v.width))},
+	columns := make([]table.Column, len(v.columns))
+	for i, c := range v.columns {
+		title := columnTitle(c)
+		if i == v.sortColumn {
+			title += " ▲"
+			if v.sortDescending {
+				title = columnTitle(c) + " ▼"
+			}
+		}
+
+		columns[i] = table.Column{
+			Title: title,
+			Width: int(float32(maxColWidths[i]) / float32(max(maxColWidthsSum, 1)) * 0.95 * float32(v.width)),
+		}
 	}
 
 	maxHeight := v.height/2 - 1
-	tableHeight := min(maxHeight, len(rows)+1)
+	tableHeight := min(maxHeight, len(v.rows)+1)
 
 	v.vp1.SetSize(v.width/2, v.height-tableHeight-1)
 	v.vp2.SetSize(v.width/2+v.width%2, v.height-tableHeight-1)
 
+	// f is used to follow the results of queries, so it does not page down
+	keyMap := table.DefaultKeyMap()
+	keyMap.PageDown = key.NewBinding(
+		key.WithKeys("pgdown", " "),
+		key.WithHelp("pgdn", "page down"),
+	)
+
 	v.table = table.New(
 		table.WithColumns(columns),
 		table.WithRows(tableRows),
 		table.WithFocused(true),
 		table.WithHeight(tableHeight),
 		table.WithWidth(v.width),
+		table.WithKeyMap(keyMap),
 	)
-
-	v.message = fmt.Sprintf("%d requests found", len(v.table.Rows()))
-
-	v.updateViewports()
+	v.table.SetCursor(cursor)
 }
 
 func (v *RequestsTableView) updateViewports() {
-	if len(v.rows) > 0 {
-		if v.updateVp1Fn != nil {
-			vp1Content := v.updateVp1Fn(v.rows[v.currentRow])
-			v.vp1.Clear()
-			v.vp1.AppendBlock(replit.StringBlock{vp1Content})
-			v.vp1.GotoTop()
-		}
-		if v.updateVp2Fn != nil {
-			vp2Content := v.updateVp2Fn(v.rows[v.currentRow])
-			v.vp2.Clear()
-			v.vp2.AppendBlock(replit.StringBlock{vp2Content})
-			v.vp2.GotoTop()
-		}
+	if len(v.rows) == 0 {
+		v.vp1.Clear()
+		v.vp2.Clear()
+		return
+	}
+
+	if v.updateVp1Fn != nil {
+		setViewportContent(v.vp1, v.updateVp1Fn(v.rows[v.currentRow], !v.raw), v.searchTerm())
+	}
+	if v.updateVp2Fn != nil {
+		setViewportContent(v.vp2, v.updateVp2Fn(v.rows[v.currentRow], !v.raw), v.searchTerm())
 	}
 }
 
-func (v *RequestsTableView) SetUpdateFns(fn1, fn2 func(RequestsTableRow) string) {
+func (v *RequestsTableView) SetUpdateFns(fn1, fn2 func(RequestsTableRow, bool) string) {
 	v.updateVp1Fn = fn1
 	v.updateVp2Fn = fn2
 
 	v.updateViewports()
 }
 
+// toggleRaw switches the bodies in the viewports between pretty printed and
+// raw.
+func (v *RequestsTableView) toggleRaw() tea.Cmd {
+	v.raw = !v.raw
+	v.updateViewports()
+
+	message := "showing pretty printed bodies"
+	if v.raw {
+		message = "showing raw bodies"
+	}
+	return func() tea.Msg {
+		return requestTableViewMessage{message: message}
+	}
+}
+
+// SetSummary replaces the number of requests found, shown below the table,
+// with summary.
+func (v *RequestsTableView) SetSummary(summary string) {
+	v.summary = summary
+	v.message = v.summaryMessage()
+}
+
+func (v *RequestsTableView) summaryMessage() string {
+	if v.filter != "" {
+		return fmt.Sprintf("%d of %d requests match '%s'", len(v.rows), len(v.allRows), v.filter)
+	}
+
+	if v.summary != "" {
+		return v.summary
+	}
+
+	if v.total > len(v.allRows) {
+		message := fmt.Sprintf("%d requests found, %d loaded", v.total, len(v.allRows))
+		if v.sortLoaded && v.sortColumn >= 0 {
+			message += fmt.Sprintf(", only the loaded ones sorted by %s", columnTitle(v.columns[v.sortColumn]))
+		}
+		return message
+	}
+
+	return fmt.Sprintf("%d requests found", len(v.table.Rows()))
+}
+
+// SetTotal sets the number of rows of the results, when not all of them are
+// loaded.
+func (v *RequestsTableView) SetTotal(total int) {
+	v.total = total
+	v.message = v.summaryMessage()
+}
+
 func (v *RequestsTableView) SetRowKeyBinding(key string, fn func(RequestsTableRow) tea.Cmd) {
 	v.rowKeyBindings[key] = fn
 }
 
 func (v *RequestsTableView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if kmsg, ok := msg.(tea.KeyMsg); ok && v.filtering {
+		return v, v.updateFilterInput(kmsg)
+	}
+
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		switch msg.String() {
@@ -190,6 +516,9 @@ func (v *RequestsTableView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		v.vp1.SetSize(v.width/2, v.height-tableHeight)
 		v.vp2.SetSize(v.width/2+v.width%2, v.height-tableHeight)
 
+	case filterMsg:
+		return v, v.addFilterMatches(msg)
+
 	case requestTableViewMessage:
 		if msg.message != "" {
 			v.message = msg.message
@@ -199,12 +528,46 @@ func (v *RequestsTableView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		}
 
-		v.message = fmt.Sprintf("%d requests found", len(v.table.Rows()))
+		v.message = v.summaryMessage()
 	}
 
 	var cmd tea.Cmd
 	switch v.focus {
 	case focusTable:
+		// 1 to 9 sort the rows by the first nine columns, s sorts them by
+		// the next column, which reaches the columns after the ninth, and S
+		// reverses the order. / filters them, n and N go to the next and
+		// previous match of the filter in the viewports and p switches
+		// between pretty printed and raw bodies
+		if kmsg, ok := msg.(tea.KeyMsg); ok {
+			if i, err := strconv.Atoi(kmsg.String()); err == nil && i >= 1 && i <= len(v.columns) {
+				return v, v.sortBy(i - 1)
+			}
+
+			switch kmsg.String() {
+			case "s":
+				if len(v.columns) > 0 {
+					return v, v.sortBy((v.sortColumn + 1) % len(v.columns))
+				}
+				return v, nil
+			case "S":
+				if v.sortColumn >= 0 {
+					return v, v.sortBy(v.sortColumn)
+				}
+				return v, nil
+			case "/":
+				return v, v.startFiltering()
+			case "n", "N":
+				if v.searchTerm() != "" {
+					v.vp1.Update(msg)
+					v.vp2.Update(msg)
+				}
+				return v, nil
+			case "p":
+				return v, v.toggleRaw()
+			}
+		}
+
 		v.table, cmd = v.table.Update(msg)
 		selectedRow := v.table.Cursor()
 		if selectedRow != v.currentRow {
@@ -214,8 +577,8 @@ func (v *RequestsTableView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		if kmsg, ok := msg.(tea.KeyMsg); ok {
 			kb, ok := v.rowKeyBindings[kmsg.String()]
-			if ok {
-				cmd = kb(RequestsTableRow(v.table.SelectedRow()))
+			if ok && len(v.rows) > 0 {
+				cmd = kb(v.rows[v.table.Cursor()])
 			}
 		}
 
@@ -235,7 +598,11 @@ func (v *RequestsTableView) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 func (v *RequestsTableView) View() string {
 	table := v.table.View()
-	table += "\n" + v.message
+	if v.filtering {
+		table += "\n" + v.filterInput.View()
+	} else {
+		table += "\n" + v.message
+	}
 
 	viewports := lipgloss.JoinHorizontal(lipgloss.Bottom, v.vp1.View(), v.vp2.View())
 	output := lipgloss.JoinVertical(lipgloss.Left, table, viewports)
@@ -260,7 +627,7 @@ func (v *RequestsTableView) TableRawView() string {
 
 	v.table.SetStyles(s)
 	output += v.table.View()
-	output += fmt.Sprintf("\n%d requests found", len(rows))
+	output += "\n" + v.summaryMessage()
 
 	return output
 }
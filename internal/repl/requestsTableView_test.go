@@ -0,0 +1,168 @@
+package repl
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// newPagedResultsView creates a query results view with the first page of
+// the rows of a text query, after adding requests to the fixture so they do
+// not fit in a page. The status of each added request is its id.
+func newPagedResultsView(t *testing.T, input string) *QueryResultsView {
+	t.Helper()
+
+	_, db := newFixtureDB(t)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 5; id < 5+pageSize+50; id++ {
+		if _, err := tx.Exec("INSERT INTO requests (request_id, method, url, body) VALUES (?, 'GET', 'https://example.com/', '')", id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (?, ?, '')", id, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := parseTextQuery(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pager, err := newRequestPager(db, query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := pager.next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := NewQueryResultsView(db, nil, rows, 120, 40)
+	v.query = query
+	v.pager = pager
+	v.requestsTableView.SetTotal(len(fixtureRequests) + pageSize + 50)
+
+	return v
+}
+
+// pressKey sends a key to a view and the messages of the pages it loads
+// back to it.
+func pressKey(v *QueryResultsView, key string) {
+	_, cmd := v.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key)})
+	for _, msg := range runCmd[pageMsg](cmd) {
+		v.Update(msg)
+	}
+}
+
+func TestSortLoadsSortedResults(t *testing.T) {
+	v := newPagedResultsView(t, "query requests order by id desc")
+
+	// The status column is the fourth one. Sorting only the loaded rows
+	// would start with request 55, the one with the lowest status of the
+	// first page
+	tests := []struct {
+		key      string
+		expected []string
+	}{
+		{key: "4", expected: []string{"5", "6", "7"}},
+		{key: "4", expected: []string{"3", "2", "254"}},
+	}
+
+	for _, test := range tests {
+		pressKey(v, test.key)
+
+		rows := v.requestsTableView.rows
+		if len(rows) != pageSize {
+			t.Errorf("key %s: expected a page of rows, got %d", test.key, len(rows))
+		}
+		if ids := rowIDs(rows[:len(test.expected)]); !slices.Equal(ids, test.expected) {
+			t.Errorf("key %s: expected rows %v first, got %v", test.key, test.expected, ids)
+		}
+		if strings.Contains(v.requestsTableView.message, "only the loaded ones") {
+			t.Errorf("key %s: expected all the results to be sorted, got message %q", test.key, v.requestsTableView.message)
+		}
+	}
+}
+
+func TestSortLoadedRowsOnly(t *testing.T) {
+	// The rows of a query with a limit cannot be sorted again in the query,
+	// because the limit applies to the rows in the order of the query. The
+	// table is sorted without the view, which would load the rest of the
+	// rows for the selected row, now the last one
+	v := newPagedResultsView(t, "query requests order by id desc limit 220")
+	if cmd := v.requestsTableView.sortBy(3); cmd != nil {
+		t.Errorf("expected no rows to be loaded")
+	}
+
+	if ids := rowIDs(v.requestsTableView.rows[:2]); !slices.Equal(ids, []string{"55", "56"}) {
+		t.Errorf("expected the loaded rows to be sorted, got %v first", ids)
+	}
+	if !strings.Contains(v.requestsTableView.message, "only the loaded ones sorted by Status") {
+		t.Errorf("expected the message to say only the loaded rows are sorted, got %q", v.requestsTableView.message)
+	}
+}
+
+func TestSortKeepsFollowedRows(t *testing.T) {
+	v := newPagedResultsView(t, "query requests order by id desc")
+	v.follow()
+
+	// The followed request has the highest status, so it is not in the
+	// first page of the results sorted by status
+	if _, err := v.db.Exec("INSERT INTO requests (request_id, method, url, body) VALUES (1000, 'GET', 'https://example.com/new', '')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.db.Exec("INSERT INTO responses (response_id, status_code, body) VALUES (1000, 999, '')"); err != nil {
+		t.Fatal(err)
+	}
+	v.Update(v.fetchNewRows()())
+	if ids := rowIDs(v.requestsTableView.rows[:1]); !slices.Equal(ids, []string{"1000"}) {
+		t.Fatalf("expected the followed request first, got %v", ids)
+	}
+
+	pressKey(v, "4")
+
+	rows := v.requestsTableView.rows
+	if len(rows) != pageSize+1 {
+		t.Errorf("expected a page of rows and the followed one, got %d", len(rows))
+	}
+	if ids := rowIDs(rows[len(rows)-1:]); !slices.Equal(ids, []string{"1000"}) {
+		t.Errorf("expected the followed request last, got %v", ids)
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	columns := []string{"timestamp", "id", "method", "status", "url", "host", "path", "scheme", "port", "req_size", "resp_size"}
+
+	v := NewRequestsTableView(120, 40)
+	v.SetColumns(columns)
+
+	tests := []struct {
+		key        string
+		column     int
+		descending bool
+	}{
+		{key: "9", column: 8},
+		{key: "s", column: 9},
+		{key: "s", column: 10},
+		{key: "S", column: 10, descending: true},
+		{key: "S", column: 10},
+		{key: "s", column: 0},
+		{key: "1", column: 0, descending: true},
+	}
+
+	for _, test := range tests {
+		v.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(test.key)})
+		if v.sortColumn != test.column || v.sortDescending != test.descending {
+			t.Errorf("key %s: expected column %d descending %v, got column %d descending %v",
+				test.key, test.column, test.descending, v.sortColumn, v.sortDescending)
+		}
+	}
+}
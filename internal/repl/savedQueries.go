@@ -0,0 +1,359 @@
+package repl
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/artilugio0/efin-suite/internal/ql"
+	lua "github.com/yuin/gopher-lua"
+	_ "modernc.org/sqlite"
+)
+
+// savedQueriesFileVersion is the version of the files saved queries are
+// exported to.
+const savedQueriesFileVersion = 1
+
+const savedQueriesSchema = `
+CREATE TABLE IF NOT EXISTS saved_queries (
+	name TEXT PRIMARY KEY,
+	query TEXT NOT NULL,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+)`
+
+// DefaultSuiteDBFile returns the path of the efin-suite side database, which
+// stores data that is not tied to a requests DB, like saved queries.
+func DefaultSuiteDBFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+
+	return filepath.Join(dir, "efin-suite", "efin-suite.db")
+}
+
+type savedQuery struct {
+	Name      string    `json:"name"`
+	Query     *ql.Query `json:"query"`
+	UpdatedAt string    `json:"-"`
+}
+
+type savedQueriesFile struct {
+	Version int          `json:"version"`
+	Queries []savedQuery `json:"queries"`
+}
+
+func openSuiteDB(suiteDBFile string) (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(suiteDBFile), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", suiteDBFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open SQLite database: %v", err)
+	}
+
+	if _, err := db.Exec(savedQueriesSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func saveQuery(suiteDBFile, name string, query *ql.Query) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("saved queries must have a name")
+	}
+
+	encoded, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+
+	db, err := openSuiteDB(suiteDBFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+		INSERT INTO saved_queries (name, query) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET query = excluded.query, updated_at = CURRENT_TIMESTAMP
+	`, name, string(encoded))
+
+	return err
+}
+
+func getSavedQuery(suiteDBFile, name string) (*ql.Query, error) {
+	db, err := openSuiteDB(suiteDBFile)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var encoded string
+	err = db.QueryRow("SELECT query FROM saved_queries WHERE name = ?", name).Scan(&encoded)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("there is no saved query named '%s'", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	query := &ql.Query{}
+	if err := json.Unmarshal([]byte(encoded), query); err != nil {
+		return nil, fmt.Errorf("invalid saved query '%s': %v", name, err)
+	}
+
+	return query, nil
+}
+
+func listSavedQueries(suiteDBFile string) ([]savedQuery, error) {
+	db, err := openSuiteDB(suiteDBFile)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name, query, updated_at FROM saved_queries ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []savedQuery{}
+	for rows.Next() {
+		var encoded string
+		q := savedQuery{Query: &ql.Query{}}
+		if err := rows.Scan(&q.Name, &encoded, &q.UpdatedAt); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(encoded), q.Query); err != nil {
+			return nil, fmt.Errorf("invalid saved query '%s': %v", q.Name, err)
+		}
+		result = append(result, q)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func deleteSavedQuery(suiteDBFile, name string) error {
+	db, err := openSuiteDB(suiteDBFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	result, err := db.Exec("DELETE FROM saved_queries WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("there is no saved query named '%s'", name)
+	}
+
+	return nil
+}
+
+// exportSavedQueries writes the saved queries with the given names, or all of
+// them if no names are given, to a file that can be shared and imported with
+// importSavedQueries.
+func exportSavedQueries(suiteDBFile, file string, names []string) (int, error) {
+	queries, err := listSavedQueries(suiteDBFile)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(names) > 0 {
+		selected := []savedQuery{}
+		for _, name := range names {
+			found := false
+			for _, q := range queries {
+				if q.Name == name {
+					selected = append(selected, q)
+					found = true
+				}
+			}
+			if !found {
+				return 0, fmt.Errorf("there is no saved query named '%s'", name)
+			}
+		}
+		queries = selected
+	}
+
+	data, err := json.MarshalIndent(savedQueriesFile{
+		Version: savedQueriesFileVersion,
+		Queries: queries,
+	}, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.WriteFile(file, append(data, '\n'), 0600); err != nil {
+		return 0, err
+	}
+
+	return len(queries), nil
+}
+
+// importSavedQueries saves the queries of a file written by
+// exportSavedQueries, replacing the saved queries with the same names.
+func importSavedQueries(suiteDBFile, file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+
+	var f savedQueriesFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return 0, fmt.Errorf("invalid saved queries file '%s': %v", file, err)
+	}
+
+	if f.Version != savedQueriesFileVersion {
+		return 0, fmt.Errorf("unsupported saved queries file version %d", f.Version)
+	}
+
+	for _, q := range f.Queries {
+		if q.Query == nil {
+			return 0, fmt.Errorf("saved query '%s' has no query", q.Name)
+		}
+	}
+
+	for _, q := range f.Queries {
+		if err := saveQuery(suiteDBFile, q.Name, q.Query); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(f.Queries), nil
+}
+
+// registerSavedQueryFunctions adds the Lua functions used to manage saved
+// queries:
+//
+//	save_query('errors', q.resp_status.ge(500))
+//	save_query('admin', "requests where path contains 'admin'")
+//	run('errors')
+//	saved_queries()
+//	delete_query('errors')
+//	export_queries('queries.json' [, 'errors', ...])
+//	import_queries('queries.json')
+func registerSavedQueryFunctions(L *lua.LState, suiteDBFile string) {
+	L.SetGlobal("save_query", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		query, err := luaValueToQuery(L.CheckAny(2))
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		if err := saveQuery(suiteDBFile, name, query); err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		L.Push(lua.LString("query saved as '" + name + "'"))
+		return 1
+	}))
+
+	L.SetGlobal("run", L.NewFunction(func(L *lua.LState) int {
+		query, err := getSavedQuery(suiteDBFile, L.CheckString(1))
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		ud := L.NewUserData()
+		ud.Value = query
+		L.Push(ud)
+		return 1
+	}))
+
+	L.SetGlobal("saved_queries", L.NewFunction(func(L *lua.LState) int {
+		queries, err := listSavedQueries(suiteDBFile)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		if len(queries) == 0 {
+			L.Push(lua.LString("no saved queries"))
+			return 1
+		}
+
+		width := 0
+		for _, q := range queries {
+			width = max(width, len(q.Name))
+		}
+
+		lines := make([]string, len(queries))
+		for i, q := range queries {
+			lines[i] = fmt.Sprintf("%-*s  %s  %s", width, q.Name, q.UpdatedAt, q.Query)
+		}
+
+		L.Push(lua.LString(strings.Join(lines, "\n")))
+		return 1
+	}))
+
+	L.SetGlobal("delete_query", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		if err := deleteSavedQuery(suiteDBFile, name); err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		L.Push(lua.LString("query '" + name + "' deleted"))
+		return 1
+	}))
+
+	L.SetGlobal("export_queries", L.NewFunction(func(L *lua.LState) int {
+		file := L.CheckString(1)
+		names := []string{}
+		for i := 2; i <= L.GetTop(); i++ {
+			names = append(names, L.CheckString(i))
+		}
+
+		n, err := exportSavedQueries(suiteDBFile, file, names)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		L.Push(lua.LString(fmt.Sprintf("%d queries exported to %s", n, file)))
+		return 1
+	}))
+
+	L.SetGlobal("import_queries", L.NewFunction(func(L *lua.LState) int {
+		file := L.CheckString(1)
+		n, err := importSavedQueries(suiteDBFile, file)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+
+		L.Push(lua.LString(fmt.Sprintf("%d queries imported from %s", n, file)))
+		return 1
+	}))
+}
+
+// luaValueToQuery converts the queries accepted by save_query: expressions
+// and queries built with the DSL, text queries and the result of run.
+func luaValueToQuery(value lua.LValue) (*ql.Query, error) {
+	switch v := value.(type) {
+	case *lua.LTable:
+		return toQuery(v)
+
+	case lua.LString:
+		return parseTextQuery(string(v))
+
+	case *lua.LUserData:
+		if query, ok := v.Value.(*ql.Query); ok {
+			return query, nil
+		}
+	}
+
+	return nil, fmt.Errorf("expected a query, found a %s value", value.Type().String())
+}
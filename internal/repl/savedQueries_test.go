@@ -0,0 +1,156 @@
+package repl
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExportImportSavedQueries(t *testing.T) {
+	dir := t.TempDir()
+	from := filepath.Join(dir, "from.db")
+	to := filepath.Join(dir, "to.db")
+	file := filepath.Join(dir, "queries.json")
+
+	queries := map[string]string{
+		"posts":    "query requests where method eq POST order by id",
+		"errors":   "query requests where resp.status ge 500",
+		"sessions": "query requests where id in (query requests where header.cookie contains 's3cr3t') or url contains 'session'",
+		"count":    "query count group by method",
+		"recent":   "query requests where timestamp gt 1h30m ago",
+	}
+	for name, input := range queries {
+		query, err := parseTextQuery(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := saveQuery(from, name, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Imported queries replace the ones with the same name
+	stale, err := parseTextQuery("query requests where method eq GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveQuery(to, "posts", stale); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := exportSavedQueries(from, file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(queries) {
+		t.Errorf("expected %d exported queries, got %d", len(queries), n)
+	}
+
+	// Durations are written as in queries, not as nanoseconds
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `"1h30m"`) {
+		t.Errorf("expected the duration of the recent query to be 1h30m, got %s", content)
+	}
+
+	n, err = importSavedQueries(to, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(queries) {
+		t.Errorf("expected %d imported queries, got %d", len(queries), n)
+	}
+
+	for name := range queries {
+		original, err := getSavedQuery(from, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported, err := getSavedQuery(to, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Conditions have the aliases of their tables, which are different
+		// in each decoded query, so the queries are compared encoded
+		originalJSON, err := json.Marshal(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+		importedJSON, err := json.Marshal(imported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(importedJSON) != string(originalJSON) {
+			t.Errorf("%s: expected the imported query to be\n%s\ngot\n%s", name, originalJSON, importedJSON)
+		}
+	}
+
+	imported, err := getSavedQuery(to, "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := doRequestQuery(context.Background(), fixtureDB, imported, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := rowIDs(rows)
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"2", "4"}) {
+		t.Errorf("expected the imported query to match requests 2 and 4, got %v", ids)
+	}
+}
+
+func TestExportSavedQueriesErrors(t *testing.T) {
+	dir := t.TempDir()
+	suiteDBFile := filepath.Join(dir, "suite.db")
+
+	query, err := parseTextQuery("query requests where method eq POST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveQuery(suiteDBFile, "posts", query); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := exportSavedQueries(suiteDBFile, filepath.Join(dir, "out.json"), []string{"posts", "missing"}); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("expected an error for the missing query, got %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{name: "invalid json", content: "{", expected: "invalid saved queries file"},
+		{name: "unknown version", content: `{"version": 2, "queries": []}`, expected: "unsupported saved queries file version 2"},
+		{name: "missing query", content: `{"version": 1, "queries": [{"name": "empty"}]}`, expected: "saved query 'empty' has no query"},
+	}
+
+	for _, test := range tests {
+		file := filepath.Join(dir, "in.json")
+		if err := os.WriteFile(file, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := importSavedQueries(suiteDBFile, file)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.expected, err)
+		}
+	}
+
+	// Files with errors do not change the saved queries
+	saved, err := listSavedQueries(suiteDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Name != "posts" {
+		t.Errorf("expected only the posts query, got %v", saved)
+	}
+}
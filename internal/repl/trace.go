@@ -0,0 +1,107 @@
+package repl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/artilugio0/efin-suite/internal/ql"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// traceStep is a request in the trace of a value: the request whose response
+// is the first one with the value, or a later request that sends it back.
+type traceStep struct {
+	row      RequestsTableRow
+	origin   bool
+	location string
+}
+
+// tracedValue is the userdata returned by trace(value) in Lua. The REPL
+// shows the trace of the value when it is the result of the input.
+type tracedValue struct {
+	value string
+}
+
+func doTraceQuery(ctx context.Context, db *sql.DB, value string) ([]traceStep, error) {
+	compiled, values, err := ql.CompileTrace(value)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, compiled, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []traceStep{}
+
+	for rows.Next() {
+		var status int
+		step := traceStep{}
+		if err := rows.Scan(&step.row.Timestamp, &step.row.ID, &step.row.Method, &status, &step.row.URL, &step.origin, &step.location); err != nil {
+			return nil, err
+		}
+		step.row.Status = strconv.Itoa(status)
+		result = append(result, step)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// traceSummary describes where a value comes from and how many requests
+// send it back.
+func traceSummary(value string, steps []traceStep) string {
+	if len(steps) > 0 && steps[0].origin {
+		return fmt.Sprintf("'%s' first seen in the response to request %s (%s), sent back by %d later requests",
+			value, steps[0].row.ID, steps[0].location, len(steps)-1)
+	}
+
+	return fmt.Sprintf("'%s' not found in any response, sent by %d requests", value, len(steps))
+}
+
+// newTraceResultsView shows the trace of a value as a timeline of requests,
+// with the places where the value was found above the request, or the
+// response for the request the value comes from.
+func newTraceResultsView(db *sql.DB, L *lua.LState, value string, steps []traceStep, width, height int) *QueryResultsView {
+	rows := make([]RequestsTableRow, len(steps))
+	stepsById := map[string]traceStep{}
+	for i, s := range steps {
+		rows[i] = s.row
+		stepsById[s.row.ID] = s
+	}
+
+	view := NewQueryResultsView(db, L, rows, width, height)
+	view.requestsTableView.SetUpdateFns(func(r RequestsTableRow, pretty bool) string {
+		req, _, err := getCachedRequestResponse(db, r.ID)
+		if err != nil {
+			return fmt.Sprintf("Error getting request: %v", err)
+		}
+
+		output := requestString(req, pretty)
+		if s := stepsById[r.ID]; !s.origin {
+			output = "Sent in: " + s.location + "\n\n" + output
+		}
+		return output
+	}, func(r RequestsTableRow, pretty bool) string {
+		_, resp, err := getCachedRequestResponse(db, r.ID)
+		if err != nil {
+			return fmt.Sprintf("Error getting response: %v", err)
+		}
+
+		output := responseString(resp, pretty)
+		if s := stepsById[r.ID]; s.origin {
+			output = "Found in: " + s.location + "\n\n" + output
+		}
+		return output
+	})
+	view.requestsTableView.SetSummary(traceSummary(value, steps))
+
+	return view
+}
@@ -0,0 +1,78 @@
+package repl
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDoTraceQuery(t *testing.T) {
+	tests := []struct {
+		value    string
+		steps    []traceStep
+		expected string
+	}{
+		{
+			value: "s3cr3t",
+			steps: []traceStep{
+				{row: RequestsTableRow{ID: "1"}, origin: true, location: "header Set-Cookie, body"},
+				{row: RequestsTableRow{ID: "2"}, location: "header Cookie"},
+				{row: RequestsTableRow{ID: "4"}, location: "url"},
+			},
+			expected: "'s3cr3t' first seen in the response to request 1 (header Set-Cookie, body), sent back by 2 later requests",
+		},
+		{
+			value: "alice",
+			steps: []traceStep{
+				{row: RequestsTableRow{ID: "1"}, origin: true, location: "body"},
+				{row: RequestsTableRow{ID: "2"}, location: "body"},
+			},
+			expected: "'alice' first seen in the response to request 1 (body), sent back by 1 later requests",
+		},
+		{
+			// Values the client sends first have no origin
+			value: "example.com",
+			steps: []traceStep{
+				{row: RequestsTableRow{ID: "1"}, location: "url, header Host"},
+				{row: RequestsTableRow{ID: "2"}, location: "url, header Host"},
+				{row: RequestsTableRow{ID: "4"}, location: "url, header Host"},
+			},
+			expected: "'example.com' not found in any response, sent by 3 requests",
+		},
+		{
+			value:    "nothing",
+			steps:    []traceStep{},
+			expected: "'nothing' not found in any response, sent by 0 requests",
+		},
+	}
+
+	for _, test := range tests {
+		steps, err := doTraceQuery(context.Background(), fixtureDB, test.value)
+		if err != nil {
+			t.Fatalf("%s: %v", test.value, err)
+		}
+
+		if len(steps) != len(test.steps) {
+			t.Errorf("%s: expected %d steps, got %+v", test.value, len(test.steps), steps)
+			continue
+		}
+		for i, s := range steps {
+			e := test.steps[i]
+			if s.row.ID != e.row.ID || s.origin != e.origin || s.location != e.location {
+				t.Errorf("%s: expected step %d to be request %s (origin %v, %s), got request %s (origin %v, %s)",
+					test.value, i, e.row.ID, e.origin, e.location, s.row.ID, s.origin, s.location)
+			}
+		}
+
+		if summary := traceSummary(test.value, steps); summary != test.expected {
+			t.Errorf("%s: expected summary %q, got %q", test.value, test.expected, summary)
+		}
+	}
+}
+
+func TestDoTraceQueryErrors(t *testing.T) {
+	le := newTestEvaluator(t, "/does/not/exist.db")
+
+	if _, err := le.evalTrace(context.Background(), "s3cr3t", 120, 40); err == nil {
+		t.Errorf("expected an error for a missing DB")
+	}
+}